@@ -3,12 +3,15 @@ package blob
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/dotslash/cloudsync/util"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -17,15 +20,42 @@ import (
 )
 import gcs "cloud.google.com/go/storage"
 
-const writerClientIdKey = "WriterClientId"
+const (
+	writerClientIdKey = "WriterClientId"
+	symlinkTargetKey  = "SymlinkTarget"
+)
+
+// internalPrefix (relative to the base path) holds the objects cloudsync keeps for
+// itself. They are never synced.
+const internalPrefix = ".cloudsync"
+
+// Metadata set on the blobs moved to the trash.
+const (
+	deletedByKey    = "DeletedBy"
+	originalPathKey = "OriginalPath"
+)
 
 type MetaEntry struct {
 	BasePath           string
 	RelPath            util.RelPathType
 	Md5                string // hex string of md5
+	Size               int64
 	ModTime            time.Time
 	BlobWriterClientId *string
 	ACLs               []gcs.ACLRule
+	// Not empty if the blob stands for a symlink. The content of the blob is the target.
+	SymlinkTarget string `json:",omitempty"`
+}
+
+// PutOptions are the optional attributes of a blob being written.
+type PutOptions struct {
+	// If not empty, these acls will be used for the newly created / updated blob
+	ACLs []gcs.ACLRule
+	// Marks the blob as a symlink to SymlinkTarget.
+	SymlinkTarget string
+	// The md5 (hex) of the content, if the caller knows it. With Dedup, content
+	// that is already stored is then not read at all.
+	Md5 string
 }
 
 type FullEntry struct {
@@ -34,39 +64,133 @@ type FullEntry struct {
 	Content io.ReadCloser
 }
 
+// Done is returned by MetaIterator.Next when there are no more entries.
+var Done = iterator.Done
+
+// ErrNotExist is returned by GetMeta and Get when there is no such blob.
+var ErrNotExist = gcs.ErrObjectNotExist
+
+// IsRateLimited tells whether err is GCS asking to slow down.
+func IsRateLimited(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests
+}
+
+// MetaIterator goes over the entries of a listing.
+type MetaIterator interface {
+	// Next returns the next entry, or Done if there are no more entries.
+	Next() (*MetaEntry, error)
+}
+
 type Backend interface {
-	ListDirRecursive(prefix string) (map[util.RelPathType]MetaEntry, error)
+	// List returns the blobs under prefix in the (byte) order of their RelPaths.
+	// The blobs are fetched a page at a time while iterating.
+	List(prefix string) MetaIterator
 	GetMeta(name util.RelPathType) (*MetaEntry, error)
 	Delete(name util.RelPathType) error
 	Get(name util.RelPathType) (*FullEntry, error)
 	// Reader will be closed by Put
-        // If acls is not empty, these acls will be used to write
-        // for the newly created / updated blob
-	Put(name util.RelPathType, reader io.ReadCloser, acls []gcs.ACLRule) error
+	Put(name util.RelPathType, reader io.ReadCloser, opts PutOptions) error
+	// Copy copies a blob (content, symlink target and acls) without downloading
+	// it. The copy is marked as written by this machine. Backends that can not
+	// copy on the server side can implement it with CopyByDownload.
+	Copy(from, to util.RelPathType) error
+	// Move renames a blob without downloading it. The moved blob is marked as
+	// written by this machine.
+	Move(from, to util.RelPathType) error
+}
+
+// ListDirRecursive collects all the blobs under prefix in a map.
+func ListDirRecursive(backend Backend, prefix string) (map[util.RelPathType]MetaEntry, error) {
+	ret := make(map[util.RelPathType]MetaEntry)
+	it := backend.List(prefix)
+	for {
+		entry, err := it.Next()
+		if err == Done {
+			return ret, nil
+		} else if err != nil {
+			return nil, err
+		}
+		ret[entry.RelPath] = *entry
+	}
+}
+
+// CopyByDownload implements Backend.Copy by reading the blob and writing it again.
+func CopyByDownload(backend Backend, from, to util.RelPathType) error {
+	entry, err := backend.Get(from)
+	if err != nil {
+		return err
+	}
+	return backend.Put(to, entry.Content, PutOptions{ACLs: entry.ACLs, SymlinkTarget: entry.SymlinkTarget})
+}
+
+// BackendOptions has the optional settings for a backend.
+type BackendOptions struct {
+	// Removed blobs are moved under this prefix (relative to the base path)
+	// instead of being deleted. Empty means no trash.
+	TrashPrefix string
+	// Service account credentials. If empty GOOGLE_APPLICATION_CREDENTIALS is used.
+	CredentialsFile string
+	// Store the content of blobs once per md5 (see dedup.go).
+	Dedup bool
 }
 
 type GcpBackend struct {
-	client     *gcs.Client
-	bucket     *gcs.BucketHandle
-	basePrefix string
-	clientId   string
+	client      *gcs.Client
+	bucket      *gcs.BucketHandle
+	basePrefix  string
+	trashPrefix string
+	clientId    string
+	dedup       bool
+	leaseSeen   *leaseObservation
 }
 
-func (g GcpBackend) Init(bucket string, basePrefix string) *GcpBackend {
+func (g GcpBackend) Init(bucket string, basePrefix string, opts BackendOptions) *GcpBackend {
 	var err error
-	g.client, err = gcs.NewClient(
-		context.TODO(), option.WithCredentialsFile(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")))
+	credentialsFile := opts.CredentialsFile
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	g.client, err = gcs.NewClient(context.TODO(), option.WithCredentialsFile(credentialsFile))
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create client %v", err))
 	}
 	g.bucket = g.client.Bucket(bucket)
 	g.basePrefix = strings.Trim(basePrefix, "/")
+	g.trashPrefix = strings.Trim(opts.TrashPrefix, "/")
 	g.clientId = util.UniqueMachineId
+	g.dedup = opts.Dedup
+	g.leaseSeen = &leaseObservation{}
 	fmt.Println(g.bucket, "--", g.basePrefix)
 	return &g
 }
 
-func (g *GcpBackend) ListDirRecursive(prefix string) (map[util.RelPathType]MetaEntry, error) {
+// Number of objects fetched per list call.
+const listPageSize = 1000
+
+type gcpIterator struct {
+	g        *GcpBackend
+	basePath string
+	it       *gcs.ObjectIterator
+}
+
+func (gi *gcpIterator) Next() (*MetaEntry, error) {
+	for {
+		next, err := gi.it.Next()
+		if err != nil {
+			return nil, err
+		}
+		relPath := strings.TrimPrefix(next.Name, gi.basePath)
+		if relPath == "" || gi.g.isHidden(relPath) {
+			// "" is the base path itself, Eg: a folder placeholder made in the console.
+			continue
+		}
+		return makeMetaEntry(gi.basePath, util.RelPathType(relPath), next), nil
+	}
+}
+
+// List relies on gcs listing the objects in the lexicographic order of their names.
+func (g *GcpBackend) List(prefix string) MetaIterator {
 	basePath := g.basePrefix + prefix
 	if !strings.HasSuffix(basePath, "/") {
 		basePath = basePath + "/"
@@ -79,92 +203,201 @@ func (g *GcpBackend) ListDirRecursive(prefix string) (map[util.RelPathType]MetaE
 		Versions:   false,
 		Projection: gcs.ProjectionFull,
 	})
-	ret := make(map[util.RelPathType]MetaEntry)
-	for {
-		next, err := it.Next()
-		if err == iterator.Done {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-		entry := MetaEntry{
-			BasePath: basePath,
-			RelPath:  util.RelPathType(strings.TrimPrefix(next.Name, basePath)),
-			Md5:      hex.EncodeToString(next.MD5),
-			ModTime:  next.Updated,
-			ACLs:     next.ACL,
-		}
-		writerClientId, ok := next.Metadata[writerClientIdKey]
-		if ok {
-			entry.BlobWriterClientId = &writerClientId
-		}
+	it.PageInfo().MaxSize = listPageSize
+	return &gcpIterator{g: g, basePath: basePath, it: it}
+}
+
+func makeMetaEntry(basePath string, relPath util.RelPathType, attrs *gcs.ObjectAttrs) *MetaEntry {
+	ret := &MetaEntry{
+		BasePath:      basePath,
+		RelPath:       relPath,
+		Md5:           hex.EncodeToString(attrs.MD5),
+		Size:          attrs.Size,
+		ModTime:       attrs.Updated,
+		ACLs:          attrs.ACL,
+		SymlinkTarget: attrs.Metadata[symlinkTargetKey],
+	}
+	writerClientId, ok := attrs.Metadata[writerClientIdKey]
+	if ok {
+		ret.BlobWriterClientId = &writerClientId
+	}
+	// For pointers (see dedup.go) report the content they point to.
+	if ref, ok := parseContentRef(attrs); ok {
+		ret.Md5, ret.Size = ref.md5, ref.size
+	}
+	return ret
+}
 
-		ret[entry.RelPath] = entry
+// HiddenPrefixes are the prefixes (relative to the base path) of the objects a
+// backend with opts does not list: the trash and the internal objects.
+func HiddenPrefixes(opts BackendOptions) []string {
+	ret := []string{internalPrefix + "/"}
+	if trashPrefix := strings.Trim(opts.TrashPrefix, "/"); trashPrefix != "" {
+		ret = append(ret, trashPrefix+"/")
 	}
-	return ret, nil
+	return ret
+}
+
+// isHidden is true for the trash and the internal objects.
+func (g *GcpBackend) isHidden(relPath string) bool {
+	return strings.HasPrefix(relPath, internalPrefix+"/") ||
+		(g.trashPrefix != "" && strings.HasPrefix(relPath, g.trashPrefix+"/"))
 }
 
+// objectName is the object of a blob. Directory markers keep their trailing "/",
+// which path.Join drops.
+func (g *GcpBackend) objectName(name util.RelPathType) string {
+	ret := path.Join(g.basePrefix, name.String())
+	if name.IsDir() {
+		ret += "/"
+	}
+	return ret
+}
+
+// Delete removes the blob. If the backend has a trash, the blob (unless it is a
+// directory marker) is first copied to <trash prefix>/<time of deletion>/<name>.
 func (g *GcpBackend) Delete(name util.RelPathType) error {
-	return g.bucket.Object(path.Join(g.basePrefix, name.String())).Delete(context.TODO())
+	o := g.bucket.Object(g.objectName(name))
+	// Directory markers are not worth keeping in the trash.
+	if g.trashPrefix != "" && !name.IsDir() {
+		trashName := path.Join(g.basePrefix, g.trashPrefix, time.Now().UTC().Format(util.TrashTimeFormat), name.String())
+		attrs, err := o.Attrs(context.TODO())
+		if err != nil {
+			return err
+		}
+		log.Printf("Moving %v:%v to trash %v", o.BucketName(), o.ObjectName(), trashName)
+		err = g.copyObject(attrs, g.bucket.Object(trashName), map[string]string{
+			deletedByKey:    g.clientId,
+			originalPathKey: name.String(),
+		})
+		if err != nil {
+			return err
+		}
+		// Only delete what went to the trash.
+		o = o.If(gcs.Conditions{GenerationMatch: attrs.Generation})
+	}
+	return o.Delete(context.TODO())
 }
 
 func (g *GcpBackend) GetMeta(name util.RelPathType) (*MetaEntry, error) {
-	attrs, err := g.bucket.Object(path.Join(g.basePrefix, name.String())).Attrs(context.TODO())
+	attrs, err := g.bucket.Object(g.objectName(name)).Attrs(context.TODO())
 	if err != nil {
 		return nil, err
 	}
-	ret := &MetaEntry{
-		BasePath: g.basePrefix,
-		RelPath:  name,
-		Md5:      hex.EncodeToString(attrs.MD5),
-		ModTime:  attrs.Updated,
-		ACLs:     attrs.ACL,
-	}
-	writerClientId, ok := attrs.Metadata[writerClientIdKey]
-	if ok {
-		ret.BlobWriterClientId = &writerClientId
-	}
-	return ret, nil
+	return makeMetaEntry(g.basePrefix, name, attrs), nil
 }
 
 func (g *GcpBackend) Get(name util.RelPathType) (*FullEntry, error) {
-	o := g.bucket.Object(path.Join(g.basePrefix, name.String()))
-	if attrs, err := o.Attrs(context.TODO()); err != nil {
+	o := g.bucket.Object(g.objectName(name))
+	attrs, err := o.Attrs(context.TODO())
+	if err != nil {
 		return nil, err
-	} else if reader, err := o.NewReader(context.TODO()); err != nil {
+	}
+	contentObj := o.If(gcs.Conditions{GenerationMatch: attrs.Generation})
+	if ref, ok := parseContentRef(attrs); ok {
+		contentObj = g.contentObject(ref.md5)
+	}
+	if reader, err := contentObj.NewReader(context.TODO()); err != nil {
 		return nil, err
 	} else {
 		return &FullEntry{
-			MetaEntry: &MetaEntry{
-				BasePath: g.basePrefix,
-				RelPath:  name,
-				Md5:      hex.EncodeToString(attrs.MD5),
-				ModTime:  attrs.Updated,
-			},
-			Content: reader,
+			MetaEntry: makeMetaEntry(g.basePrefix, name, attrs),
+			Content:   reader,
 		}, nil
 	}
 }
 
-func (g *GcpBackend) Put(name util.RelPathType, reader io.ReadCloser, acls []gcs.ACLRule) error {
-	o := g.bucket.Object(path.Join(g.basePrefix, name.String()))
+func (g *GcpBackend) Put(name util.RelPathType, reader io.ReadCloser, opts PutOptions) error {
+	defer reader.Close()
+	if g.dedup && !name.IsDir() {
+		return g.putDedup(name, reader, opts)
+	}
+	o := g.bucket.Object(g.objectName(name))
 	log.Printf("Writing to %v:%v", o.BucketName(), o.ObjectName())
-        w := o.NewWriter(context.TODO())
+	w := o.NewWriter(context.TODO())
 	// Set client id attribute
-        if w.ObjectAttrs.Metadata == nil {
+	if w.ObjectAttrs.Metadata == nil {
 		w.ObjectAttrs.Metadata = make(map[string]string)
 	}
 	w.ObjectAttrs.Metadata[writerClientIdKey] = g.clientId
-        // Set acls if present
-	if len(acls) != 0 {
-		w.ACL = acls
+	if opts.SymlinkTarget != "" {
+		w.ObjectAttrs.Metadata[symlinkTargetKey] = opts.SymlinkTarget
+	}
+	// Set acls if present
+	if len(opts.ACLs) != 0 {
+		w.ACL = opts.ACLs
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		_ = w.CloseWithError(err)
+		return err
+	}
+	// The upload is only done (or failed) once the writer is closed.
+	return w.Close()
+}
+
+// copyObject copies the object described by srcAttrs to dst on the server side
+// (with the rewrite api, which is a metadata only operation within a location and
+// storage class). The copy has the metadata and acls of the source with
+// extraMetadata on top (an empty value removes the key). It fails if the source
+// changed since srcAttrs were read.
+func (g *GcpBackend) copyObject(srcAttrs *gcs.ObjectAttrs, dst *gcs.ObjectHandle, extraMetadata map[string]string) error {
+	src := g.bucket.Object(srcAttrs.Name).If(gcs.Conditions{GenerationMatch: srcAttrs.Generation})
+	copier := dst.CopierFrom(src)
+	copier.ContentType = srcAttrs.ContentType
+	copier.Metadata = make(map[string]string)
+	for k, v := range srcAttrs.Metadata {
+		copier.Metadata[k] = v
+	}
+	for k, v := range extraMetadata {
+		if v == "" {
+			delete(copier.Metadata, k)
+		} else {
+			copier.Metadata[k] = v
+		}
+	}
+	copier.ACL = srcAttrs.ACL
+	// Large objects across locations or storage classes take several rewrite calls.
+	copier.ProgressFunc = func(copied, total uint64) {
+		if copied < total {
+			log.Printf("Copying %v to %v: %v/%v bytes", srcAttrs.Name, dst.ObjectName(), copied, total)
+		}
 	}
-	return util.CopyAndClose(w, reader)
+	_, err := copier.Run(context.TODO())
+	return err
+}
+
+func (g *GcpBackend) Copy(from, to util.RelPathType) error {
+	src := g.bucket.Object(g.objectName(from))
+	dst := g.bucket.Object(g.objectName(to))
+	attrs, err := src.Attrs(context.TODO())
+	if err != nil {
+		return err
+	}
+	log.Printf("Copying %v:%v to %v", src.BucketName(), src.ObjectName(), dst.ObjectName())
+	return g.copyObject(attrs, dst, map[string]string{writerClientIdKey: g.clientId})
+}
+
+func (g *GcpBackend) Move(from, to util.RelPathType) error {
+	src := g.bucket.Object(g.objectName(from))
+	dst := g.bucket.Object(g.objectName(to))
+	attrs, err := src.Attrs(context.TODO())
+	if err != nil {
+		return err
+	}
+	log.Printf("Moving %v:%v to %v", src.BucketName(), src.ObjectName(), dst.ObjectName())
+	if err = g.copyObject(attrs, dst, map[string]string{writerClientIdKey: g.clientId}); err != nil {
+		return err
+	}
+	return src.If(gcs.Conditions{GenerationMatch: attrs.Generation}).Delete(context.TODO())
+}
+
+func NewBackend(baseURL url.URL, trashPrefix string) Backend {
+	return NewBackendWithOptions(baseURL, BackendOptions{TrashPrefix: trashPrefix})
 }
 
-func NewBackend(baseURL url.URL, _ string) Backend {
+func NewBackendWithOptions(baseURL url.URL, opts BackendOptions) Backend {
 	if baseURL.Scheme != "gs" {
 		panic("Wrong scheme" + baseURL.String())
 	}
-	return GcpBackend{}.Init(baseURL.Host, baseURL.Path)
+	return GcpBackend{}.Init(baseURL.Host, baseURL.Path, opts)
 }
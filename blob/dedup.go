@@ -0,0 +1,232 @@
+package blob
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dotslash/cloudsync/util"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+import gcs "cloud.google.com/go/storage"
+
+// With BackendOptions.Dedup the content of a blob is stored once under
+// <base>/.cloudsync/content/<md5> and the blob itself is an empty pointer object
+// whose metadata has the md5 and size of the content. Writing a blob whose
+// content is already known uploads nothing but the pointer.
+//
+// Pointers are read even without Dedup, so the layout can be switched on and
+// off. Content that is not referenced by any pointer (including the ones in the
+// trash) is removed by CollectGarbage.
+
+const (
+	contentMd5Key  = "ContentMd5"
+	contentSizeKey = "ContentSize"
+	contentDir     = "content"
+	// Set on the content each time a Put reuses it. See touchContent.
+	contentReusedKey = "LastReused"
+)
+
+// Content uploaded (or reused, see touchContent) less than this long ago is not
+// garbage collected. Put stores the content before it writes the pointer, so a
+// concurrent Put could otherwise lose its content.
+const gcGracePeriod = time.Hour
+
+type contentRef struct {
+	md5  string
+	size int64
+}
+
+func parseContentRef(attrs *gcs.ObjectAttrs) (contentRef, bool) {
+	md5Hex, ok := attrs.Metadata[contentMd5Key]
+	if !ok {
+		return contentRef{}, false
+	}
+	size, err := strconv.ParseInt(attrs.Metadata[contentSizeKey], 10, 64)
+	if err != nil {
+		log.Printf("parseContentRef: bad %v in %v - %v", contentSizeKey, attrs.Name, err)
+		return contentRef{}, false
+	}
+	return contentRef{md5: md5Hex, size: size}, true
+}
+
+func (g *GcpBackend) contentPrefix() string {
+	return path.Join(g.basePrefix, internalPrefix, contentDir) + "/"
+}
+
+func (g *GcpBackend) contentObject(md5Hex string) *gcs.ObjectHandle {
+	return g.bucket.Object(g.contentPrefix() + md5Hex)
+}
+
+// spool copies reader to a temp file and returns the file (at offset 0) and the
+// md5 of its content. The caller should close and remove the file.
+func spool(reader io.Reader) (*os.File, contentRef, error) {
+	file, err := os.CreateTemp("", "cloudsync-put-*")
+	if err != nil {
+		return nil, contentRef{}, err
+	}
+	hasher := md5.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), reader)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, contentRef{}, err
+	}
+	return file, contentRef{md5: hex.EncodeToString(hasher.Sum(nil)), size: size}, nil
+}
+
+// touchContent marks stored content as reused before a pointer to it is written.
+// Updating its metadata bumps its Updated time and metageneration, so that a
+// CollectGarbage that listed the pointers before this one neither picks it (see
+// gcGracePeriod) nor removes it (its delete has a metageneration precondition).
+func (g *GcpBackend) touchContent(md5Hex string) (*gcs.ObjectAttrs, error) {
+	return g.contentObject(md5Hex).Update(context.TODO(), gcs.ObjectAttrsToUpdate{
+		Metadata: map[string]string{contentReusedKey: time.Now().UTC().Format(time.RFC3339)},
+	})
+}
+
+func (g *GcpBackend) putDedup(name util.RelPathType, reader io.Reader, opts PutOptions) error {
+	if opts.Md5 != "" {
+		// Known content is not even read.
+		if attrs, err := g.touchContent(opts.Md5); err == nil {
+			log.Printf("Content of %v (%v) is already stored. Only writing the pointer", name, opts.Md5)
+			return g.writePointer(name, contentRef{md5: opts.Md5, size: attrs.Size}, opts)
+		} else if err != gcs.ErrObjectNotExist {
+			return err
+		}
+	}
+	file, ref, err := spool(reader)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	content := g.contentObject(ref.md5)
+	if _, err = g.touchContent(ref.md5); err == nil {
+		log.Printf("Content of %v (%v) is already stored. Only writing the pointer", name, ref.md5)
+	} else if err != gcs.ErrObjectNotExist {
+		return err
+	} else {
+		log.Printf("Writing content of %v to %v:%v", name, content.BucketName(), content.ObjectName())
+		// DoesNotExist => if someone else stored the same content meanwhile, the
+		// upload fails with a precondition error, which is fine.
+		w := content.If(gcs.Conditions{DoesNotExist: true}).NewWriter(context.TODO())
+		w.MD5, _ = hex.DecodeString(ref.md5)
+		if _, err = io.Copy(w, file); err != nil {
+			_ = w.CloseWithError(err)
+			return err
+		}
+		if err = w.Close(); err != nil && !isPreconditionFailed(err) {
+			return err
+		}
+	}
+	return g.writePointer(name, ref, opts)
+}
+
+func (g *GcpBackend) writePointer(name util.RelPathType, ref contentRef, opts PutOptions) error {
+	o := g.bucket.Object(g.objectName(name))
+	log.Printf("Writing pointer %v:%v -> %v", o.BucketName(), o.ObjectName(), ref.md5)
+	w := o.NewWriter(context.TODO())
+	w.Metadata = map[string]string{
+		writerClientIdKey: g.clientId,
+		contentMd5Key:     ref.md5,
+		contentSizeKey:    strconv.FormatInt(ref.size, 10),
+	}
+	if opts.SymlinkTarget != "" {
+		w.Metadata[symlinkTargetKey] = opts.SymlinkTarget
+	}
+	if len(opts.ACLs) != 0 {
+		w.ACL = opts.ACLs
+	}
+	return w.Close()
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// GarbageCollector is implemented by the backends that can have unreferenced content.
+type GarbageCollector interface {
+	// CollectGarbage removes the content that is not referenced by any blob and
+	// returns what was (or with dryRun, would be) removed.
+	CollectGarbage(dryRun bool) ([]string, error)
+}
+
+func (g *GcpBackend) CollectGarbage(dryRun bool) ([]string, error) {
+	contentPrefix := g.contentPrefix()
+	listPrefix := g.basePrefix + "/"
+	if g.basePrefix == "" {
+		listPrefix = ""
+	}
+	// Everything under the base path, including the trash and the noncurrent
+	// versions of the blobs (see Versioner), can point to content.
+	referenced := make(map[string]bool)
+	type contentObj struct {
+		name           string
+		generation     int64
+		metageneration int64
+		// Of the last upload or reuse. Zero for noncurrent versions.
+		updated time.Time
+	}
+	var contents []contentObj
+	it := g.bucket.Objects(context.TODO(), &gcs.Query{Prefix: listPrefix, Versions: true})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(attrs.Name, contentPrefix) {
+			c := contentObj{name: attrs.Name, generation: attrs.Generation, metageneration: attrs.Metageneration}
+			if attrs.Deleted.IsZero() {
+				c.updated = attrs.Updated
+			}
+			// Noncurrent versions of content are never read: a pointer reads the
+			// current one. They are all garbage.
+			contents = append(contents, c)
+		} else if ref, ok := parseContentRef(attrs); ok {
+			referenced[ref.md5] = true
+		}
+	}
+	var removed []string
+	for _, c := range contents {
+		md5Hex := strings.TrimPrefix(c.name, contentPrefix)
+		current := !c.updated.IsZero()
+		if current && (referenced[md5Hex] || time.Since(c.updated) < gcGracePeriod) {
+			continue
+		}
+		if dryRun {
+			removed = append(removed, c.name)
+			continue
+		}
+		log.Printf("CollectGarbage: removing unreferenced content %v#%v", c.name, c.generation)
+		// Deleting the generation frees it for good with object versioning too. The
+		// metageneration changes when a Put reuses the content (see touchContent).
+		err := g.bucket.Object(c.name).Generation(c.generation).
+			If(gcs.Conditions{MetagenerationMatch: c.metageneration}).Delete(context.TODO())
+		if isPreconditionFailed(err) {
+			log.Printf("CollectGarbage: %v was reused meanwhile, keeping it", c.name)
+			continue
+		} else if err != nil && err != gcs.ErrObjectNotExist {
+			return removed, fmt.Errorf("deleting %v failed - %v", c.name, err)
+		}
+		removed = append(removed, c.name)
+	}
+	return removed, nil
+}
@@ -0,0 +1,186 @@
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dotslash/cloudsync/util"
+	"google.golang.org/api/iterator"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+import gcs "cloud.google.com/go/storage"
+
+// The journals, relative to the internal prefix. Each machine has its own
+// directory with one object per append, named by the time of its last entry.
+const (
+	journalDir        = "journal"
+	journalTimeFormat = "20060102T150405.000000000Z"
+)
+
+// Operations of JournalEntry.
+const (
+	JournalUpload = "upload"
+	JournalDelete = "delete"
+	JournalMove   = "move"
+	JournalCopy   = "copy"
+)
+
+// JournalEntry is an operation a machine did on the remote.
+type JournalEntry struct {
+	Time    time.Time        `json:"time"`
+	Machine string           `json:"machine"`
+	Pair    string           `json:"pair,omitempty"`
+	Op      string           `json:"op"`
+	Path    util.RelPathType `json:"path"`
+	// The source of a move or copy.
+	From util.RelPathType `json:"from,omitempty"`
+	// Of the content written, or removed by a delete. Empty if not known.
+	Md5  string `json:"md5,omitempty"`
+	Size int64  `json:"size,omitempty"`
+}
+
+// JournalObject is one append to the journal of a machine.
+type JournalObject struct {
+	// Relative to the journal dir: <machine>/<time>.jsonl.
+	Name string `json:"name"`
+	// The time of its last entry.
+	Last time.Time `json:"last"`
+	Size int64     `json:"size"`
+}
+
+// Journaler is implemented by the backends that keep a journal of the operations
+// of each machine.
+type Journaler interface {
+	// AppendJournal adds the entries (oldest first) to the journal of this machine.
+	AppendJournal(entries []JournalEntry) error
+	// ReadJournal returns the entries of machine (all the machines if empty) from
+	// since on, oldest first.
+	ReadJournal(machine string, since time.Time) ([]JournalEntry, error)
+	// JournalObjects returns the appends of all the machines whose entries are all
+	// older than before.
+	JournalObjects(before time.Time) ([]JournalObject, error)
+	// RemoveJournalObject removes an append returned by JournalObjects.
+	RemoveJournalObject(name string) error
+}
+
+func (g *GcpBackend) journalPrefix() string {
+	return path.Join(g.basePrefix, internalPrefix, journalDir) + "/"
+}
+
+func (g *GcpBackend) AppendJournal(entries []JournalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for _, e := range entries {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	name := g.journalPrefix() + url.PathEscape(g.clientId) + "/" +
+		entries[len(entries)-1].Time.UTC().Format(journalTimeFormat) + ".jsonl"
+	w := g.bucket.Object(name).If(gcs.Conditions{DoesNotExist: true}).NewWriter(context.TODO())
+	w.ContentType = "application/x-ndjson"
+	if _, err := w.Write(data.Bytes()); err != nil {
+		_ = w.CloseWithError(err)
+		return err
+	}
+	return w.Close()
+}
+
+func (g *GcpBackend) ReadJournal(machine string, since time.Time) ([]JournalEntry, error) {
+	prefix := g.journalPrefix()
+	if machine != "" {
+		prefix += url.PathEscape(machine) + "/"
+	}
+	it := g.bucket.Objects(context.TODO(), &gcs.Query{Prefix: prefix})
+	it.PageInfo().MaxSize = listPageSize
+	var ret []JournalEntry
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		lastTime, ok := journalTime(attrs.Name)
+		if !ok || lastTime.Before(since) {
+			continue
+		}
+		entries, err := g.readJournalObject(attrs.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.Time.Before(since) {
+				ret = append(ret, e)
+			}
+		}
+	}
+	// The machines are listed one after the other.
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret, nil
+}
+
+// journalTime returns the time of the last entry of a journal object, which is
+// in its name.
+func journalTime(name string) (time.Time, bool) {
+	t, err := time.Parse(journalTimeFormat, strings.TrimSuffix(path.Base(name), ".jsonl"))
+	return t, err == nil
+}
+
+func (g *GcpBackend) JournalObjects(before time.Time) ([]JournalObject, error) {
+	prefix := g.journalPrefix()
+	it := g.bucket.Objects(context.TODO(), &gcs.Query{Prefix: prefix})
+	it.PageInfo().MaxSize = listPageSize
+	var ret []JournalObject
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if lastTime, ok := journalTime(attrs.Name); ok && lastTime.Before(before) {
+			ret = append(ret, JournalObject{Name: strings.TrimPrefix(attrs.Name, prefix), Last: lastTime, Size: attrs.Size})
+		}
+	}
+	return ret, nil
+}
+
+func (g *GcpBackend) RemoveJournalObject(name string) error {
+	if _, ok := journalTime(name); !ok || strings.Count(name, "/") != 1 || strings.Contains(name, "..") {
+		return fmt.Errorf("%v is not a journal object", name)
+	}
+	err := g.bucket.Object(g.journalPrefix() + name).Delete(context.TODO())
+	if err == gcs.ErrObjectNotExist {
+		return ErrNotExist
+	}
+	return err
+}
+
+func (g *GcpBackend) readJournalObject(name string) ([]JournalEntry, error) {
+	reader, err := g.bucket.Object(name).NewReader(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var ret []JournalEntry
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("bad journal entry in %v - %v", name, err)
+		}
+		ret = append(ret, e)
+	}
+	return ret, scanner.Err()
+}
@@ -0,0 +1,174 @@
+package blob
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+)
+import gcs "cloud.google.com/go/storage"
+
+// The lease object, relative to the internal prefix.
+const leaseObject = "lease"
+
+// LeaseInfo describes the holder of a lease.
+type LeaseInfo struct {
+	// Client id of the machine holding it.
+	Holder   string        `json:"holder"`
+	Acquired time.Time     `json:"acquired"`
+	TTL      time.Duration `json:"ttl"`
+	// When the lease object was last written, by the clock of the server.
+	Renewed time.Time `json:"renewed"`
+	Expires time.Time `json:"expires"`
+}
+
+// leaseContent is what the lease object holds. Its generation is the version of
+// the lease.
+type leaseContent struct {
+	Holder   string        `json:"holder"`
+	Acquired time.Time     `json:"acquired"`
+	TTL      time.Duration `json:"ttl"`
+}
+
+// leaseObservation is when this process first saw a generation of the lease
+// object. A lease expires when its generation did not change for its ttl, as
+// measured here: the clocks of the machines and of the server are never
+// compared.
+type leaseObservation struct {
+	mu         sync.Mutex
+	generation int64
+	since      time.Time
+}
+
+// expired records that generation is the current one and tells whether it has
+// been for ttl.
+func (o *leaseObservation) expired(generation int64, ttl time.Duration) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.generation != generation || o.since.IsZero() {
+		o.generation, o.since = generation, time.Now()
+	}
+	return time.Since(o.since) >= ttl
+}
+
+// LeaseHeldError is returned by Leaser.AcquireLease when another machine holds
+// the lease.
+type LeaseHeldError struct {
+	Info LeaseInfo
+}
+
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf("the lease is held by %v until %v", e.Info.Holder, e.Info.Expires.Local().Format(time.RFC3339))
+}
+
+// Leaser is implemented by the backends that can hold a lease, so that machines
+// sharing a remote can take turns at modifying it.
+type Leaser interface {
+	// AcquireLease takes the lease for this machine, or renews it if this machine
+	// holds it, so that it expires ttl from now. It fails with *LeaseHeldError if
+	// another machine holds a lease that did not expire. A lease of another machine
+	// expires once this one saw it not renewed for its ttl, so a stale lease is
+	// only taken over by a later call.
+	AcquireLease(ttl time.Duration) (*LeaseInfo, error)
+	// ReleaseLease gives up the lease if this machine holds it.
+	ReleaseLease() error
+	// GetLease returns the current lease, nil if there is none. It can be expired.
+	GetLease() (*LeaseInfo, error)
+}
+
+func (g *GcpBackend) leaseObject() *gcs.ObjectHandle {
+	return g.bucket.Object(path.Join(g.basePrefix, internalPrefix, leaseObject))
+}
+
+// readLease returns the lease and its generation. A nil lease means there is none.
+func (g *GcpBackend) readLease() (*LeaseInfo, int64, error) {
+	reader, err := g.leaseObject().NewReader(context.TODO())
+	if err == gcs.ErrObjectNotExist {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	var content leaseContent
+	if err = json.Unmarshal(data, &content); err != nil {
+		return nil, 0, fmt.Errorf("bad lease object - %v", err)
+	}
+	return makeLeaseInfo(content, reader.Attrs.LastModified), reader.Attrs.Generation, nil
+}
+
+func makeLeaseInfo(content leaseContent, renewed time.Time) *LeaseInfo {
+	return &LeaseInfo{
+		Holder:   content.Holder,
+		Acquired: content.Acquired,
+		TTL:      content.TTL,
+		Renewed:  renewed,
+		Expires:  renewed.Add(content.TTL),
+	}
+}
+
+func (g *GcpBackend) GetLease() (*LeaseInfo, error) {
+	info, _, err := g.readLease()
+	return info, err
+}
+
+func (g *GcpBackend) AcquireLease(ttl time.Duration) (*LeaseInfo, error) {
+	current, generation, err := g.readLease()
+	if err != nil {
+		return nil, err
+	}
+	content := leaseContent{Holder: g.clientId, Acquired: time.Now(), TTL: ttl}
+	o := g.leaseObject().If(gcs.Conditions{DoesNotExist: true})
+	if current != nil {
+		expired := g.leaseSeen.expired(generation, current.TTL)
+		if current.Holder != g.clientId && !expired {
+			return nil, &LeaseHeldError{Info: *current}
+		} else if current.Holder == g.clientId && !expired {
+			content.Acquired = current.Acquired
+		}
+		// Only replace the version that was looked at.
+		o = g.leaseObject().If(gcs.Conditions{GenerationMatch: generation})
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	w := o.NewWriter(context.TODO())
+	w.ContentType = "application/json"
+	if _, err = w.Write(data); err != nil {
+		_ = w.CloseWithError(err)
+		return nil, err
+	}
+	if err = w.Close(); isPreconditionFailed(err) {
+		// Another machine got there first.
+		if current, _, err = g.readLease(); err != nil {
+			return nil, err
+		} else if current != nil {
+			return nil, &LeaseHeldError{Info: *current}
+		}
+		return nil, fmt.Errorf("the lease changed while acquiring it")
+	} else if err != nil {
+		return nil, err
+	}
+	g.leaseSeen.expired(w.Attrs().Generation, ttl)
+	return makeLeaseInfo(content, w.Attrs().Updated), nil
+}
+
+func (g *GcpBackend) ReleaseLease() error {
+	current, generation, err := g.readLease()
+	if err != nil || current == nil || current.Holder != g.clientId {
+		return err
+	}
+	err = g.leaseObject().If(gcs.Conditions{GenerationMatch: generation}).Delete(context.TODO())
+	if err == gcs.ErrObjectNotExist || isPreconditionFailed(err) {
+		// Expired and taken over meanwhile.
+		return nil
+	}
+	return err
+}
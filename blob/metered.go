@@ -0,0 +1,125 @@
+package blob
+
+import (
+	"github.com/dotslash/cloudsync/metrics"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"time"
+)
+
+var (
+	backendCallSeconds = metrics.Default.NewHistogramVec("cloudsync_backend_call_duration_seconds",
+		"Latency of the calls to the blob backend.", nil, "pair", "method", "result")
+	backendBytes = metrics.Default.NewCounterVec("cloudsync_bytes_transferred_total",
+		"Bytes uploaded to and downloaded from the blob backend.", "pair", "direction")
+)
+
+// meteredBackend exports the latency of every backend call and the number of
+// bytes going through Put and Get.
+type meteredBackend struct {
+	Backend
+	pair string
+}
+
+// NewMeteredBackend wraps backend so that its calls are recorded in
+// metrics.Default with the given pair label.
+func NewMeteredBackend(backend Backend, pair string) Backend {
+	return &meteredBackend{Backend: backend, pair: pair}
+}
+
+func (m *meteredBackend) observe(method string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	backendCallSeconds.ObserveSince(start, m.pair, method, result)
+}
+
+type countingReader struct {
+	reader io.ReadCloser
+	count  func(n int)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.reader.Close()
+}
+
+func (m *meteredBackend) countBytes(reader io.ReadCloser, direction string) io.ReadCloser {
+	return &countingReader{reader: reader, count: func(n int) {
+		if n > 0 {
+			backendBytes.Add(float64(n), m.pair, direction)
+		}
+	}}
+}
+
+type meteredIterator struct {
+	m     *meteredBackend
+	it    MetaIterator
+	start time.Time
+	done  bool
+}
+
+// Next records the latency of the whole listing once it is done.
+func (mi *meteredIterator) Next() (*MetaEntry, error) {
+	entry, err := mi.it.Next()
+	if err != nil && !mi.done {
+		mi.done = true
+		if err == Done {
+			mi.m.observe("List", mi.start, nil)
+		} else {
+			mi.m.observe("List", mi.start, err)
+		}
+	}
+	return entry, err
+}
+
+func (m *meteredBackend) List(prefix string) MetaIterator {
+	return &meteredIterator{m: m, it: m.Backend.List(prefix), start: time.Now()}
+}
+
+func (m *meteredBackend) GetMeta(name util.RelPathType) (ret *MetaEntry, err error) {
+	start := time.Now()
+	defer func() { m.observe("GetMeta", start, err) }()
+	return m.Backend.GetMeta(name)
+}
+
+func (m *meteredBackend) Delete(name util.RelPathType) (err error) {
+	start := time.Now()
+	defer func() { m.observe("Delete", start, err) }()
+	return m.Backend.Delete(name)
+}
+
+// The latency of Get only covers opening the blob, not reading it.
+func (m *meteredBackend) Get(name util.RelPathType) (ret *FullEntry, err error) {
+	start := time.Now()
+	defer func() { m.observe("Get", start, err) }()
+	if ret, err = m.Backend.Get(name); err != nil {
+		return nil, err
+	}
+	ret.Content = m.countBytes(ret.Content, "download")
+	return ret, nil
+}
+
+func (m *meteredBackend) Put(name util.RelPathType, reader io.ReadCloser, opts PutOptions) (err error) {
+	start := time.Now()
+	defer func() { m.observe("Put", start, err) }()
+	return m.Backend.Put(name, m.countBytes(reader, "upload"), opts)
+}
+
+func (m *meteredBackend) Copy(from, to util.RelPathType) (err error) {
+	start := time.Now()
+	defer func() { m.observe("Copy", start, err) }()
+	return m.Backend.Copy(from, to)
+}
+
+func (m *meteredBackend) Move(from, to util.RelPathType) (err error) {
+	start := time.Now()
+	defer func() { m.observe("Move", start, err) }()
+	return m.Backend.Move(from, to)
+}
@@ -0,0 +1,34 @@
+package blob
+
+import (
+	"github.com/dotslash/cloudsync/util"
+	"io"
+)
+
+// throttledBackend limits the rate at which content flows through Put and Get.
+// All the other calls are passed through to the wrapped backend as is.
+type throttledBackend struct {
+	Backend
+	upload   *util.RateLimiter
+	download *util.RateLimiter
+}
+
+// NewThrottledBackend wraps backend so that uploads and downloads are limited by
+// the given limiters. Either of them can be nil (no limit). The limiters can be
+// shared between backends and their rates can be changed while syncing.
+func NewThrottledBackend(backend Backend, upload, download *util.RateLimiter) Backend {
+	return &throttledBackend{Backend: backend, upload: upload, download: download}
+}
+
+func (t *throttledBackend) Put(name util.RelPathType, reader io.ReadCloser, opts PutOptions) error {
+	return t.Backend.Put(name, util.NewThrottledReader(reader, t.upload), opts)
+}
+
+func (t *throttledBackend) Get(name util.RelPathType) (*FullEntry, error) {
+	entry, err := t.Backend.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	entry.Content = util.NewThrottledReader(entry.Content, t.download)
+	return entry, nil
+}
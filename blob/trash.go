@@ -0,0 +1,143 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"github.com/dotslash/cloudsync/util"
+	"google.golang.org/api/iterator"
+	"path"
+	"strings"
+	"time"
+)
+import gcs "cloud.google.com/go/storage"
+
+// TrashEntry is a blob in the trash.
+type TrashEntry struct {
+	// Relative to the base path: <trash prefix>/<time of deletion>/<original path>.
+	TrashPath    util.RelPathType
+	OriginalPath util.RelPathType
+	DeletedAt    time.Time
+	// Client id of the machine that deleted it. Empty if not known.
+	DeletedBy string
+	Size      int64
+	Md5       string
+}
+
+// ErrExists is returned by Trash.Restore when the destination has a blob.
+var ErrExists = fmt.Errorf("the blob exists")
+
+// Trash is implemented by the backends that keep removed blobs (and by the local
+// trash of a syncer, see syncer.LocalTrash).
+type Trash interface {
+	// ListTrash returns the trashed blobs whose original path starts with prefix,
+	// oldest first.
+	ListTrash(prefix string) ([]TrashEntry, error)
+	// Restore moves a trashed blob back to to (its original path if empty). It
+	// fails with ErrExists if there is a blob there.
+	Restore(trashPath, to util.RelPathType) error
+	// Purge removes a trashed blob for good.
+	Purge(trashPath util.RelPathType) error
+}
+
+// RestoredPath is where a trashed blob is restored when its original path is
+// taken: "dir/name.restored-<time of removal>.ext".
+func RestoredPath(original util.RelPathType, deletedAt time.Time) util.RelPathType {
+	dir, name := path.Split(original.String())
+	ext := path.Ext(name)
+	if ext == name {
+		// Dot files like ".bashrc" have no extension.
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	return util.RelPathType(dir + stem + ".restored-" + deletedAt.UTC().Format("20060102T150405") + ext)
+}
+
+func (g *GcpBackend) ListTrash(prefix string) ([]TrashEntry, error) {
+	if g.trashPrefix == "" {
+		return nil, fmt.Errorf("the backend has no trash")
+	}
+	trashBase := path.Join(g.basePrefix, g.trashPrefix) + "/"
+	it := g.bucket.Objects(context.TODO(), &gcs.Query{Prefix: trashBase})
+	it.PageInfo().MaxSize = listPageSize
+	var ret []TrashEntry
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		deletedAt, original, ok := util.ParseTrashPath(strings.TrimPrefix(attrs.Name, trashBase))
+		if !ok {
+			continue
+		}
+		if p := attrs.Metadata[originalPathKey]; p != "" {
+			original = util.RelPathType(p)
+		}
+		if !strings.HasPrefix(original.String(), prefix) {
+			continue
+		}
+		meta := makeMetaEntry(g.basePrefix, util.RelPathType(strings.TrimPrefix(attrs.Name, g.basePrefix+"/")), attrs)
+		ret = append(ret, TrashEntry{
+			TrashPath:    meta.RelPath,
+			OriginalPath: original,
+			DeletedAt:    deletedAt,
+			DeletedBy:    attrs.Metadata[deletedByKey],
+			Size:         meta.Size,
+			Md5:          meta.Md5,
+		})
+	}
+	// The time is the first component, so the listing is sorted by it.
+	return ret, nil
+}
+
+// trashObject returns the handle and attributes of a trashed blob, with its
+// original path.
+func (g *GcpBackend) trashObject(trashPath util.RelPathType) (*gcs.ObjectHandle, *gcs.ObjectAttrs, util.RelPathType, error) {
+	rel := strings.TrimPrefix(trashPath.String(), g.trashPrefix+"/")
+	_, original, ok := util.ParseTrashPath(rel)
+	if g.trashPrefix == "" || !ok || rel == trashPath.String() {
+		return nil, nil, "", fmt.Errorf("%v is not in the trash", trashPath)
+	}
+	obj := g.bucket.Object(g.objectName(trashPath))
+	attrs, err := obj.Attrs(context.TODO())
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if p := attrs.Metadata[originalPathKey]; p != "" {
+		original = util.RelPathType(p)
+	}
+	return obj, attrs, original, nil
+}
+
+func (g *GcpBackend) Restore(trashPath, to util.RelPathType) error {
+	src, attrs, original, err := g.trashObject(trashPath)
+	if err != nil {
+		return err
+	}
+	if to == "" {
+		to = original
+	}
+	dst := g.bucket.Object(g.objectName(to)).If(gcs.Conditions{DoesNotExist: true})
+	err = g.copyObject(attrs, dst, map[string]string{
+		writerClientIdKey: g.clientId,
+		deletedByKey:      "",
+		originalPathKey:   "",
+	})
+	if isPreconditionFailed(err) {
+		return ErrExists
+	} else if err != nil {
+		return err
+	}
+	return src.If(gcs.Conditions{GenerationMatch: attrs.Generation}).Delete(context.TODO())
+}
+
+func (g *GcpBackend) Purge(trashPath util.RelPathType) error {
+	obj, attrs, _, err := g.trashObject(trashPath)
+	if err != nil {
+		return err
+	}
+	// Deleting the generation does not leave a noncurrent version behind when the
+	// bucket has object versioning.
+	return obj.Generation(attrs.Generation).Delete(context.TODO())
+}
@@ -0,0 +1,159 @@
+package blob
+
+import (
+	"context"
+	"github.com/dotslash/cloudsync/util"
+	"google.golang.org/api/iterator"
+	"log"
+	"strings"
+	"time"
+)
+import gcs "cloud.google.com/go/storage"
+
+// Version is a generation of a blob. With object versioning on the bucket, GCS
+// keeps the overwritten and removed generations as noncurrent versions.
+type Version struct {
+	Generation int64 `json:"generation"`
+	// When the generation was written.
+	Created time.Time `json:"created"`
+	// When it stopped being the current generation, because it was overwritten or
+	// removed. Zero for the current one.
+	Replaced time.Time `json:"replaced,omitempty"`
+	Size     int64     `json:"size"`
+	Md5      string    `json:"md5"`
+	// Empty if not known.
+	WriterClientId string `json:"writer_client_id,omitempty"`
+}
+
+// Current is true for the generation that is served without a generation.
+func (v *Version) Current() bool {
+	return v.Replaced.IsZero()
+}
+
+// Versioner is implemented by the backends that keep the versions of blobs.
+type Versioner interface {
+	// Versions returns the generations of a blob, oldest first. Without object
+	// versioning there is at most one.
+	Versions(name util.RelPathType) ([]Version, error)
+	// GetVersion returns the content of a generation of a blob.
+	GetVersion(name util.RelPathType, generation int64) (*FullEntry, error)
+	// WalkVersions calls fn with the generations (oldest first) of every blob
+	// whose path starts with prefix, in the order of the paths. Blobs that were
+	// removed are there too, with only noncurrent generations. The trash and the
+	// internal objects are left out.
+	WalkVersions(prefix string, fn func(name util.RelPathType, versions []Version) error) error
+	// WalkInternalVersions is WalkVersions for the internal objects (the dedup
+	// content, the lease and the journal), whose noncurrent generations nothing
+	// reads. The names are relative to the base path, like the ones of the blobs.
+	WalkInternalVersions(fn func(name util.RelPathType, versions []Version) error) error
+	// DeleteVersion removes a noncurrent generation of a blob, or of an internal
+	// object, for good.
+	DeleteVersion(name util.RelPathType, generation int64) error
+}
+
+func makeVersion(basePath string, name util.RelPathType, attrs *gcs.ObjectAttrs) Version {
+	meta := makeMetaEntry(basePath, name, attrs)
+	v := Version{
+		Generation: attrs.Generation,
+		Created:    attrs.Created,
+		Replaced:   attrs.Deleted,
+		Size:       meta.Size,
+		Md5:        meta.Md5,
+	}
+	if meta.BlobWriterClientId != nil {
+		v.WriterClientId = *meta.BlobWriterClientId
+	}
+	return v
+}
+
+func (g *GcpBackend) Versions(name util.RelPathType) ([]Version, error) {
+	objectName := g.objectName(name)
+	it := g.bucket.Objects(context.TODO(), &gcs.Query{Prefix: objectName, Versions: true})
+	it.PageInfo().MaxSize = listPageSize
+	var ret []Version
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if attrs.Name != objectName {
+			// Eg: "notes.md.bak" for "notes.md"
+			continue
+		}
+		ret = append(ret, makeVersion(g.basePrefix, name, attrs))
+	}
+	// The versions of an object are listed by generation, which grows with time.
+	return ret, nil
+}
+
+func (g *GcpBackend) GetVersion(name util.RelPathType, generation int64) (*FullEntry, error) {
+	o := g.bucket.Object(g.objectName(name)).Generation(generation)
+	attrs, err := o.Attrs(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	contentObj := o
+	if ref, ok := parseContentRef(attrs); ok {
+		contentObj = g.contentObject(ref.md5)
+	}
+	reader, err := contentObj.NewReader(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return &FullEntry{MetaEntry: makeMetaEntry(g.basePrefix, name, attrs), Content: reader}, nil
+}
+
+func (g *GcpBackend) WalkVersions(prefix string, fn func(name util.RelPathType, versions []Version) error) error {
+	return g.walkVersions(prefix, false, fn)
+}
+
+func (g *GcpBackend) WalkInternalVersions(fn func(name util.RelPathType, versions []Version) error) error {
+	return g.walkVersions(internalPrefix+"/", true, fn)
+}
+
+// walkVersions lists the generations under prefix, leaving out the hidden
+// objects unless internal is set.
+func (g *GcpBackend) walkVersions(prefix string, internal bool,
+	fn func(name util.RelPathType, versions []Version) error) error {
+	basePath := g.basePrefix + "/"
+	if g.basePrefix == "" {
+		basePath = ""
+	}
+	it := g.bucket.Objects(context.TODO(), &gcs.Query{Prefix: basePath + prefix, Versions: true})
+	it.PageInfo().MaxSize = listPageSize
+	// The generations of an object are listed together, oldest first.
+	var name util.RelPathType
+	var versions []Version
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		relPath := strings.TrimPrefix(attrs.Name, basePath)
+		if !internal && g.isHidden(relPath) {
+			continue
+		}
+		if relPath != name.String() && len(versions) != 0 {
+			if err = fn(name, versions); err != nil {
+				return err
+			}
+			versions = nil
+		}
+		name = util.RelPathType(relPath)
+		versions = append(versions, makeVersion(basePath, name, attrs))
+	}
+	if len(versions) != 0 {
+		return fn(name, versions)
+	}
+	return nil
+}
+
+func (g *GcpBackend) DeleteVersion(name util.RelPathType, generation int64) error {
+	o := g.bucket.Object(g.objectName(name)).Generation(generation)
+	log.Printf("Deleting %v:%v#%v", o.BucketName(), o.ObjectName(), generation)
+	return o.Delete(context.TODO())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"os"
+	"path"
+)
+
+// getCommand downloads a blob to a file (or stdout).
+func getCommand(args []string) {
+	flags := newFlagSet("get")
+	rf := addRemoteFlags(flags)
+	generation := flags.Int64("generation", 0,
+		"Download this generation (see the history command) instead of the current one")
+	_ = flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		usageError(flags, "get needs the path of the blob and optionally the destination")
+	} else if *generation < 0 {
+		usageError(flags, "Bad -generation %v", *generation)
+	}
+	name := remotePath(flags, flags.Arg(0))
+	dest := flags.Arg(1)
+	backend := rf.backend(flags)
+
+	entry, err := getVersion(backend, name, *generation)
+	if err == blob.ErrNotExist {
+		fail("%v: no such blob", name)
+	} else if err != nil {
+		fail("%v: %v", name, err)
+	}
+	defer entry.Content.Close()
+	if dest == "" || dest == "-" {
+		if _, err = io.Copy(os.Stdout, entry.Content); err != nil {
+			fail("%v: %v", name, err)
+		}
+		return
+	}
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = path.Join(dest, path.Base(name.String()))
+	}
+	file, err := os.Create(dest)
+	if err != nil {
+		fail("%v", err)
+	}
+	if err = util.CopyAndClose(file, entry.Content); err != nil {
+		fail("%v: %v", name, err)
+	}
+	if err = os.Chtimes(dest, entry.ModTime, entry.ModTime); err != nil {
+		fail("%v", err)
+	}
+}
+
+// putCommand uploads a local file as a blob. The acls of an existing blob are kept.
+func putCommand(args []string) {
+	flags := newFlagSet("put")
+	rf := addRemoteFlags(flags).withLease(flags)
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		usageError(flags, "put needs the local file and the path of the blob")
+	}
+	src, name := flags.Arg(0), remotePath(flags, flags.Arg(1))
+	if name.IsDir() {
+		usageError(flags, "Bad blob path %q", flags.Arg(1))
+	}
+	backend := rf.backend(flags)
+
+	var opts blob.PutOptions
+	if existing, err := backend.GetMeta(name); err == nil {
+		opts.ACLs = existing.ACLs
+	} else if err != blob.ErrNotExist {
+		fail("%v: %v", name, err)
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		fail("%v", err)
+	}
+	release := rf.holdLease(flags, backend)
+	err = backend.Put(name, file, opts)
+	release()
+	if err != nil {
+		fail("%v: %v", name, err)
+	}
+}
+
+// rmCommand removes blobs. They are moved to the remote trash if it has one.
+func rmCommand(args []string) {
+	flags := newFlagSet("rm")
+	rf := addRemoteFlags(flags).withLease(flags)
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		usageError(flags, "rm needs the path(s) of the blobs")
+	}
+	var names []util.RelPathType
+	for _, arg := range flags.Args() {
+		names = append(names, remotePath(flags, arg))
+	}
+	backend := rf.backend(flags)
+	release := rf.holdLease(flags, backend)
+	failed := false
+	for _, name := range names {
+		if err := backend.Delete(name); err == blob.ErrNotExist {
+			fmt.Fprintf(os.Stderr, "%v: no such blob\n", name)
+			failed = true
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", name, err)
+			failed = true
+		}
+	}
+	release()
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/config"
+	"github.com/dotslash/cloudsync/syncer"
+	"github.com/dotslash/cloudsync/util"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Exit codes of all the commands.
+const (
+	exitOK = 0
+	// Something failed (a round, a download, reading the index...).
+	exitFailure = 1
+	// Bad flags or arguments.
+	exitUsage = 2
+	// The command worked and found differences (see verify and diff).
+	exitDifferences = 3
+)
+
+type command struct {
+	name string
+	// Flags and arguments, after "cloudsync <name>".
+	args string
+	// One line, shown in the list of commands.
+	summary string
+	run     func(args []string)
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"sync", "(-config=... [-pair=name] | -local=... -remote=gs://...) [flags]",
+			"Run one sync round and exit", syncCommand},
+		{"daemon", "(-config=... | -local=... -remote=gs://...) [flags]",
+			"Sync in a loop and serve the status", daemonCommand},
+		{"plan", "(-config=... [-pair=name] | -local=... -remote=gs://...) [-json]",
+			"Print what a sync round would do without doing it", planCommand},
+		{"status", "[-addr=...] [-json]", "Print the status of a running daemon", statusCommand},
+		{"ls", "(-config=... [-pair=name] | -state_dir=...) [-json] [prefix]",
+			"List what the index knows, without scanning", lsCommand},
+		{"get", "(-config=... -pair=name | -remote=gs://...) [-generation=N] path [dest]",
+			"Download a blob to dest (stdout if missing or -)", getCommand},
+		{"history", "(-config=... -pair=name | -remote=gs://...) [-json] path",
+			"List the versions (generations) of a blob", historyCommand},
+		{"diff", "(-config=... -pair=name | -remote=gs://...) path generation [generation]",
+			"Print the differences between two versions of a blob (or one and the current)", diffCommand},
+		{"put", "(-config=... -pair=name | -remote=gs://...) file path",
+			"Upload a local file as the blob path", putCommand},
+		{"rm", "(-config=... -pair=name | -remote=gs://...) path...",
+			"Remove blobs (they go to the remote trash)", rmCommand},
+		{"trash", "(-config=... [-pair=name] | -remote=gs://... | -local=...) [-side=...] [-older_than=...] [-match=...] [-empty] [prefix]",
+			"List (or empty) the local and remote trash", trashCommand},
+		{"restore", "(-config=... [-pair=name] | -remote=gs://... | -local=...) [-side=...] [-to=path] [-rename] trash_path...",
+			"Restore removed files from a trash to their original path", restoreCommand},
+		{"verify", "(-config=... [-pair=name] | -local=... -remote=gs://...) [-json]",
+			"Compare the local files with the blobs", verifyCommand},
+		{"journal", "(-config=... [-pair=name] | -remote=gs://...) [-machine=id] [-since=24h] [-op=...] [-json] [prefix]",
+			"Print what the machines did on the remote", journalCommand},
+		{"prune", "(-config=... [-pair=name] | -remote=gs://... | -local=...) [-keep_versions=N] [-keep_daily=N] [-keep_weekly=N] [-trash_days=N] [-dry_run] [-json] [prefix]",
+			"Remove the old versions and trash entries the retention rules do not keep", pruneCommand},
+		{"gc", "(-config=... | -remote=gs://...) [-dry_run]",
+			"Remove dedup content no blob refers to", gcCommand},
+		{"select", "(-config=... [-pair=name] | -state_dir=... -local=...) [-replace] [path...]",
+			"Add remote subtrees to the selective sync of a pair", selectCommand},
+		{"unselect", "(-config=... [-pair=name] | -state_dir=... -local=...) [-dry_run] path...",
+			"Remove remote subtrees from the selective sync and evict them locally", unselectCommand},
+		{"mount", "(-config=... -pair=name | -remote=gs://...) -cache_dir=... mountpoint",
+			"Serve a remote as a FUSE filesystem", mountCommand},
+		{"help", "[command]", "Print the help of a command", helpCommand},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: cloudsync <command> [flags] [args]")
+	fmt.Fprintln(out, "\nCommands:")
+	names := make([]string, 0, len(commands))
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-9v %v\n", name, findCommand(name).summary)
+	}
+	fmt.Fprintln(out, "\nRun `cloudsync help <command>` for its flags.")
+	fmt.Fprintf(out, "Exit codes: %v ok, %v failure, %v bad usage, %v differences found (verify, diff).\n",
+		exitOK, exitFailure, exitUsage, exitDifferences)
+}
+
+// newFlagSet returns the flag set of a command, with a usage message built from
+// the command table.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		out := flags.Output()
+		if c := findCommand(name); c != nil {
+			fmt.Fprintf(out, "Usage: cloudsync %v %v\n\n%v.\n", name, c.args, c.summary)
+		}
+		var hasFlags bool
+		flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(out, "\nFlags:")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+// usageError prints msg and the usage of the command and exits.
+func usageError(flags *flag.FlagSet, format string, args ...interface{}) {
+	fmt.Fprintf(flags.Output(), format+"\n\n", args...)
+	flags.Usage()
+	os.Exit(exitUsage)
+}
+
+// fail prints the error and exits.
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(exitFailure)
+}
+
+func helpCommand(args []string) {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" {
+		printUsage()
+		return
+	}
+	c := findCommand(args[0])
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	c.run([]string{"-h"})
+}
+
+// parseRemoteURL validates a remote path like gs://bucket/path.
+func parseRemoteURL(remote string) (*url.URL, error) {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return nil, fmt.Errorf("bad remote %q - %v", remote, err)
+	} else if u.Scheme != "gs" || u.Host == "" {
+		return nil, fmt.Errorf("remote should look like gs://<bucket>/<path>, got %q", remote)
+	}
+	return u, nil
+}
+
+// remoteFlags pick the remote of a command: a pair of the config file or -remote.
+type remoteFlags struct {
+	configPath      *string
+	pairName        *string
+	remote          *string
+	credentialsFile *string
+	remoteTrash     *string
+	// Nil unless added by withLease.
+	lease *bool
+}
+
+func addRemoteFlags(flags *flag.FlagSet) *remoteFlags {
+	return &remoteFlags{
+		configPath: flags.String("config", "", "Config file with the pair"),
+		pairName:   flags.String("pair", "", "The pair (needed if the config has more than one)"),
+		remote:     flags.String("remote", "", "Remote path, without -config. Eg: gs://bucket/path"),
+		credentialsFile: flags.String("credentials_file", "",
+			"Service account credentials, without -config. Defaults to GOOGLE_APPLICATION_CREDENTIALS"),
+		remoteTrash: flags.String("remote_trash_prefix", ".trash",
+			"Trash of the remote (relative to the remote path), without -config. Empty means no trash"),
+	}
+}
+
+// withLease adds -lease, for the commands that change the remote.
+func (rf *remoteFlags) withLease(flags *flag.FlagSet) *remoteFlags {
+	rf.lease = flags.Bool("lease", false,
+		"Hold the lease of the remote while changing it, like a round. Implied by lease: true in the pair")
+	return rf
+}
+
+// holdLease takes the lease of the remote picked by the flags if the pair has
+// `lease: true` or -lease is given. The returned func releases it, and must be
+// called before exiting.
+func (rf *remoteFlags) holdLease(flags *flag.FlagSet, backend blob.Backend) func() {
+	use, ttl := rf.lease != nil && *rf.lease, time.Duration(0)
+	_, pair, err := rf.pair()
+	if err != nil {
+		usageError(flags, "%v", err)
+	} else if pair != nil {
+		use, ttl = use || pair.Lease, pair.LeaseTTL
+	}
+	return holdLease(backend, use, ttl)
+}
+
+// holdLease takes the lease of the remote when use is set, for a command that
+// changes it outside of a round, and returns the func that releases it.
+func holdLease(backend blob.Backend, use bool, ttl time.Duration) func() {
+	if !use {
+		return func() {}
+	}
+	release, err := syncer.HoldLease(leaser(backend), ttl)
+	if err != nil {
+		fail("Could not take the lease: %v", err)
+	}
+	return release
+}
+
+// pair returns the pair picked by -config and -pair (with its config), nil
+// without -config.
+func (rf *remoteFlags) pair() (*config.Config, *config.PairConfig, error) {
+	if *rf.configPath == "" {
+		return nil, nil, nil
+	}
+	cfg, err := config.Load(*rf.configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var found *config.PairConfig
+	for i := range cfg.Pairs {
+		if cfg.Pairs[i].Name == *rf.pairName || (*rf.pairName == "" && len(cfg.Pairs) == 1) {
+			found = &cfg.Pairs[i]
+		}
+	}
+	if found == nil && *rf.pairName == "" {
+		return nil, nil, fmt.Errorf("%v has more than one pair, pick one with -pair", *rf.configPath)
+	} else if found == nil {
+		return nil, nil, fmt.Errorf("no pair named %q in %v", *rf.pairName, *rf.configPath)
+	}
+	return cfg, found, nil
+}
+
+// initMachineId sets up the machine id (the writer of the blobs) like the daemon
+// does. cfg is nil without -config.
+func initMachineId(cfg *config.Config) {
+	stateDir, err := config.AbsPath(config.DefaultStateDir)
+	machineId := ""
+	if cfg != nil {
+		stateDir, machineId = cfg.StateDir, cfg.MachineId
+	}
+	if err == nil {
+		err = util.InitMachineId(stateDir, machineId)
+	}
+	if err != nil {
+		fail("Could not set up the machine id: %v", err)
+	}
+}
+
+// hasRemote is true if the flags pick a remote.
+func (rf *remoteFlags) hasRemote() bool {
+	return *rf.configPath != "" || *rf.remote != ""
+}
+
+// backend exits with exitUsage if the flags do not pick a remote.
+func (rf *remoteFlags) backend(flags *flag.FlagSet) blob.Backend {
+	if *rf.configPath != "" {
+		cfg, pair, err := rf.pair()
+		if err != nil {
+			usageError(flags, "%v", err)
+		}
+		initMachineId(cfg)
+		return blob.NewBackendWithOptions(pair.RemoteURL, pair.BackendOptions())
+	} else if *rf.remote == "" {
+		usageError(flags, "Either -config or -remote is needed")
+	}
+	remote, err := parseRemoteURL(*rf.remote)
+	if err != nil {
+		usageError(flags, "%v", err)
+	}
+	initMachineId(nil)
+	return blob.NewBackendWithOptions(*remote, blob.BackendOptions{
+		TrashPrefix:     *rf.remoteTrash,
+		CredentialsFile: *rf.credentialsFile,
+	})
+}
+
+// remotePath turns the path of a blob given on the command line into a RelPath.
+// A leading "/" is dropped and a trailing one names a directory marker. Anything
+// else that is not a clean relative path is a usage error.
+func remotePath(flags *flag.FlagSet, p string) util.RelPathType {
+	rel := strings.TrimPrefix(p, "/")
+	trimmed := strings.TrimSuffix(rel, "/")
+	if trimmed == "" || trimmed == "." || path.Clean(trimmed) != trimmed ||
+		trimmed == ".." || strings.HasPrefix(trimmed, "../") {
+		usageError(flags, "Bad remote path %q", p)
+	}
+	return util.RelPathType(rel)
+}
+
+// remotePrefix is remotePath for the optional prefixes of the listing commands,
+// where "" means everything.
+func remotePrefix(flags *flag.FlagSet, p string) string {
+	if p == "" {
+		return ""
+	}
+	return remotePath(flags, p).String()
+}
@@ -0,0 +1,352 @@
+package config
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/feed"
+	"github.com/dotslash/cloudsync/hooks"
+	"github.com/dotslash/cloudsync/retention"
+	"github.com/dotslash/cloudsync/syncer"
+	"github.com/dotslash/cloudsync/util"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Example config:
+//
+//	state_dir: ~/.cloudsync
+//	machine_id: my-laptop # optional, a random id is generated and kept in state_dir
+//	rate_limits:
+//	  upload: 1M
+//	  upload_schedule: 09:00-18:00=256K
+//	pairs:
+//	  - name: notes
+//	    local: ~/notes
+//	    remote: gs://my-bucket/notes
+//	    excludes: [.git/, .idea/, "*.swp"]
+//	    symlinks: link
+//	    selected: [work/, journal.md] # optional, only these are synced here
+//	    feed: pubsub:projects/my-project/subscriptions/notes # optional, see the feed package
+//	    feed_reconcile: 6h
+//	    lease: true # optional, when several machines sync the remote
+//	    journal: true
+//	    hooks: # optional, see the hooks package
+//	      - command: make -C ~/notes site
+//	        events: [post-sync]
+//	  - name: photos
+//	    local: ~/photos
+//	    remote: gs://my-bucket/photos
+//	    direction: upload-only
+//	    min_interval: 10m
+//	    max_interval: 2h
+//	    quiet_hours: 09:00-18:00 # only scan locally while at work
+//	    credentials_file: ~/.config/photos-sa.json
+//	    disable_trash: true
+//	    dedup: true
+//	    retention: # optional, see the retention package
+//	      keep_versions: 3
+//	      keep_weekly: 52
+//	      trash_days: 30
+//	      journal_days: 365
+//	      prune_interval: 24h
+
+// RateLimits are shared by all the pairs. See util.ParseByteRate and
+// util.ParseRateSchedule for the formats.
+type RateLimits struct {
+	Upload           string `yaml:"upload"`
+	Download         string `yaml:"download"`
+	UploadSchedule   string `yaml:"upload_schedule"`
+	DownloadSchedule string `yaml:"download_schedule"`
+}
+
+type PairConfig struct {
+	// Has to be unique. The state of the pair is stored in <state_dir>/<name>
+	Name      string        `yaml:"name"`
+	Local     string        `yaml:"local"`
+	Remote    string        `yaml:"remote"`
+	Excludes  []string      `yaml:"excludes"`
+	Direction string        `yaml:"direction"`
+	Interval  time.Duration `yaml:"interval"`
+	// The daemon waits min_interval (30s by default) after a round with changes,
+	// and up to max_interval (10m by default) when idle or failing. interval is
+	// the old name of min_interval.
+	MinInterval time.Duration `yaml:"min_interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+	// Comma separated HH:MM-HH:MM windows in which the daemon does not touch the
+	// remote, it only scans the local files. Eg: 22:00-07:00
+	QuietHours string `yaml:"quiet_hours"`
+	// skip, follow (default) or link. See util.SymlinkPolicy
+	Symlinks string `yaml:"symlinks"`
+	// Defaults to <local>/.trash
+	LocalTrash string `yaml:"local_trash"`
+	// Defaults to .trash (relative to the remote path)
+	RemoteTrashPrefix string `yaml:"remote_trash_prefix"`
+	DisableTrash      bool   `yaml:"disable_trash"`
+	// Defaults to GOOGLE_APPLICATION_CREDENTIALS
+	CredentialsFile string `yaml:"credentials_file"`
+	// Store the content of the blobs by md5 under <remote>/.cloudsync/content. See
+	// blob.BackendOptions.Dedup
+	Dedup bool `yaml:"dedup"`
+	// Only these remote subtrees (or files) are synced to this machine. Empty means
+	// everything. Changed by `cloudsync select` and `cloudsync unselect`, after
+	// which the selection in the state dir is used instead.
+	Selected []string `yaml:"selected"`
+	// Where the change notifications of the remote come from, so that rounds do not
+	// list the whole remote. See feed.Open for the format.
+	Feed string `yaml:"feed"`
+	// How often the whole remote is listed anyway with a feed. Defaults to an hour.
+	FeedReconcile time.Duration `yaml:"feed_reconcile"`
+	// Commands or webhooks run on the rounds and actions of the pair.
+	Hooks []hooks.Spec `yaml:"hooks"`
+	// Take turns with the other machines syncing the remote: a round only runs
+	// while holding the lease object in <remote>/.cloudsync/lease, which expires
+	// lease_ttl (2m by default) after it was last renewed.
+	Lease    bool          `yaml:"lease"`
+	LeaseTTL time.Duration `yaml:"lease_ttl"`
+	// Append the uploads, removals, moves and copies of this machine to its
+	// journal in <remote>/.cloudsync/journal. See `cloudsync journal`.
+	Journal bool `yaml:"journal"`
+	// Which old versions and trash entries are kept. See `cloudsync prune`.
+	Retention *retention.Policy `yaml:"retention"`
+
+	RemoteURL    url.URL           `yaml:"-"`
+	QuietWindows []util.TimeWindow `yaml:"-"`
+}
+
+type Config struct {
+	StateDir string `yaml:"state_dir"`
+	// Overrides the machine id stored in the state dir.
+	MachineId  string       `yaml:"machine_id"`
+	RateLimits RateLimits   `yaml:"rate_limits"`
+	Pairs      []PairConfig `yaml:"pairs"`
+}
+
+const (
+	DefaultStateDir          = "~/.cloudsync"
+	defaultRemoteTrashPrefix = ".trash"
+	defaultLocalTrashDir     = ".trash"
+)
+
+func expandHome(p string) (string, error) {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(home, strings.TrimPrefix(p, "~")), nil
+}
+
+// AbsPath expands ~ and makes p absolute.
+func AbsPath(p string) (string, error) {
+	p, err := expandHome(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(p)
+}
+
+// Load reads the config at configPath, fills in the defaults and validates it.
+func Load(configPath string) (*Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err = yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %v failed - %v", configPath, err)
+	}
+	if err = cfg.init(); err != nil {
+		return nil, fmt.Errorf("invalid config %v - %v", configPath, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) init() error {
+	var err error
+	if c.StateDir == "" {
+		c.StateDir = DefaultStateDir
+	}
+	if c.StateDir, err = AbsPath(c.StateDir); err != nil {
+		return err
+	}
+	if len(c.Pairs) == 0 {
+		return fmt.Errorf("no pairs")
+	}
+	names := make(map[string]bool)
+	for i := range c.Pairs {
+		pair := &c.Pairs[i]
+		if err = pair.init(); err != nil {
+			return fmt.Errorf("pair %v(%q): %v", i, pair.Name, err)
+		}
+		if names[pair.Name] {
+			return fmt.Errorf("pair %v: duplicate name %q", i, pair.Name)
+		}
+		names[pair.Name] = true
+	}
+	return nil
+}
+
+func (p *PairConfig) init() error {
+	var err error
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	} else if strings.ContainsAny(p.Name, "/\\") || p.Name == "." || p.Name == ".." {
+		return fmt.Errorf("name should be usable as a directory name")
+	}
+	if p.Local == "" {
+		return fmt.Errorf("local is required")
+	} else if p.Local, err = AbsPath(p.Local); err != nil {
+		return err
+	}
+	remote, err := url.Parse(p.Remote)
+	if err != nil {
+		return fmt.Errorf("bad remote %q - %v", p.Remote, err)
+	} else if remote.Scheme != "gs" || remote.Host == "" {
+		return fmt.Errorf("remote should look like gs://<bucket>/<path>, got %q", p.Remote)
+	}
+	p.RemoteURL = *remote
+	if p.Direction == "" {
+		p.Direction = string(syncer.SyncModeTwoWay)
+	} else if !syncer.SyncMode(p.Direction).Valid() {
+		return fmt.Errorf("direction should be one of %v, %v, %v. got %q",
+			syncer.SyncModeTwoWay, syncer.SyncModeUploadOnly, syncer.SyncModeDownloadOnly, p.Direction)
+	}
+	if p.Symlinks == "" {
+		p.Symlinks = string(util.SymlinkFollow)
+	} else if !util.SymlinkPolicy(p.Symlinks).Valid() {
+		return fmt.Errorf("symlinks should be one of %v, %v, %v. got %q",
+			util.SymlinkSkip, util.SymlinkFollow, util.SymlinkLink, p.Symlinks)
+	}
+	if p.MinInterval == 0 {
+		p.MinInterval = p.Interval
+	}
+	if p.MinInterval < 0 {
+		return fmt.Errorf("negative min_interval %v", p.MinInterval)
+	} else if p.MaxInterval < 0 {
+		return fmt.Errorf("negative max_interval %v", p.MaxInterval)
+	} else if p.MaxInterval != 0 && p.MaxInterval < p.MinInterval {
+		return fmt.Errorf("max_interval %v is shorter than min_interval %v", p.MaxInterval, p.MinInterval)
+	}
+	if p.QuietWindows, err = util.ParseTimeWindows(p.QuietHours); err != nil {
+		return fmt.Errorf("bad quiet_hours - %v", err)
+	}
+	if p.Feed != "" {
+		if err = feed.ValidSpec(p.Feed); err != nil {
+			return err
+		}
+	}
+	if p.FeedReconcile < 0 {
+		return fmt.Errorf("negative feed_reconcile %v", p.FeedReconcile)
+	}
+	if p.LeaseTTL < 0 {
+		return fmt.Errorf("negative lease_ttl %v", p.LeaseTTL)
+	}
+	if p.Retention != nil {
+		if err = p.Retention.Validate(); err != nil {
+			return err
+		}
+	}
+	for i := range p.Hooks {
+		if err = p.Hooks[i].Validate(); err != nil {
+			return fmt.Errorf("hook %v: %v", i, err)
+		}
+	}
+	if p.DisableTrash {
+		p.LocalTrash, p.RemoteTrashPrefix = "", ""
+	} else {
+		if p.LocalTrash == "" {
+			p.LocalTrash = path.Join(p.Local, defaultLocalTrashDir)
+		} else if p.LocalTrash, err = AbsPath(p.LocalTrash); err != nil {
+			return err
+		}
+		if p.RemoteTrashPrefix == "" {
+			p.RemoteTrashPrefix = defaultRemoteTrashPrefix
+		}
+	}
+	if p.CredentialsFile != "" {
+		if p.CredentialsFile, err = AbsPath(p.CredentialsFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PairStateDir is the directory in which the state of the pair is stored.
+func (c *Config) PairStateDir(pair *PairConfig) string {
+	return path.Join(c.StateDir, pair.Name)
+}
+
+// Limiters builds the upload and download limiters described by the config.
+func (r RateLimits) Limiters() (upload *util.RateLimiter, download *util.RateLimiter, err error) {
+	if upload, err = makeLimiter(r.Upload, r.UploadSchedule); err != nil {
+		return nil, nil, err
+	}
+	if download, err = makeLimiter(r.Download, r.DownloadSchedule); err != nil {
+		return nil, nil, err
+	}
+	return upload, download, nil
+}
+
+func makeLimiter(rateStr, scheduleStr string) (*util.RateLimiter, error) {
+	rate, err := util.ParseByteRate(rateStr)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := util.ParseRateSchedule(scheduleStr)
+	if err != nil {
+		return nil, err
+	}
+	limiter := util.NewRateLimiter(rate)
+	limiter.SetSchedule(schedule)
+	return limiter, nil
+}
+
+func (c *Config) SyncerOptions(pair *PairConfig) syncer.Options {
+	var hook syncer.Hook
+	if len(pair.Hooks) != 0 {
+		hook = hooks.New(pair.Hooks)
+	}
+	return syncer.Options{
+		Name:       pair.Name,
+		LocalTrash: pair.LocalTrash,
+		Excludes:   pair.Excludes,
+		Mode:       syncer.SyncMode(pair.Direction),
+		StateDir:   c.PairStateDir(pair),
+		Symlinks:   util.SymlinkPolicy(pair.Symlinks),
+		Selected:   pair.Selected,
+
+		MinInterval:       pair.MinInterval,
+		MaxInterval:       pair.MaxInterval,
+		QuietHours:        pair.QuietWindows,
+		ReconcileInterval: pair.FeedReconcile,
+		Hook:              hook,
+		LeaseTTL:          pair.LeaseTTL,
+	}
+}
+
+// OpenFeed returns the change feed of the remote of the pair, nil if it has none.
+func (p *PairConfig) OpenFeed() (syncer.RemoteFeed, error) {
+	if p.Feed == "" {
+		return nil, nil
+	}
+	source, err := feed.Open(p.Feed, p.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	return feed.New(source, p.RemoteURL, blob.HiddenPrefixes(p.BackendOptions())), nil
+}
+
+func (p *PairConfig) BackendOptions() blob.BackendOptions {
+	return blob.BackendOptions{
+		TrashPrefix:     p.RemoteTrashPrefix,
+		CredentialsFile: p.CredentialsFile,
+		Dedup:           p.Dedup,
+	}
+}
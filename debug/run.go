@@ -5,6 +5,7 @@ import (
 	"github.com/akamensky/argparse"
 	"github.com/dotslash/cloudsync/blob"
 	"github.com/dotslash/cloudsync/util"
+	"io"
 	"net/url"
 	"os"
 	"strings"
@@ -14,7 +15,7 @@ func debugBlob(args []string) {
 	println(strings.Join(args, "\n"))
 	u, _ := url.Parse(args[0])
 	backend := blob.NewBackend(*u, "")
-	entries, err := backend.ListDirRecursive("")
+	entries, err := blob.ListDirRecursive(backend, "")
 	if err != nil {
 		panic(fmt.Sprintf("ok %v", err))
 	}
@@ -23,20 +24,46 @@ func debugBlob(args []string) {
 		fmt.Printf("%v %v %v %v\n", e.BasePath, e.RelPath, e.ModTime.String(), md5Str)
 	}
 }
+
+// debugMarker checks that a directory marker round trips: it is written, listed
+// and removed as the object "<name>/", never as a file "<name>".
+func debugMarker(args []string) {
+	u, _ := url.Parse(args[0])
+	backend := blob.NewBackend(*u, "")
+	marker := util.RelPathType("cloudsync-debug-marker/")
+	err := backend.Put(marker, io.NopCloser(strings.NewReader("")), blob.PutOptions{})
+	util.PanicIfErr(err, "Put failed")
+	entries, err := blob.ListDirRecursive(backend, "")
+	util.PanicIfErr(err, "ListDirRecursive failed")
+	_, listed := entries[marker]
+	_, asFile := entries[marker[:len(marker)-1]]
+	fmt.Printf("listed as a marker: %v, as a file: %v\n", listed, asFile)
+	util.PanicIfErr(backend.Delete(marker), "Delete failed")
+	if _, err = backend.GetMeta(marker); err != blob.ErrNotExist {
+		panic(fmt.Sprintf("%v is still there after Delete, err=%v", marker, err))
+	}
+	if !listed || asFile {
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
 func main() {
 	if os.Args[1] == "blob" {
 		debugBlob(os.Args[2:])
 	} else if os.Args[1] == "file" {
 		debugFile(os.Args[1:])
+	} else if os.Args[1] == "marker" {
+		debugMarker(os.Args[2:])
 	} else if os.Args[1] == "blob-get" {
 		u, _ := url.Parse(os.Args[2])
 		backend := blob.NewBackend(*u, "")
 		meta, _ := backend.GetMeta(util.RelPathType(os.Args[3]))
 		fmt.Println(meta)
 	} else {
-		id, err := util.GetUniqueMachineId()
+		id, err := util.GetLegacyMachineId()
 		fmt.Println("Error: ", err)
-		fmt.Println("uniqueId", id)
+		fmt.Println("legacyId", id)
 	}
 }
 
@@ -46,7 +73,7 @@ func debugFile(args []string) {
 	if err := parser.Parse(args); err != nil {
 		fmt.Print(parser.Usage(err))
 	}
-	res, err := util.ListFilesRec(*path)
+	res, err := util.ListFilesRec(*path, util.WalkOptions{})
 	util.PanicIfErr(err, "ListFilesRec failed")
 	for _, meta := range res {
 		fmt.Printf("%v %v %v\n", meta.BaseDir, meta.RelPath, meta.Md5sum)
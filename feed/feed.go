@@ -0,0 +1,129 @@
+// Package feed turns object change notifications of GCS into the remote paths a
+// sync round has to look at, so that it does not have to list the whole remote.
+//
+// GCS publishes the notifications to a Pub/Sub topic (see `gsutil notification
+// create -f json -t <topic> gs://<bucket>`). They are read from a subscription of
+// it (see PubSubSource) or, for tests and local setups, from a file with one
+// notification per line (see FileSource).
+package feed
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/util"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Notification is an object change notification, as in the attributes of the
+// Pub/Sub messages GCS publishes.
+type Notification struct {
+	// OBJECT_FINALIZE, OBJECT_DELETE, OBJECT_ARCHIVE or OBJECT_METADATA_UPDATE.
+	EventType        string `json:"eventType"`
+	BucketId         string `json:"bucketId"`
+	ObjectId         string `json:"objectId"`
+	ObjectGeneration string `json:"objectGeneration,omitempty"`
+	EventTime        string `json:"eventTime,omitempty"`
+}
+
+// Source delivers notifications.
+type Source interface {
+	// Poll returns the notifications that arrived since the last call (and
+	// acknowledges them). It does not wait for new ones.
+	Poll() ([]Notification, error)
+}
+
+// Feed is the changes of a remote, from the notifications of a source. It
+// implements syncer.RemoteFeed.
+type Feed struct {
+	source     Source
+	bucket     string
+	basePrefix string
+	// Relative to the base path. The changes under them are dropped.
+	hidden []string
+}
+
+// New returns the feed of the remote gs://bucket/path. The changes under the
+// hidden prefixes (relative to the remote path) are dropped.
+func New(source Source, remote url.URL, hidden []string) *Feed {
+	return &Feed{
+		source:     source,
+		bucket:     remote.Host,
+		basePrefix: strings.Trim(remote.Path, "/"),
+		hidden:     hidden,
+	}
+}
+
+// relPath returns the path of an object relative to the remote, false if the
+// object is not in it.
+func (f *Feed) relPath(n Notification) (util.RelPathType, bool) {
+	if n.BucketId != f.bucket || n.ObjectId == "" {
+		return "", false
+	}
+	rel := n.ObjectId
+	if f.basePrefix != "" {
+		if !strings.HasPrefix(rel, f.basePrefix+"/") {
+			return "", false
+		}
+		rel = strings.TrimPrefix(rel, f.basePrefix+"/")
+	}
+	for _, h := range f.hidden {
+		if strings.HasPrefix(rel, h) {
+			return "", false
+		}
+	}
+	return util.RelPathType(rel), rel != ""
+}
+
+// Changes returns the paths (sorted, without duplicates) that changed since the
+// last call.
+func (f *Feed) Changes() ([]util.RelPathType, error) {
+	notifications, err := f.source.Poll()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[util.RelPathType]bool)
+	var ret []util.RelPathType
+	for _, n := range notifications {
+		if p, ok := f.relPath(n); ok && !seen[p] {
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, nil
+}
+
+func splitSpec(spec string) (kind, arg string) {
+	if colon := strings.Index(spec, ":"); colon >= 0 {
+		return spec[:colon], spec[colon+1:]
+	}
+	return spec, ""
+}
+
+// Open returns the source described by spec: "pubsub:projects/<project>/subscriptions/<name>"
+// or "file:<path>". The Pub/Sub source uses credentialsFile (or
+// GOOGLE_APPLICATION_CREDENTIALS) unless PUBSUB_EMULATOR_HOST is set.
+func Open(spec, credentialsFile string) (Source, error) {
+	if err := ValidSpec(spec); err != nil {
+		return nil, err
+	}
+	switch kind, arg := splitSpec(spec); kind {
+	case "pubsub":
+		return NewPubSubSource(arg, credentialsFile)
+	case "file":
+		return NewFileSource(arg), nil
+	}
+	return nil, fmt.Errorf("bad feed %q", spec)
+}
+
+// ValidSpec checks the format of a spec for Open, without opening it.
+func ValidSpec(spec string) error {
+	kind, arg := splitSpec(spec)
+	if arg == "" || (kind != "pubsub" && kind != "file") {
+		return fmt.Errorf("bad feed %q, expected pubsub:projects/<project>/subscriptions/<name> or file:<path>", spec)
+	} else if kind == "pubsub" && !strings.HasPrefix(arg, "projects/") {
+		return fmt.Errorf("bad feed %q, the subscription should look like projects/<project>/subscriptions/<name>", spec)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FileSource reads notifications from a file with one json Notification per
+// line, as a stand in for Pub/Sub. Lines appended to the file are returned by the
+// next Poll.
+type FileSource struct {
+	path string
+	// Of the first line that was not returned yet.
+	offset int64
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (s *FileSource) Poll() ([]Notification, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err != nil {
+		return nil, err
+	} else if info.Size() < s.offset {
+		// Truncated, start over.
+		s.offset = 0
+	}
+	if _, err = file.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Notification
+	for {
+		newline := bytes.IndexByte(data, '\n')
+		if newline < 0 {
+			// A line that is still being written.
+			return ret, nil
+		}
+		line := bytes.TrimSpace(data[:newline])
+		data = data[newline+1:]
+		s.offset += int64(newline + 1)
+		if len(line) == 0 {
+			continue
+		}
+		var n Notification
+		if err = json.Unmarshal(line, &n); err != nil {
+			return ret, fmt.Errorf("%v: bad notification %q - %v", s.path, line, err)
+		}
+		ret = append(ret, n)
+	}
+}
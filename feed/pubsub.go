@@ -0,0 +1,79 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+	"os"
+)
+
+// Messages pulled per call, and per Poll (the rest is left for the next one).
+const (
+	pullBatchSize = 1000
+	maxPerPoll    = 20 * pullBatchSize
+)
+
+// PubSubSource pulls the notifications from a Pub/Sub subscription.
+type PubSubSource struct {
+	service      *pubsub.Service
+	subscription string
+}
+
+// NewPubSubSource reads projects/<project>/subscriptions/<name>. With
+// PUBSUB_EMULATOR_HOST set, it talks to the emulator without credentials.
+func NewPubSubSource(subscription, credentialsFile string) (*PubSubSource, error) {
+	var opts []option.ClientOption
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		opts = append(opts, option.WithEndpoint("http://"+host+"/"), option.WithoutAuthentication())
+	} else {
+		if credentialsFile == "" {
+			credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		if credentialsFile != "" {
+			opts = append(opts, option.WithCredentialsFile(credentialsFile))
+		}
+	}
+	service, err := pubsub.NewService(context.TODO(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating the pubsub client failed - %v", err)
+	}
+	return &PubSubSource{service: service, subscription: subscription}, nil
+}
+
+func (s *PubSubSource) Poll() ([]Notification, error) {
+	var ret []Notification
+	for len(ret) < maxPerPoll {
+		resp, err := s.service.Projects.Subscriptions.Pull(s.subscription, &pubsub.PullRequest{
+			MaxMessages:       pullBatchSize,
+			ReturnImmediately: true,
+		}).Do()
+		if err != nil {
+			return nil, fmt.Errorf("pulling from %v failed - %v", s.subscription, err)
+		} else if len(resp.ReceivedMessages) == 0 {
+			break
+		}
+		ackIds := make([]string, 0, len(resp.ReceivedMessages))
+		for _, m := range resp.ReceivedMessages {
+			ackIds = append(ackIds, m.AckId)
+			if m.Message == nil {
+				continue
+			}
+			attrs := m.Message.Attributes
+			ret = append(ret, Notification{
+				EventType:        attrs["eventType"],
+				BucketId:         attrs["bucketId"],
+				ObjectId:         attrs["objectId"],
+				ObjectGeneration: attrs["objectGeneration"],
+				EventTime:        attrs["eventTime"],
+			})
+		}
+		// Acked before they are used: a failed round is followed by a full listing.
+		_, err = s.service.Projects.Subscriptions.Acknowledge(s.subscription,
+			&pubsub.AcknowledgeRequest{AckIds: ackIds}).Do()
+		if err != nil {
+			return nil, fmt.Errorf("acknowledging to %v failed - %v", s.subscription, err)
+		}
+	}
+	return ret, nil
+}
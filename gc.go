@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/config"
+	"net/url"
+	"os"
+)
+
+// gcCommand removes the dedup content that no blob refers to anymore.
+func gcCommand(args []string) {
+	flags := newFlagSet("gc")
+	remotePath := flags.String("remote", "", "Remote path. Eg: gs://bucket/path")
+	credentialsFile := flags.String("credentials_file", "", "Service account credentials. Defaults to GOOGLE_APPLICATION_CREDENTIALS")
+	configPath := flags.String("config", "", "Collect the garbage of all the pairs in this config file")
+	dryRun := flags.Bool("dry_run", false, "Only print what would be removed")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		usageError(flags, "Unexpected arguments %v", flags.Args())
+	}
+
+	var remotes []url.URL
+	var opts []blob.BackendOptions
+	if *configPath != "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			usageError(flags, "Could not load %v: %v", *configPath, err)
+		}
+		for _, pair := range cfg.Pairs {
+			remotes = append(remotes, pair.RemoteURL)
+			opts = append(opts, pair.BackendOptions())
+		}
+	} else if *remotePath == "" {
+		usageError(flags, "Either -config or -remote is needed")
+	} else if remote, err := parseRemoteURL(*remotePath); err != nil {
+		usageError(flags, "%v", err)
+	} else {
+		remotes = append(remotes, *remote)
+		opts = append(opts, blob.BackendOptions{CredentialsFile: *credentialsFile})
+	}
+
+	failed := false
+	for i, remote := range remotes {
+		collector, ok := blob.NewBackendWithOptions(remote, opts[i]).(blob.GarbageCollector)
+		if !ok {
+			continue
+		}
+		removed, err := collector.CollectGarbage(*dryRun)
+		for _, name := range removed {
+			if *dryRun {
+				fmt.Printf("would remove %v\n", name)
+			} else {
+				fmt.Printf("removed %v\n", name)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", remote.String(), err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
@@ -3,7 +3,10 @@ module github.com/dotslash/cloudsync
 go 1.16
 
 require (
+	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
 	cloud.google.com/go/storage v1.18.2
 	github.com/akamensky/argparse v1.3.1
+	go.etcd.io/bbolt v1.3.6
 	google.golang.org/api v0.63.0
+	gopkg.in/yaml.v3 v3.0.1
 )
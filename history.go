@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"os"
+	"strconv"
+)
+
+func parseGeneration(flags *flag.FlagSet, s string) int64 {
+	generation, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || generation <= 0 {
+		usageError(flags, "Bad generation %q, expected a number printed by `cloudsync history`", s)
+	}
+	return generation
+}
+
+// historyCommand lists the generations of a blob.
+func historyCommand(args []string) {
+	flags := newFlagSet("history")
+	rf := addRemoteFlags(flags)
+	asJson := flags.Bool("json", false, "Print the versions as json, one per line")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		usageError(flags, "history needs the path of a blob")
+	}
+	name := remotePath(flags, flags.Arg(0))
+	versioner, ok := rf.backend(flags).(blob.Versioner)
+	if !ok {
+		fail("The remote does not keep versions")
+	}
+	versions, err := versioner.Versions(name)
+	if err != nil {
+		fail("%v: %v", name, err)
+	} else if len(versions) == 0 {
+		fail("%v: no such blob", name)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, v := range versions {
+		if *asJson {
+			_ = encoder.Encode(v)
+			continue
+		}
+		by := v.WriterClientId
+		if by == "" {
+			by = "-"
+		} else if util.IsOwnClientId(by) {
+			by += " (this machine)"
+		}
+		state := "current"
+		if !v.Current() {
+			state = "replaced or removed " + v.Replaced.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%v %v %8v %v  by %v, %v\n", v.Generation, v.Created.Local().Format("2006-01-02 15:04:05"),
+			formatBytes(v.Size), v.Md5, by, state)
+	}
+	if len(versions) == 1 {
+		fmt.Fprintln(os.Stderr, "Only the current version is there. Older ones are kept if object versioning is on "+
+			"for the bucket (gsutil versioning set on gs://<bucket>).")
+	}
+}
+
+// getVersion gets a generation of a blob, the current one if generation is 0.
+func getVersion(backend blob.Backend, name util.RelPathType, generation int64) (*blob.FullEntry, error) {
+	if generation == 0 {
+		return backend.Get(name)
+	}
+	versions, ok := backend.(blob.Versioner)
+	if !ok {
+		return nil, fmt.Errorf("the remote does not keep versions")
+	}
+	return versions.GetVersion(name, generation)
+}
+
+func readVersion(backend blob.Backend, name util.RelPathType, generation int64) ([]byte, error) {
+	entry, err := getVersion(backend, name, generation)
+	if err != nil {
+		return nil, err
+	}
+	defer entry.Content.Close()
+	return io.ReadAll(entry.Content)
+}
+
+// diffCommand prints the differences between two generations of a blob.
+func diffCommand(args []string) {
+	flags := newFlagSet("diff")
+	rf := addRemoteFlags(flags)
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 && flags.NArg() != 3 {
+		usageError(flags, "diff needs the path of a blob and one or two generations")
+	}
+	name := remotePath(flags, flags.Arg(0))
+	from, to := parseGeneration(flags, flags.Arg(1)), int64(0)
+	if flags.NArg() == 3 {
+		to = parseGeneration(flags, flags.Arg(2))
+	}
+	backend := rf.backend(flags)
+	a, err := readVersion(backend, name, from)
+	if err != nil {
+		fail("%v#%v: %v", name, from, err)
+	}
+	b, err := readVersion(backend, name, to)
+	if err != nil {
+		fail("%v: %v", name, err)
+	}
+	toName := fmt.Sprintf("%v#%v", name, to)
+	if to == 0 {
+		toName = fmt.Sprintf("%v (current)", name)
+	}
+	fromName := fmt.Sprintf("%v#%v", name, from)
+	if util.IsBinary(a) || util.IsBinary(b) {
+		if string(a) != string(b) {
+			fmt.Printf("Binary versions %v and %v differ\n", fromName, toName)
+			os.Exit(exitDifferences)
+		}
+		return
+	}
+	if diff := util.UnifiedDiff(fromName, toName, a, b); diff != "" {
+		fmt.Print(diff)
+		os.Exit(exitDifferences)
+	}
+}
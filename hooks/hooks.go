@@ -0,0 +1,232 @@
+// Package hooks runs shell commands and webhooks on the events of a syncer (see
+// syncer.HookEvent), to trigger builds or notifications when files arrive.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dotslash/cloudsync/syncer"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+	// Events waiting for a slow hook. More than that are dropped.
+	queueSize = 1000
+	// Of the output of a failed command or webhook kept in the log.
+	maxOutputLog = 1024
+)
+
+// Spec is a hook of the config file.
+//
+//	hooks:
+//	  - command: make -C ~/notes site
+//	    events: [post-sync]
+//	  - url: https://example.com/arrived
+//	    events: [action]
+//	    match: ["/inbox/*.pdf"]
+//	    timeout: 5s
+type Spec struct {
+	// Run with sh -c, with the event as json on stdin and in $CLOUDSYNC_EVENT.
+	Command string `yaml:"command"`
+	// The event is POSTed here as json.
+	URL string `yaml:"url"`
+	// pre-sync, post-sync and action. Empty means all of them.
+	Events []string `yaml:"events"`
+	// Only the action events for paths matching one of these (like in excludes).
+	Match []string `yaml:"match"`
+	// Defaults to 30 secs.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (s *Spec) Validate() error {
+	if (s.Command == "") == (s.URL == "") {
+		return fmt.Errorf("a hook needs either command or url")
+	}
+	if s.URL != "" {
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("hook url should be http(s)://..., got %q", s.URL)
+		}
+	}
+	for _, e := range s.Events {
+		if e != syncer.HookPreSync && e != syncer.HookPostSync && e != syncer.HookAction {
+			return fmt.Errorf("unknown hook event %q, expected %v, %v or %v",
+				e, syncer.HookPreSync, syncer.HookPostSync, syncer.HookAction)
+		}
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("negative hook timeout %v", s.Timeout)
+	}
+	return nil
+}
+
+// ParseFlag makes a Spec of all the events from a command, or from a url if it
+// starts with http:// or https://.
+func ParseFlag(s string) Spec {
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		return Spec{URL: s}
+	}
+	return Spec{Command: s}
+}
+
+func (s *Spec) String() string {
+	if s.URL != "" {
+		return s.URL
+	}
+	return s.Command
+}
+
+type hook struct {
+	spec   Spec
+	events map[string]bool
+	match  *util.ExcludeMatcher
+	queue  chan syncer.HookEvent
+	// Counts the queued events.
+	pending *sync.WaitGroup
+}
+
+func (h *hook) wants(event syncer.HookEvent) bool {
+	if len(h.events) != 0 && !h.events[event.Event] {
+		return false
+	}
+	return event.Event != syncer.HookAction || h.match == nil ||
+		h.match.Excluded(event.Path, false) || (event.From != "" && h.match.Excluded(event.From, false))
+}
+
+// work runs the queued events one at a time, in order.
+func (h *hook) work() {
+	for event := range h.queue {
+		h.run(event)
+		h.pending.Done()
+	}
+}
+
+// run runs the hook for an event and logs its failure.
+func (h *hook) run(event syncer.HookEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("hook %v: %v", &h.spec, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.spec.Timeout)
+	defer cancel()
+	var output []byte
+	if h.spec.URL != "" {
+		output, err = post(ctx, h.spec.URL, payload)
+	} else {
+		output, err = runCommand(ctx, h.spec.Command, payload)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", h.spec.Timeout)
+	}
+	if err != nil {
+		if len(output) > maxOutputLog {
+			output = output[:maxOutputLog]
+		}
+		log.Printf("hook %v on %v %v failed - %v: %s", &h.spec, event.Event, event.Path, err, output)
+	}
+}
+
+// runCommand runs command with sh. The output goes to a file rather than a pipe:
+// children of the shell would keep a pipe open after the timeout killed it.
+func runCommand(ctx context.Context, command string, payload []byte) ([]byte, error) {
+	output, err := os.CreateTemp("", "cloudsync-hook-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout, cmd.Stderr = output, output
+	cmd.Env = append(os.Environ(), "CLOUDSYNC_EVENT="+string(payload))
+	if err = cmd.Run(); err == nil {
+		return nil, nil
+	}
+	logged, _ := io.ReadAll(io.NewSectionReader(output, 0, maxOutputLog))
+	return logged, err
+}
+
+func post(ctx context.Context, url string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxOutputLog))
+	if resp.StatusCode/100 != 2 {
+		return body, fmt.Errorf("got %v", resp.Status)
+	}
+	return nil, nil
+}
+
+// Runner fires the hooks of a pair. It implements syncer.Hook.
+type Runner struct {
+	hooks   []*hook
+	pending sync.WaitGroup
+}
+
+// New starts the runner of the hooks. The specs should be valid.
+func New(specs []Spec) *Runner {
+	r := &Runner{}
+	for _, spec := range specs {
+		if spec.Timeout <= 0 {
+			spec.Timeout = defaultTimeout
+		}
+		h := &hook{
+			spec:    spec,
+			events:  make(map[string]bool),
+			queue:   make(chan syncer.HookEvent, queueSize),
+			pending: &r.pending,
+		}
+		for _, e := range spec.Events {
+			h.events[e] = true
+		}
+		if len(spec.Match) != 0 {
+			h.match = util.NewExcludeMatcher(spec.Match)
+		}
+		go h.work()
+		r.hooks = append(r.hooks, h)
+	}
+	return r
+}
+
+func (r *Runner) Fire(event syncer.HookEvent) {
+	for _, h := range r.hooks {
+		if !h.wants(event) {
+			continue
+		}
+		if event.Event == syncer.HookPreSync {
+			h.run(event)
+			continue
+		}
+		r.pending.Add(1)
+		select {
+		case h.queue <- event:
+		default:
+			r.pending.Done()
+			log.Printf("hook %v is falling behind, dropping %v %v", &h.spec, event.Event, event.Path)
+		}
+	}
+}
+
+// Wait blocks until the hooks ran for the events fired so far.
+func (r *Runner) Wait() {
+	r.pending.Wait()
+}
@@ -0,0 +1,256 @@
+// Package index keeps what the syncer knows about every path of a pair in an
+// on-disk (bbolt) database: the local and remote metadata seen by the last scan,
+// whether the path is in sync and the hashes it was last in sync with.
+//
+// The syncer holds the database open only while it syncs, so the commands can
+// read it (see OpenReadOnly) without scanning anything.
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"strings"
+	"time"
+)
+
+// FileName is the name of the index in the state dir of a pair.
+const FileName = "index.db"
+
+// SyncState is the state of a path after the last round.
+type SyncState string
+
+const (
+	// The local file and the blob have the same content.
+	StateSynced SyncState = "synced"
+	// They differ and an action is planned (or not allowed by the sync mode).
+	StatePending SyncState = "pending"
+	// The last action on the path failed. See Entry.Error.
+	StateFailed SyncState = "failed"
+)
+
+// Entry is what the index knows about one path.
+type Entry struct {
+	Path util.RelPathType
+	// As seen by the last scan. Nil if the path was not there.
+	Local  *util.LocalFileMeta `json:",omitempty"`
+	Remote *blob.MetaEntry     `json:",omitempty"`
+	State  SyncState
+	Error  string `json:",omitempty"`
+	// The md5 of the local file and of the blob when the path was last in sync.
+	// Empty if it never was.
+	SyncedLocalMd5  string    `json:",omitempty"`
+	SyncedRemoteMd5 string    `json:",omitempty"`
+	SyncedAt        time.Time `json:",omitempty"`
+	ScannedAt       time.Time
+}
+
+var (
+	metaBucket = []byte("meta")
+	currentKey = []byte("current")
+	// The entries of the current scan are in one of these. A new scan is written
+	// to the other one and they are swapped on commit.
+	entryBuckets = [2][]byte{[]byte("entries-0"), []byte("entries-1")}
+)
+
+// Number of entries read or written per transaction. Transactions are kept short
+// so that the syncer never holds a read and a write transaction at once.
+const batchSize = 1000
+
+type Index struct {
+	db *bolt.DB
+}
+
+// Open opens (or creates) the index for reading and writing. Only one process can
+// have it open like this; it waits up to timeout for the others to close it.
+func Open(path string, timeout time.Duration) (*Index, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("opening %v failed - %v", path, err)
+	}
+	return &Index{db: db}, nil
+}
+
+// OpenReadOnly opens an existing index. It waits up to timeout if a syncer has
+// it open.
+func OpenReadOnly(path string, timeout time.Duration) (*Index, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: timeout, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("opening %v failed - %v", path, err)
+	}
+	return &Index{db: db}, nil
+}
+
+func (ix *Index) Close() error {
+	return ix.db.Close()
+}
+
+// currentBucket returns the bucket with the entries of the last committed scan,
+// or nil if nothing was committed yet.
+func currentBucket(tx *bolt.Tx) *bolt.Bucket {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return nil
+	}
+	name := meta.Get(currentKey)
+	if name == nil {
+		return nil
+	}
+	return tx.Bucket(name)
+}
+
+// Empty is true if no scan was committed yet.
+func (ix *Index) Empty() (bool, error) {
+	empty := true
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		empty = currentBucket(tx) == nil
+		return nil
+	})
+	return empty, err
+}
+
+func (ix *Index) Get(p util.RelPathType) (*Entry, error) {
+	var ret *Entry
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		b := currentBucket(tx)
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(p))
+		if data == nil {
+			return nil
+		}
+		ret = &Entry{}
+		return json.Unmarshal(data, ret)
+	})
+	return ret, err
+}
+
+// Iterator goes over entries in the order of their paths. It reads a batch at a
+// time, each in its own transaction, so it does not block the writers.
+type Iterator struct {
+	db     *bolt.DB
+	bucket func(tx *bolt.Tx) *bolt.Bucket
+	prefix string
+	// The last key read. The next batch starts after it.
+	last  []byte
+	batch []Entry
+	done  bool
+}
+
+// Next returns io.EOF when there are no more entries.
+func (it *Iterator) Next() (*Entry, error) {
+	if len(it.batch) == 0 && !it.done {
+		if err := it.readBatch(); err != nil {
+			return nil, err
+		}
+	}
+	if len(it.batch) == 0 {
+		return nil, io.EOF
+	}
+	ret := &it.batch[0]
+	it.batch = it.batch[1:]
+	return ret, nil
+}
+
+func (it *Iterator) readBatch() error {
+	return it.db.View(func(tx *bolt.Tx) error {
+		b := it.bucket(tx)
+		if b == nil {
+			it.done = true
+			return nil
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if it.last == nil {
+			k, v = c.Seek([]byte(it.prefix))
+		} else if k, v = c.Seek(it.last); bytes.Equal(k, it.last) {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(it.batch) < batchSize; k, v = c.Next() {
+			if !strings.HasPrefix(string(k), it.prefix) {
+				it.done = true
+				return nil
+			}
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("bad index entry %v - %v", string(k), err)
+			}
+			it.batch = append(it.batch, e)
+		}
+		if k == nil {
+			it.done = true
+		} else if len(it.batch) != 0 {
+			it.last = []byte(it.batch[len(it.batch)-1].Path)
+		}
+		return nil
+	})
+}
+
+// Entries returns the entries of the last committed scan whose path starts with
+// prefix.
+func (ix *Index) Entries(prefix string) *Iterator {
+	return &Iterator{db: ix.db, bucket: currentBucket, prefix: prefix}
+}
+
+// Modify calls fn with the entry of every path in paths (nil if it has none) and
+// stores what fn returns. Returning nil removes the entry. All in one transaction.
+func (ix *Index) Modify(paths []util.RelPathType, fn func(p util.RelPathType, e *Entry) *Entry) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		b := currentBucket(tx)
+		if b == nil {
+			return errors.New("nothing to modify, no scan was committed")
+		}
+		for _, p := range paths {
+			var old *Entry
+			if data := b.Get([]byte(p)); data != nil {
+				old = &Entry{}
+				if err := json.Unmarshal(data, old); err != nil {
+					return err
+				}
+			}
+			var err error
+			if e := fn(p, old); e == nil {
+				err = b.Delete([]byte(p))
+			} else if data, marshalErr := json.Marshal(e); marshalErr != nil {
+				err = marshalErr
+			} else {
+				err = b.Put([]byte(p), data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Summary counts the entries per state.
+type Summary struct {
+	Entries   int               `json:"entries"`
+	States    map[SyncState]int `json:"states"`
+	ScannedAt time.Time         `json:"scanned_at"`
+}
+
+func (ix *Index) Summary() (*Summary, error) {
+	ret := &Summary{States: make(map[SyncState]int)}
+	it := ix.Entries("")
+	for {
+		e, err := it.Next()
+		if err == io.EOF {
+			return ret, nil
+		} else if err != nil {
+			return nil, err
+		}
+		ret.Entries++
+		ret.States[e.State]++
+		if e.ScannedAt.After(ret.ScannedAt) {
+			ret.ScannedAt = e.ScannedAt
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ScanWriter writes the entries of a new scan. They replace the entries of the
+// last scan on Commit. Until then readers see the last scan.
+type ScanWriter struct {
+	ix      *Index
+	bucket  []byte
+	pending []Entry
+	// The path of the last added entry
+	last []byte
+	done bool
+}
+
+// NewScan starts a new scan. Only one scan can be written at a time.
+func (ix *Index) NewScan() (*ScanWriter, error) {
+	w := &ScanWriter{ix: ix}
+	err := ix.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		// Use the bucket that is not current. Whatever is in it is from an
+		// aborted scan.
+		w.bucket = entryBuckets[0]
+		if bytes.Equal(meta.Get(currentKey), entryBuckets[0]) {
+			w.bucket = entryBuckets[1]
+		}
+		if err = tx.DeleteBucket(w.bucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err = tx.CreateBucket(w.bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Add adds an entry to the scan. Entries have to be added in the order of their
+// paths.
+func (w *ScanWriter) Add(e Entry) error {
+	if w.last != nil && bytes.Compare([]byte(e.Path), w.last) <= 0 {
+		return fmt.Errorf("index: %v added after %v", e.Path, string(w.last))
+	}
+	w.last = []byte(e.Path)
+	w.pending = append(w.pending, e)
+	if len(w.pending) >= batchSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush writes the added entries to the database.
+func (w *ScanWriter) Flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	err := w.ix.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(w.bucket)
+		for _, e := range w.pending {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err = b.Put([]byte(e.Path), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	w.pending = w.pending[:0]
+	return err
+}
+
+// Entries returns the entries added so far (and flushed).
+func (w *ScanWriter) Entries() *Iterator {
+	return &Iterator{db: w.ix.db, bucket: func(tx *bolt.Tx) *bolt.Bucket {
+		return tx.Bucket(w.bucket)
+	}}
+}
+
+// Commit makes the new scan the current one.
+func (w *ScanWriter) Commit() error {
+	if w.done {
+		return fmt.Errorf("index: scan already committed or aborted")
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.done = true
+	return w.ix.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		old := append([]byte(nil), meta.Get(currentKey)...)
+		if err := meta.Put(currentKey, w.bucket); err != nil {
+			return err
+		}
+		if len(old) != 0 && !bytes.Equal(old, w.bucket) {
+			return tx.DeleteBucket(old)
+		}
+		return nil
+	})
+}
+
+// Abort drops the new scan.
+func (w *ScanWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	return w.ix.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(w.bucket)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	"os"
+	"strings"
+	"time"
+)
+
+// journalCommand prints the journal entries of the machines syncing a remote,
+// oldest first.
+func journalCommand(args []string) {
+	flags := newFlagSet("journal")
+	rf := addRemoteFlags(flags)
+	machine := flags.String("machine", "", "Only the entries of this machine id")
+	since := flags.Duration("since", 24*time.Hour, "Only the entries of this long ago or later. 0 for all")
+	op := flags.String("op", "", "Only these operations (comma separated): upload, delete, move, copy")
+	asJson := flags.Bool("json", false, "Print the entries as json, one per line")
+	_ = flags.Parse(args)
+	if flags.NArg() > 1 {
+		usageError(flags, "Unexpected arguments %v", flags.Args()[1:])
+	}
+	ops := make(map[string]bool)
+	for _, o := range strings.Split(*op, ",") {
+		if o = strings.TrimSpace(o); o == "" {
+			continue
+		} else if o != blob.JournalUpload && o != blob.JournalDelete && o != blob.JournalMove && o != blob.JournalCopy {
+			usageError(flags, "Bad -op %q", o)
+		}
+		ops[o] = true
+	}
+	journal, ok := rf.backend(flags).(blob.Journaler)
+	if !ok {
+		fail("The remote has no journal")
+	}
+	from := time.Time{}
+	if *since > 0 {
+		from = time.Now().Add(-*since)
+	}
+	entries, err := journal.ReadJournal(*machine, from)
+	if err != nil {
+		fail("%v", err)
+	}
+	prefix := remotePrefix(flags, flags.Arg(0))
+	encoder := json.NewEncoder(os.Stdout)
+	for _, e := range entries {
+		if len(ops) != 0 && !ops[e.Op] {
+			continue
+		} else if !strings.HasPrefix(e.Path.String(), prefix) && !strings.HasPrefix(e.From.String(), prefix) {
+			continue
+		}
+		if *asJson {
+			_ = encoder.Encode(e)
+			continue
+		}
+		by := e.Machine
+		if util.IsOwnClientId(by) {
+			by += " (this machine)"
+		}
+		what := e.Path.String()
+		if e.From != "" {
+			what = e.From.String() + " -> " + what
+		}
+		if e.Md5 != "" {
+			what += "  md5 " + e.Md5
+		}
+		if e.Size > 0 {
+			what += " (" + formatBytes(e.Size) + ")"
+		}
+		fmt.Printf("%v %-6v %v  by %v\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Op, what, by)
+	}
+}
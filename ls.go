@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotslash/cloudsync/config"
+	"github.com/dotslash/cloudsync/index"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// How long the commands wait for a syncer that is in the middle of a round.
+const indexWaitTimeout = 10 * time.Second
+
+// indexDirs returns the state dirs (by pair name) that have the indexes to read:
+// the pairs of the config file or the given state dir.
+func indexDirs(configPath, stateDir, pairName string) (map[string]string, error) {
+	ret := make(map[string]string)
+	if configPath == "" {
+		if stateDir == "" {
+			return nil, fmt.Errorf("either -config or -state_dir is needed")
+		}
+		ret["default"] = stateDir
+		return ret, nil
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cfg.Pairs {
+		if pairName == "" || cfg.Pairs[i].Name == pairName {
+			ret[cfg.Pairs[i].Name] = cfg.PairStateDir(&cfg.Pairs[i])
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no pair named %q in %v", pairName, configPath)
+	}
+	return ret, nil
+}
+
+func printEntry(pair string, e *index.Entry) {
+	size, md5 := "-", "-"
+	if e.Local != nil {
+		size, md5 = formatBytes(e.Local.Size), e.Local.Md5sum
+	} else if e.Remote != nil {
+		size, md5 = formatBytes(e.Remote.Size), e.Remote.Md5
+	}
+	where := ""
+	if e.Local != nil {
+		where += "L"
+	}
+	if e.Remote != nil {
+		where += "R"
+	}
+	fmt.Printf("%-8v %-2v %8v %v %v:%v", e.State, where, size, md5, pair, e.Path)
+	if e.Error != "" {
+		fmt.Printf("  (%v)", e.Error)
+	}
+	fmt.Println()
+}
+
+// lsCommand lists what the index of each pair knows, without scanning anything.
+func lsCommand(args []string) {
+	flags := newFlagSet("ls")
+	configPath := flags.String("config", "", "Config file with the pairs")
+	pairName := flags.String("pair", "", "Only list this pair")
+	stateDir := flags.String("state_dir", "", "State dir of the pair (without -config)")
+	asJson := flags.Bool("json", false, "Print the index entries as json, one per line")
+	_ = flags.Parse(args)
+	if flags.NArg() > 1 {
+		usageError(flags, "Unexpected arguments %v", flags.Args()[1:])
+	}
+	prefix := flags.Arg(0)
+
+	dirs, err := indexDirs(*configPath, *stateDir, *pairName)
+	if err != nil {
+		usageError(flags, "%v", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	failed := false
+	for pair, dir := range dirs {
+		ix, err := index.OpenReadOnly(path.Join(dir, index.FileName), indexWaitTimeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", pair, err)
+			failed = true
+			continue
+		}
+		it := ix.Entries(prefix)
+		for {
+			e, err := it.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "%v: %v\n", pair, err)
+				failed = true
+				break
+			}
+			if *asJson {
+				_ = encoder.Encode(e)
+			} else {
+				printEntry(pair, e)
+			}
+		}
+		ix.Close()
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
@@ -2,27 +2,339 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/config"
+	"github.com/dotslash/cloudsync/feed"
+	"github.com/dotslash/cloudsync/hooks"
+	"github.com/dotslash/cloudsync/metrics"
+	"github.com/dotslash/cloudsync/retention"
+	"github.com/dotslash/cloudsync/server"
 	"github.com/dotslash/cloudsync/syncer"
+	"github.com/dotslash/cloudsync/util"
 	"log"
-	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+type startable interface {
+	server.StatusSource
+	Start()
+}
+
+// runSyncers starts the syncers and the status server and blocks forever.
+func runSyncers(syncers []startable, statusAddr string, upload, download *util.RateLimiter) {
+	if statusAddr != "" {
+		sources := make([]server.StatusSource, 0, len(syncers))
+		for _, s := range syncers {
+			sources = append(sources, s)
+		}
+		statusServer := server.New(sources, upload, download)
+		statusServer.Handle("/metrics", metrics.Default.Handler())
+		go func() {
+			err := statusServer.ListenAndServe(statusAddr)
+			log.Printf("status server failed. err=%v", err)
+		}()
+	}
+	var wg sync.WaitGroup
+	for _, s := range syncers {
+		wg.Add(1)
+		go func(s startable) {
+			defer wg.Done()
+			s.Start()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// syncFlags pick the pairs of sync, daemon, plan and verify: the pairs of the
+// config file, or one pair given by flags.
+type syncFlags struct {
+	configPath       *string
+	pairName         *string
+	localPath        *string
+	localTrash       *string
+	remotePath       *string
+	remoteTrash      *string
+	stateDir         *string
+	uploadLimit      *string
+	downloadLimit    *string
+	uploadSchedule   *string
+	downloadSchedule *string
+	symlinks         *string
+	machineId        *string
+	dedup            *bool
+	feed             *string
+	feedReconcile    *time.Duration
+	minInterval      *time.Duration
+	maxInterval      *time.Duration
+	quietHours       *string
+	hook             *string
+	hookTimeout      *time.Duration
+	lease            *bool
+	leaseTTL         *time.Duration
+	journal          *bool
+	// Only the daemon reads the change feeds (the other commands would take the
+	// notifications away from it) and prunes.
+	daemon bool
+}
+
+func addSyncFlags(flags *flag.FlagSet, withPair bool) *syncFlags {
+	sf := &syncFlags{
+		configPath: flags.String("config", "",
+			"Config file describing the pairs to sync. If set, the other flags are ignored"),
+		localPath:  flags.String("local", ".", "Local Path"),
+		localTrash: flags.String("local_trash", "./.trash", "Local Trash"),
+		remotePath: flags.String("remote", "",
+			"Remote path (currently only gcp is supported). Eg: gs://bucket/path",
+		),
+		remoteTrash: flags.String("remote_trash_prefix", ".trash",
+			"Removed blobs will be stored in this prefix. See the prune command to purge the old ones"),
+		stateDir: flags.String("state_dir", "",
+			"If set, the last scan is stored here so that restarts can tell deletions from additions"),
+		uploadLimit: flags.String("upload_limit", "",
+			"Max upload rate in bytes per sec. Eg: 512K, 2M. Empty means unlimited"),
+		downloadLimit: flags.String("download_limit", "",
+			"Max download rate in bytes per sec. Eg: 512K, 2M. Empty means unlimited"),
+		uploadSchedule: flags.String("upload_schedule", "",
+			"Time of day overrides for upload_limit. Eg: 09:00-18:00=256K,18:00-09:00=0"),
+		downloadSchedule: flags.String("download_schedule", "",
+			"Time of day overrides for download_limit. Eg: 09:00-18:00=1M"),
+		symlinks: flags.String("symlinks", string(util.SymlinkFollow),
+			"What to do with symlinks. skip: ignore them, follow: sync what they point to (if it is inside "+
+				"the local path), link: sync them as links"),
+		machineId: flags.String("machine_id", "",
+			"Identifies this machine as the writer of blobs. By default a random id is generated and stored in "+
+				"state_dir (or "+config.DefaultStateDir+")"),
+		dedup: flags.Bool("dedup", false,
+			"Store the content of the blobs once per md5 under <remote>/.cloudsync/content (see the gc command)"),
+		feed: flags.String("feed", "",
+			"Change notifications of the remote, so that the daemon does not list it every round. "+
+				"pubsub:projects/<project>/subscriptions/<name> or file:<path> (one json notification per line)"),
+		feedReconcile: flags.Duration("feed_reconcile", time.Hour, "How often the whole remote is listed anyway with -feed"),
+		minInterval: flags.Duration("min_interval", 30*time.Second,
+			"How long the daemon waits after a round with changes"),
+		maxInterval: flags.Duration("max_interval", 10*time.Minute,
+			"Idle rounds, failures and rate limits stretch the wait of the daemon up to this"),
+		quietHours: flags.String("quiet_hours", "",
+			"Times of day in which the daemon only scans the local files. Eg: 22:00-07:00,12:00-13:00"),
+		hook: flags.String("hook", "",
+			"Shell command, or http(s) url to POST to, run before and after each round and for each action "+
+				"that is done, with the event as json"),
+		hookTimeout: flags.Duration("hook_timeout", 30*time.Second, "How long -hook can take"),
+		lease: flags.Bool("lease", false,
+			"Only sync while holding the lease object in <remote>/.cloudsync/lease, so that machines sharing "+
+				"the remote take turns"),
+		leaseTTL: flags.Duration("lease_ttl", 2*time.Minute, "How long the lease lasts without being renewed"),
+		journal: flags.Bool("journal", false,
+			"Append the operations of this machine on the remote to its journal in <remote>/.cloudsync/journal"),
+	}
+	empty := ""
+	sf.pairName = &empty
+	if withPair {
+		sf.pairName = flags.String("pair", "", "Only this pair of the config")
+	}
+	return sf
+}
+
+// pairSyncer is what the commands need from a syncer.
+type pairSyncer interface {
+	startable
+	SyncOnce() error
+	Plan() ([]syncer.PlannedChange, error)
+	Verify(opts syncer.VerifyOptions) (*syncer.VerifyReport, error)
+	WaitHooks()
+}
+
+// syncers builds the syncers picked by the flags. It exits with exitUsage if the
+// flags are wrong.
+func (sf *syncFlags) syncers(flags *flag.FlagSet) ([]pairSyncer, *util.RateLimiter, *util.RateLimiter) {
+	if *sf.configPath != "" {
+		return sf.configSyncers(flags)
+	}
+	if *sf.remotePath == "" {
+		usageError(flags, "Either -config or -remote is needed")
+	} else if !util.SymlinkPolicy(*sf.symlinks).Valid() {
+		usageError(flags, "Bad -symlinks %q", *sf.symlinks)
+	}
+	remote, err := parseRemoteURL(*sf.remotePath)
+	if err != nil {
+		usageError(flags, "%v", err)
+	}
+	machineIdDir := *sf.stateDir
+	if machineIdDir == "" {
+		machineIdDir = config.DefaultStateDir
+	}
+	if machineIdDir, err = config.AbsPath(machineIdDir); err != nil {
+		usageError(flags, "Bad -state_dir: %v", err)
+	} else if err = util.InitMachineId(machineIdDir, *sf.machineId); err != nil {
+		fail("Could not set up the machine id: %v", err)
+	}
+	upload, download, err := config.RateLimits{
+		Upload:           *sf.uploadLimit,
+		Download:         *sf.downloadLimit,
+		UploadSchedule:   *sf.uploadSchedule,
+		DownloadSchedule: *sf.downloadSchedule,
+	}.Limiters()
+	if err != nil {
+		usageError(flags, "Bad rate limits: %v", err)
+	}
+	quietHours, err := util.ParseTimeWindows(*sf.quietHours)
+	if err != nil {
+		usageError(flags, "Bad -quiet_hours: %v", err)
+	} else if *sf.minInterval <= 0 || *sf.maxInterval < *sf.minInterval {
+		usageError(flags, "Expected 0 < -min_interval <= -max_interval")
+	}
+	backendOpts := blob.BackendOptions{
+		TrashPrefix: *sf.remoteTrash,
+		Dedup:       *sf.dedup,
+	}
+	opts := syncer.Options{
+		LocalTrash:        *sf.localTrash,
+		StateDir:          *sf.stateDir,
+		Symlinks:          util.SymlinkPolicy(*sf.symlinks),
+		MinInterval:       *sf.minInterval,
+		MaxInterval:       *sf.maxInterval,
+		QuietHours:        quietHours,
+		ReconcileInterval: *sf.feedReconcile,
+	}
+	if *sf.hook != "" {
+		spec := hooks.ParseFlag(*sf.hook)
+		spec.Timeout = *sf.hookTimeout
+		if err = spec.Validate(); err != nil {
+			usageError(flags, "Bad -hook: %v", err)
+		}
+		opts.Hook = hooks.New([]hooks.Spec{spec})
+	}
+	if *sf.feed != "" && sf.daemon {
+		if err = feed.ValidSpec(*sf.feed); err != nil {
+			usageError(flags, "Bad -feed: %v", err)
+		}
+		source, err := feed.Open(*sf.feed, "")
+		if err != nil {
+			fail("%v", err)
+		}
+		opts.Feed = feed.New(source, *remote, blob.HiddenPrefixes(backendOpts))
+	}
+	backend := blob.NewBackendWithOptions(*remote, backendOpts)
+	if *sf.lease {
+		opts.Lease, opts.LeaseTTL = leaser(backend), *sf.leaseTTL
+	}
+	if *sf.journal {
+		opts.Journal = journaler(backend)
+	}
+	blobStore := blob.NewThrottledBackend(backend, upload, download)
+	syncerObj := syncer.NewSyncerWithOptions(*sf.localPath, blobStore, opts)
+	return []pairSyncer{syncerObj}, upload, download
+}
+
+func leaser(backend blob.Backend) blob.Leaser {
+	leaser, ok := backend.(blob.Leaser)
+	if !ok {
+		fail("The remote does not support leases")
+	}
+	return leaser
+}
+
+func journaler(backend blob.Backend) blob.Journaler {
+	journaler, ok := backend.(blob.Journaler)
+	if !ok {
+		fail("The remote does not support a journal")
+	}
+	return journaler
+}
+
+// configSyncers builds one syncer per pair of the config (or only -pair).
+func (sf *syncFlags) configSyncers(flags *flag.FlagSet) ([]pairSyncer, *util.RateLimiter, *util.RateLimiter) {
+	cfg, err := config.Load(*sf.configPath)
+	if err != nil {
+		usageError(flags, "Could not load %v: %v", *sf.configPath, err)
+	}
+	machineId := cfg.MachineId
+	if *sf.machineId != "" {
+		machineId = *sf.machineId
+	}
+	if err = util.InitMachineId(cfg.StateDir, machineId); err != nil {
+		fail("Could not set up the machine id: %v", err)
+	}
+	upload, download, err := cfg.RateLimits.Limiters()
+	if err != nil {
+		usageError(flags, "Bad rate_limits in %v: %v", *sf.configPath, err)
+	}
+	var syncers []pairSyncer
+	for i := range cfg.Pairs {
+		pair := &cfg.Pairs[i]
+		if *sf.pairName != "" && pair.Name != *sf.pairName {
+			continue
+		}
+		backend := blob.NewBackendWithOptions(pair.RemoteURL, pair.BackendOptions())
+		blobStore := blob.NewThrottledBackend(backend, upload, download)
+		log.Printf("Pair %v: %v <-> %v (%v)", pair.Name, pair.Local, pair.Remote, pair.Direction)
+		opts := cfg.SyncerOptions(pair)
+		if pair.Lease {
+			opts.Lease = leaser(backend)
+		}
+		if pair.Journal {
+			opts.Journal = journaler(backend)
+		}
+		if sf.daemon {
+			if opts.Feed, err = pair.OpenFeed(); err != nil {
+				fail("Pair %v: %v", pair.Name, err)
+			}
+			if pair.Retention != nil && pair.Retention.PruneInterval > 0 {
+				opts.Pruner = retention.NewPruner(pair.Name, pairPruneTarget(pair, backend), *pair.Retention)
+				opts.PruneInterval = pair.Retention.PruneInterval
+			}
+		}
+		syncers = append(syncers, syncer.NewSyncerWithOptions(pair.Local, blobStore, opts))
+	}
+	if len(syncers) == 0 {
+		usageError(flags, "No pair named %q in %v", *sf.pairName, *sf.configPath)
+	}
+	return syncers, upload, download
+}
+
+// daemonCommand syncs the pairs in a loop and serves the status. It never returns.
+func daemonCommand(args []string) {
+	flags := newFlagSet("daemon")
+	sf := addSyncFlags(flags, false)
+	sf.daemon = true
+	statusAddr := flags.String("status_addr", server.DefaultAddr,
+		"Serve the status (see `cloudsync status`) and prometheus metrics (/metrics) on this address. Eg: 127.0.0.1:7321, "+
+			"unix:/tmp/cloudsync.sock. Empty disables it")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		usageError(flags, "Unexpected arguments %v", flags.Args())
+	}
+	syncers, upload, download := sf.syncers(flags)
+	startables := make([]startable, 0, len(syncers))
+	for _, s := range syncers {
+		startables = append(startables, s)
+	}
+	runSyncers(startables, *statusAddr, upload, download)
+}
+
 func main() {
-	localPath := flag.String("local", ".", "Local Path")
-	localTrash := flag.String("local_trash", "./.trash", "Local Trash")
-	remotePath := flag.String("remote", "",
-		"Local Path (currently only gcp is supported)",
-	)
-	remoteTrash := flag.String("remote_trash_prefix", ".trash",
-		"Removed blobs will be stored in this prefix. Items in trash whose "+
-			"timestamp is older than 30 days will be deleted for good")
-	flag.Parse()
-	if *remotePath == "" {
-		log.Fatalln("Oops: remotePath is empty")
-	}
-	remote, _ := url.Parse(*remotePath)
-	blobStore := blob.NewBackend(*remote, *remoteTrash)
-	syncerObj := syncer.NewSyncer(*localPath, *localTrash, blobStore)
-	syncerObj.Start()
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	name, args := os.Args[1], os.Args[2:]
+	if strings.HasPrefix(name, "-") {
+		if name == "-h" || name == "-help" || name == "--help" {
+			printUsage()
+			return
+		}
+		// Before the subcommands, cloudsync only had the flags of the daemon.
+		name, args = "daemon", os.Args[1:]
+	}
+	c := findCommand(name)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	c.run(args)
 }
@@ -0,0 +1,264 @@
+// Package metrics is a tiny metrics registry that can be scraped by prometheus.
+// It supports counters, gauges and histograms with labels, which is all cloudsync
+// needs, and writes them in the prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets (in seconds) fit both quick backend calls and slow scans.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+type series struct {
+	labelValues []string
+	value       float64
+	// Only for histograms. bucketCounts[i] is the number of observations <= buckets[i].
+	bucketCounts []uint64
+	count        uint64
+	valueFunc    func() float64
+}
+
+type metric struct {
+	mu         sync.Mutex
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+}
+
+// Registry holds a set of metrics. Use Default unless you need an isolated set.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+func (r *Registry) register(name, help string, typ metricType, buckets []float64, labelNames []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.metrics[name]; ok {
+		if existing.typ != typ || strings.Join(existing.labelNames, ",") != strings.Join(labelNames, ",") {
+			panic(fmt.Sprintf("metric %v registered twice with different types or labels", name))
+		}
+		return existing
+	}
+	m := &metric{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	r.metrics[name] = m
+	return m
+}
+
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %v expects labels %v, got %v", m.name, m.labelNames, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if m.typ == typeHistogram {
+			s.bucketCounts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+type CounterVec struct{ m *metric }
+type GaugeVec struct{ m *metric }
+type HistogramVec struct{ m *metric }
+
+// NewCounterVec registers a counter. Registering the same name again returns the
+// existing metric.
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, typeCounter, nil, labelNames)}
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, typeGauge, nil, labelNames)}
+}
+
+// NewHistogramVec registers a histogram. A nil buckets means DefaultBuckets.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{r.register(name, help, typeHistogram, buckets, labelNames)}
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("counters can only go up")
+	}
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.get(labelValues).value += delta
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labelValues).value = value
+}
+
+// SetFunc makes the gauge call f every time it is scraped.
+func (g *GaugeVec) SetFunc(f func() float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labelValues).valueFunc = f
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.get(labelValues)
+	for i, bound := range h.m.buckets {
+		if value <= bound {
+			s.bucketCounts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// ObserveSince records the time elapsed since start in seconds.
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// The HELP text escapes the same as label values, except for the quotes.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%v="%v"`, name, labelValueEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf(`%v="%v"`, extraName, extraValue))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (m *metric) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", m.name, helpEscaper.Replace(m.help), m.name, m.typ); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		var err error
+		switch m.typ {
+		case typeHistogram:
+			for i, bound := range m.buckets {
+				if _, err = fmt.Fprintf(w, "%v_bucket%v %v\n", m.name,
+					formatLabels(m.labelNames, s.labelValues, "le", formatFloat(bound)), s.bucketCounts[i]); err != nil {
+					return err
+				}
+			}
+			_, err = fmt.Fprintf(w, "%v_bucket%v %v\n%v_sum%v %v\n%v_count%v %v\n",
+				m.name, formatLabels(m.labelNames, s.labelValues, "le", "+Inf"), s.count,
+				m.name, formatLabels(m.labelNames, s.labelValues, "", ""), formatFloat(s.value),
+				m.name, formatLabels(m.labelNames, s.labelValues, "", ""), s.count)
+		default:
+			value := s.value
+			if s.valueFunc != nil {
+				value = s.valueFunc()
+			}
+			_, err = fmt.Fprintf(w, "%v%v %v\n", m.name, formatLabels(m.labelNames, s.labelValues, "", ""), formatFloat(value))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteText writes all the metrics in the prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		r.mu.Lock()
+		m := r.metrics[name]
+		r.mu.Unlock()
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := r.WriteText(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/dotslash/cloudsync/mount"
+	"github.com/dotslash/cloudsync/util"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// mountCommand serves a remote as a FUSE filesystem until it is unmounted or
+// interrupted. Files are downloaded when they are first opened.
+func mountCommand(args []string) {
+	flags := newFlagSet("mount")
+	rf := addRemoteFlags(flags)
+	cacheDir := flags.String("cache_dir", "", "Downloaded and written files are kept here")
+	cacheSize := flags.String("cache_size", "1G", "Downloaded files are evicted past this size. Eg: 512M, 0 for no limit")
+	readOnly := flags.Bool("read_only", false, "Mount read only")
+	refresh := flags.Duration("refresh", time.Minute, "How often the remote is listed again")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 || *cacheDir == "" {
+		usageError(flags, "mount needs -cache_dir and a mount point")
+	}
+	maxCache, err := util.ParseByteSize(*cacheSize)
+	if err != nil {
+		usageError(flags, "%v", err)
+	}
+	mountPoint := flags.Arg(0)
+	backend := rf.backend(flags)
+
+	filesys, err := mount.New(backend, mount.Options{
+		CacheDir:  *cacheDir,
+		CacheSize: maxCache,
+		Refresh:   *refresh,
+		ReadOnly:  *readOnly,
+	})
+	if err != nil {
+		fail("%v", err)
+	}
+	options := []fuse.MountOption{fuse.FSName("cloudsync"), fuse.Subtype("cloudsync")}
+	if *readOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+	conn, err := fuse.Mount(mountPoint, options...)
+	if err != nil {
+		fail("Mounting %v failed: %v", mountPoint, err)
+	}
+	defer conn.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("mount: unmounting %v", mountPoint)
+		if err := fuse.Unmount(mountPoint); err != nil {
+			log.Printf("mount: unmounting %v failed, is it busy? - %v", mountPoint, err)
+		}
+	}()
+
+	log.Printf("mount: serving %v", mountPoint)
+	if err = fs.Serve(conn, filesys); err != nil {
+		fail("Serving %v failed: %v", mountPoint, err)
+	}
+	<-conn.Ready
+	if conn.MountError != nil {
+		fail("Mounting %v failed: %v", mountPoint, conn.MountError)
+	}
+}
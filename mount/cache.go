@@ -0,0 +1,257 @@
+package mount
+
+import (
+	"container/list"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cache has the downloaded content by md5, so a file is downloaded once no
+// matter how many paths have it, and the files being written. The content is
+// evicted, least recently used first, when it grows over maxSize.
+type cache struct {
+	contentDir string
+	workDir    string
+	// Work copies that could not be uploaded are moved here.
+	failedDir string
+	// 0 for no limit.
+	maxSize int64
+	// Serializes the downloads of the same content.
+	mu       sync.Mutex
+	fetching map[string]*fetchLock
+	// Of *cachedContent, the most recently used first.
+	used  *list.List
+	byMd5 map[string]*list.Element
+	size  int64
+}
+
+// fetchLock is dropped from cache.fetching when the last holder unlocks it.
+type fetchLock struct {
+	sync.Mutex
+	refs int
+}
+
+type cachedContent struct {
+	md5  string
+	size int64
+}
+
+func newCache(dir string, maxSize int64) (*cache, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("the mount needs a cache dir")
+	}
+	c := &cache{
+		contentDir: path.Join(dir, "content"),
+		workDir:    path.Join(dir, "work"),
+		failedDir:  path.Join(dir, "failed"),
+		maxSize:    maxSize,
+		fetching:   make(map[string]*fetchLock),
+		used:       list.New(),
+		byMd5:      make(map[string]*list.Element),
+	}
+	for _, d := range []string{c.contentDir, c.workDir, c.failedDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	// The content of earlier mounts, by the time it was cached.
+	files, err := os.ReadDir(c.contentDir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "download-") {
+			// Left by an interrupted download.
+			_ = os.Remove(path.Join(c.contentDir, f.Name()))
+		} else if info, err := f.Info(); err == nil && info.Mode().IsRegular() {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		c.used.PushFront(&cachedContent{md5: info.Name(), size: info.Size()})
+		c.byMd5[info.Name()] = c.used.Front()
+		c.size += info.Size()
+	}
+	c.evict()
+	return c, nil
+}
+
+func (c *cache) contentPath(md5sum string) string {
+	return path.Join(c.contentDir, md5sum)
+}
+
+func (c *cache) workPath(p util.RelPathType) string {
+	return path.Join(c.workDir, p.String())
+}
+
+func (c *cache) lock(md5sum string) func() {
+	c.mu.Lock()
+	l, ok := c.fetching[md5sum]
+	if !ok {
+		l = &fetchLock{}
+		c.fetching[md5sum] = l
+	}
+	l.refs++
+	c.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(c.fetching, md5sum)
+		}
+	}
+}
+
+// fetch opens the cached content of entry, downloading it if it is not cached
+// yet. An open file stays readable when its content is evicted.
+func (c *cache) fetch(backend blob.Backend, entry *blob.MetaEntry) (*os.File, error) {
+	if entry.Md5 == "" {
+		return nil, fmt.Errorf("%v has no md5, it can not be cached", entry.RelPath)
+	}
+	cached := c.contentPath(entry.Md5)
+	unlock := c.lock(entry.Md5)
+	file, err := os.Open(cached)
+	if err == nil {
+		c.touch(entry.Md5, -1)
+		unlock()
+		return file, nil
+	}
+	size, err := c.download(backend, entry)
+	if err == nil {
+		c.touch(entry.Md5, size)
+		file, err = os.Open(cached)
+	}
+	unlock()
+	c.evict()
+	return file, err
+}
+
+// download downloads the content of entry into the cache and returns its size.
+// Must be called with the lock of the md5 held.
+func (c *cache) download(backend blob.Backend, entry *blob.MetaEntry) (int64, error) {
+	log.Printf("mount: downloading %v", entry.RelPath)
+	full, err := backend.Get(entry.RelPath)
+	if err != nil {
+		return 0, err
+	}
+	defer full.Content.Close()
+	tmp, err := os.CreateTemp(c.contentDir, "download-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), full.Content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	} else if got := hex.EncodeToString(hash.Sum(nil)); got != entry.Md5 {
+		// Changed since the listing. It is picked up by the next one.
+		return 0, fmt.Errorf("%v has md5 %v, expected %v", entry.RelPath, got, entry.Md5)
+	}
+	return size, os.Rename(tmp.Name(), c.contentPath(entry.Md5))
+}
+
+// keep moves a file that was uploaded from the work dir into the content cache.
+func (c *cache) keep(workFile, md5sum string) {
+	unlock := c.lock(md5sum)
+	info, err := os.Stat(workFile)
+	if err == nil {
+		err = os.Rename(workFile, c.contentPath(md5sum))
+	}
+	if err != nil {
+		log.Printf("mount: caching %v failed - %v", workFile, err)
+		_ = os.Remove(workFile)
+	} else {
+		c.touch(md5sum, info.Size())
+	}
+	unlock()
+	c.evict()
+}
+
+// touch marks the content as the most recently used one. size is -1 if it is
+// not known, for content that is already accounted for.
+func (c *cache) touch(md5sum string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.byMd5[md5sum]; ok {
+		c.used.MoveToFront(e)
+		content := e.Value.(*cachedContent)
+		if size >= 0 {
+			c.size += size - content.size
+			content.size = size
+		}
+		return
+	}
+	if size < 0 {
+		// Cached by an earlier mount after this one listed the dir.
+		size = 0
+		if info, err := os.Stat(c.contentPath(md5sum)); err == nil {
+			size = info.Size()
+		}
+	}
+	c.byMd5[md5sum] = c.used.PushFront(&cachedContent{md5: md5sum, size: size})
+	c.size += size
+}
+
+// evict removes the least recently used content until the cache fits in
+// maxSize. The most recently used one is always kept.
+func (c *cache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	var victims []string
+	c.mu.Lock()
+	for c.size > c.maxSize && c.used.Len() > 1 {
+		content := c.used.Remove(c.used.Back()).(*cachedContent)
+		delete(c.byMd5, content.md5)
+		c.size -= content.size
+		victims = append(victims, content.md5)
+	}
+	c.mu.Unlock()
+	for _, md5sum := range victims {
+		unlock := c.lock(md5sum)
+		c.mu.Lock()
+		_, reused := c.byMd5[md5sum]
+		c.mu.Unlock()
+		// Unless it was fetched again meanwhile.
+		if !reused {
+			if err := os.Remove(c.contentPath(md5sum)); err != nil && !os.IsNotExist(err) {
+				log.Printf("mount: evicting %v failed - %v", md5sum, err)
+			}
+		}
+		unlock()
+	}
+}
+
+// keepFailed moves the work copy of p, which could not be uploaded, out of the
+// way of the next writer and returns where it is now.
+func (c *cache) keepFailed(p util.RelPathType) (string, error) {
+	dst := path.Join(c.failedDir, time.Now().UTC().Format(util.TrashTimeFormat), p.String())
+	return dst, util.MoveFile(c.workPath(p), dst)
+}
+
+func copyFile(from *os.File, dst string) error {
+	to, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	return util.CopyAndClose(to, from)
+}
@@ -0,0 +1,262 @@
+// Package mount serves a remote as a FUSE filesystem. The tree is the listing of
+// the remote (see blob.ListDirRecursive), refreshed periodically, and a file is
+// downloaded into a local cache the first time it is opened. Written files are
+// uploaded when they are closed, through syncer.WriteBack, so a blob that
+// changed meanwhile is kept as a conflict copy like a sync round would.
+package mount
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const defaultRefreshInterval = time.Minute
+
+type Options struct {
+	// Cached content is kept in <CacheDir>/content/<md5>, the files being
+	// written in <CacheDir>/work/<path> and the ones that could not be uploaded
+	// in <CacheDir>/failed/<time>/<path>.
+	CacheDir string
+	// The cached content is evicted, least recently used first, past this many
+	// bytes. 0 for no limit.
+	CacheSize int64
+	// How often the remote is listed again. Defaults to a minute.
+	Refresh  time.Duration
+	ReadOnly bool
+}
+
+// tree is the view of the remote at the last listing.
+type tree struct {
+	// Files and directory markers.
+	entries map[util.RelPathType]*blob.MetaEntry
+	// Directory (without a trailing "/", "" for the root) -> child name -> is a directory.
+	dirs map[string]map[string]bool
+}
+
+func newTree() *tree {
+	return &tree{
+		entries: make(map[util.RelPathType]*blob.MetaEntry),
+		dirs:    map[string]map[string]bool{"": {}},
+	}
+}
+
+// addDir adds dir and its parents. The root is always there.
+func (t *tree) addDir(dir string) {
+	if _, ok := t.dirs[dir]; ok {
+		return
+	}
+	t.dirs[dir] = make(map[string]bool)
+	parent, name := splitPath(dir)
+	t.addDir(parent)
+	t.dirs[parent][name] = true
+}
+
+func (t *tree) add(entry *blob.MetaEntry) {
+	t.entries[entry.RelPath] = entry
+	if entry.RelPath.IsDir() {
+		t.addDir(dirOf(entry.RelPath))
+		return
+	}
+	parent, name := splitPath(entry.RelPath.String())
+	t.addDir(parent)
+	t.dirs[parent][name] = false
+}
+
+// remove removes a file, or an empty directory.
+func (t *tree) remove(p string, isDir bool) {
+	parent, name := splitPath(p)
+	delete(t.dirs[parent], name)
+	if isDir {
+		delete(t.dirs, p)
+		delete(t.entries, util.RelPathType(p+"/"))
+	} else {
+		delete(t.entries, util.RelPathType(p))
+	}
+}
+
+func splitPath(p string) (dir, name string) {
+	dir, name = path.Split(p)
+	return path.Clean("/" + dir)[1:], name
+}
+
+func dirOf(marker util.RelPathType) string {
+	return marker.String()[:len(marker)-1]
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// FS is the filesystem. Serve it with fs.Serve.
+type FS struct {
+	backend  blob.Backend
+	cache    *cache
+	refresh  time.Duration
+	readOnly bool
+	started  time.Time
+
+	mu sync.Mutex
+	// Broadcast when a listing is done.
+	listed   *sync.Cond
+	tree     *tree
+	hasTree  bool
+	listedAt time.Time
+	listing  bool
+	// Counts the changes made to the tree, which a listing that started before
+	// one of them may miss.
+	changes int
+	// Handed out nodes by path, so that the kernel sees the same node for a path.
+	nodes map[string]fs.Node
+	// Entries of the files with writable handles. Kept in the tree across listings.
+	writing map[util.RelPathType]*blob.MetaEntry
+}
+
+var _ fs.FS = (*FS)(nil)
+
+func New(backend blob.Backend, opts Options) (*FS, error) {
+	c, err := newCache(opts.CacheDir, opts.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Refresh <= 0 {
+		opts.Refresh = defaultRefreshInterval
+	}
+	f := &FS{
+		backend:  backend,
+		cache:    c,
+		refresh:  opts.Refresh,
+		readOnly: opts.ReadOnly,
+		started:  time.Now(),
+		tree:     newTree(),
+		nodes:    make(map[string]fs.Node),
+		writing:  make(map[util.RelPathType]*blob.MetaEntry),
+	}
+	f.listed = sync.NewCond(&f.mu)
+	return f, nil
+}
+
+func (f *FS) Root() (fs.Node, error) {
+	return f.dirNode(""), nil
+}
+
+// snapshot returns the tree. A stale one is listed again in the background and
+// served until the listing is done, only the first listing is waited for. Must
+// be called with f.mu held.
+func (f *FS) snapshot() *tree {
+	if time.Since(f.listedAt) >= f.refresh && !f.listing {
+		f.listing = true
+		go f.list(f.changes)
+	}
+	for !f.hasTree {
+		f.listed.Wait()
+	}
+	return f.tree
+}
+
+// list lists the remote without holding f.mu and swaps the new tree in. If the
+// tree was changed since changes, the listing is dropped as it can miss the
+// change, and the next snapshot lists again.
+func (f *FS) list(changes int) {
+	entries, err := blob.ListDirRecursive(f.backend, "")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.listed.Broadcast()
+	f.listing = false
+	if err != nil {
+		// The stale tree is better than none.
+		log.Printf("mount: listing the remote failed, retrying in %v - %v", f.refresh, err)
+		f.listedAt, f.hasTree = time.Now(), true
+		return
+	} else if f.hasTree && f.changes != changes {
+		return
+	}
+	t := newTree()
+	for p := range entries {
+		e := entries[p]
+		t.add(&e)
+	}
+	for p, e := range f.writing {
+		if _, ok := t.entries[p]; !ok {
+			t.add(e)
+		}
+	}
+	f.tree, f.listedAt, f.hasTree = t, time.Now(), true
+}
+
+// add and remove change the tree. Must be called with f.mu held.
+func (f *FS) add(entry *blob.MetaEntry) {
+	f.tree.add(entry)
+	f.changes++
+}
+
+func (f *FS) remove(p string, isDir bool) {
+	f.tree.remove(p, isDir)
+	f.changes++
+}
+
+// invalidate makes the next snapshot start listing the remote again.
+func (f *FS) invalidate() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listedAt = time.Time{}
+}
+
+func (f *FS) dirNode(p string) *dirNode {
+	if n, ok := f.nodes[p].(*dirNode); ok {
+		return n
+	}
+	n := &dirNode{fs: f, path: p}
+	f.nodes[p] = n
+	return n
+}
+
+func (f *FS) fileNode(p util.RelPathType) *fileNode {
+	if n, ok := f.nodes[p.String()].(*fileNode); ok {
+		return n
+	}
+	n := &fileNode{fs: f, path: p}
+	f.nodes[p.String()] = n
+	return n
+}
+
+func (f *FS) forget(p string, n fs.Node) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.nodes[p] == n {
+		delete(f.nodes, p)
+	}
+}
+
+// entry returns the current metadata of a file, nil if it is not there.
+func (f *FS) entry(p util.RelPathType) *blob.MetaEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.snapshot().entries[p]
+}
+
+// setEntry updates the metadata of a file after it was written. writing tells
+// whether it still has writable handles.
+func (f *FS) setEntry(entry *blob.MetaEntry, writing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.add(entry)
+	if writing {
+		f.writing[entry.RelPath] = entry
+	} else {
+		delete(f.writing, entry.RelPath)
+	}
+}
+
+func (f *FS) owner(a *fuse.Attr) {
+	a.Uid, a.Gid = uint32(os.Getuid()), uint32(os.Getgid())
+}
@@ -0,0 +1,480 @@
+package mount
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/syncer"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	errReadOnly = fuse.Errno(syscall.EROFS)
+	errBusy     = fuse.Errno(syscall.EBUSY)
+	errIO       = fuse.Errno(syscall.EIO)
+)
+
+type dirNode struct {
+	fs   *FS
+	path string
+}
+
+var (
+	_ fs.NodeStringLookuper = (*dirNode)(nil)
+	_ fs.HandleReadDirAller = (*dirNode)(nil)
+	_ fs.NodeCreater        = (*dirNode)(nil)
+	_ fs.NodeMkdirer        = (*dirNode)(nil)
+	_ fs.NodeRemover        = (*dirNode)(nil)
+	_ fs.NodeRenamer        = (*dirNode)(nil)
+	_ fs.NodeForgetter      = (*dirNode)(nil)
+)
+
+func (d *dirNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	t := d.fs.snapshot()
+	if _, ok := t.dirs[d.path]; !ok {
+		return fuse.ENOENT
+	}
+	a.Mode, a.Mtime = os.ModeDir|0755, d.fs.started
+	if d.fs.readOnly {
+		a.Mode = os.ModeDir | 0555
+	}
+	if marker := t.entries[util.RelPathType(d.path+"/")]; marker != nil {
+		a.Mtime = marker.ModTime
+	}
+	d.fs.owner(a)
+	return nil
+}
+
+func (d *dirNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	isDir, ok := d.fs.snapshot().dirs[d.path][name]
+	if !ok {
+		return nil, fuse.ENOENT
+	} else if isDir {
+		return d.fs.dirNode(joinPath(d.path, name)), nil
+	}
+	return d.fs.fileNode(util.RelPathType(joinPath(d.path, name))), nil
+}
+
+func (d *dirNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	t := d.fs.snapshot()
+	children, ok := t.dirs[d.path]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	ret := make([]fuse.Dirent, 0, len(children))
+	for name, isDir := range children {
+		dirent := fuse.Dirent{Name: name, Type: fuse.DT_File}
+		if isDir {
+			dirent.Type = fuse.DT_Dir
+		} else if e := t.entries[util.RelPathType(joinPath(d.path, name))]; e != nil && e.SymlinkTarget != "" {
+			dirent.Type = fuse.DT_Link
+		}
+		ret = append(ret, dirent)
+	}
+	return ret, nil
+}
+
+func (d *dirNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if d.fs.readOnly {
+		return nil, nil, errReadOnly
+	}
+	d.fs.mu.Lock()
+	n := d.fs.fileNode(util.RelPathType(joinPath(d.path, req.Name)))
+	d.fs.mu.Unlock()
+	h, err := n.openWrite(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return n, h, nil
+}
+
+func (d *dirNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if d.fs.readOnly {
+		return nil, errReadOnly
+	}
+	p := joinPath(d.path, req.Name)
+	marker := util.RelPathType(p + "/")
+	if err := d.fs.backend.Put(marker, io.NopCloser(strings.NewReader("")), blob.PutOptions{}); err != nil {
+		log.Printf("mount: creating %v failed - %v", marker, err)
+		return nil, errIO
+	}
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	d.fs.add(&blob.MetaEntry{RelPath: marker, Md5: util.EmptyMd5, ModTime: time.Now()})
+	return d.fs.dirNode(p), nil
+}
+
+// Remove moves a file to the remote trash (if the backend has one). Directories
+// can only be removed when they are empty.
+func (d *dirNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if d.fs.readOnly {
+		return errReadOnly
+	}
+	p := joinPath(d.path, req.Name)
+	d.fs.mu.Lock()
+	t := d.fs.snapshot()
+	target := util.RelPathType(p)
+	if req.Dir {
+		target += "/"
+		if len(t.dirs[p]) != 0 {
+			d.fs.mu.Unlock()
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	} else if d.fs.writing[target] != nil {
+		d.fs.mu.Unlock()
+		return errBusy
+	}
+	_, exists := t.entries[target]
+	d.fs.mu.Unlock()
+
+	if exists {
+		if err := d.fs.backend.Delete(target); err != nil && err != blob.ErrNotExist {
+			log.Printf("mount: removing %v failed - %v", target, err)
+			return errIO
+		}
+	}
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	d.fs.remove(p, req.Dir)
+	delete(d.fs.nodes, p)
+	return nil
+}
+
+// Rename moves a file on the remote. Directories are not renamed, tools like mv
+// fall back to copying them.
+func (d *dirNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if d.fs.readOnly {
+		return errReadOnly
+	}
+	to, ok := newDir.(*dirNode)
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	from, toPath := joinPath(d.path, req.OldName), joinPath(to.path, req.NewName)
+	d.fs.mu.Lock()
+	t := d.fs.snapshot()
+	entry := t.entries[util.RelPathType(from)]
+	busy := d.fs.writing[util.RelPathType(from)] != nil || d.fs.writing[util.RelPathType(toPath)] != nil
+	d.fs.mu.Unlock()
+	if entry == nil {
+		// Directories.
+		return fuse.Errno(syscall.EXDEV)
+	} else if busy {
+		return errBusy
+	}
+	if err := d.fs.backend.Move(util.RelPathType(from), util.RelPathType(toPath)); err != nil {
+		log.Printf("mount: moving %v to %v failed - %v", from, toPath, err)
+		return errIO
+	}
+	moved := *entry
+	moved.RelPath = util.RelPathType(toPath)
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	d.fs.remove(from, false)
+	d.fs.add(&moved)
+	delete(d.fs.nodes, from)
+	delete(d.fs.nodes, toPath)
+	return nil
+}
+
+func (d *dirNode) Forget() {
+	d.fs.forget(d.path, d)
+}
+
+// fileNode is a file (or a symlink) of the remote.
+type fileNode struct {
+	fs   *FS
+	path util.RelPathType
+
+	mu sync.Mutex
+	// Number of writable handles. They share the copy in the work dir.
+	writers int
+	// The work copy has changes that are not uploaded.
+	dirty bool
+	// md5 of the version the work copy started from. Empty for a new file.
+	baseMd5 string
+}
+
+var (
+	_ fs.NodeOpener     = (*fileNode)(nil)
+	_ fs.NodeSetattrer  = (*fileNode)(nil)
+	_ fs.NodeFsyncer    = (*fileNode)(nil)
+	_ fs.NodeReadlinker = (*fileNode)(nil)
+	_ fs.NodeForgetter  = (*fileNode)(nil)
+)
+
+func (n *fileNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	entry := n.fs.entry(n.path)
+	if entry == nil {
+		return fuse.ENOENT
+	}
+	a.Mode, a.Size, a.Mtime = 0644, uint64(entry.Size), entry.ModTime
+	if n.fs.readOnly {
+		a.Mode = 0444
+	}
+	if entry.SymlinkTarget != "" {
+		a.Mode, a.Size = os.ModeSymlink|0777, uint64(len(entry.SymlinkTarget))
+	}
+	n.mu.Lock()
+	if n.writers > 0 {
+		if info, err := os.Stat(n.fs.cache.workPath(n.path)); err == nil {
+			a.Size, a.Mtime = uint64(info.Size()), info.ModTime()
+		}
+	}
+	n.mu.Unlock()
+	n.fs.owner(a)
+	return nil
+}
+
+func (n *fileNode) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	entry := n.fs.entry(n.path)
+	if entry == nil || entry.SymlinkTarget == "" {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return entry.SymlinkTarget, nil
+}
+
+func (n *fileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		if n.fs.readOnly {
+			return nil, errReadOnly
+		}
+		return n.openWrite(req.Flags&fuse.OpenTruncate != 0)
+	}
+	n.mu.Lock()
+	writing := n.writers > 0
+	n.mu.Unlock()
+	if writing {
+		// Readers see what the writers wrote so far.
+		file, err := os.Open(n.fs.cache.workPath(n.path))
+		if err != nil {
+			return nil, err
+		}
+		return &readHandle{file: file}, nil
+	}
+	entry := n.fs.entry(n.path)
+	if entry == nil {
+		return nil, fuse.ENOENT
+	}
+	file, err := n.fs.cache.fetch(n.fs.backend, entry)
+	if err == blob.ErrNotExist {
+		n.fs.invalidate()
+		return nil, fuse.ENOENT
+	} else if err != nil {
+		log.Printf("mount: fetching %v failed - %v", n.path, err)
+		return nil, errIO
+	}
+	// The cached content never changes, the kernel can keep it.
+	resp.Flags |= fuse.OpenKeepCache
+	return &readHandle{file: file}, nil
+}
+
+// openWrite returns a writable handle on the work copy of the file, which is
+// made from the cached content (unless truncate is set) by the first writer.
+func (n *fileNode) openWrite(truncate bool) (*writeHandle, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	work := n.fs.cache.workPath(n.path)
+	if n.writers == 0 {
+		entry := n.fs.entry(n.path)
+		pending := &blob.MetaEntry{RelPath: n.path, Md5: util.EmptyMd5, ModTime: time.Now()}
+		n.baseMd5, n.dirty = "", true
+		if entry != nil {
+			pending = entry
+			n.baseMd5, n.dirty = entry.Md5, truncate && entry.Size > 0
+		}
+		if err := os.MkdirAll(path.Dir(work), 0755); err != nil {
+			return nil, err
+		}
+		if entry != nil && !truncate {
+			cached, err := n.fs.cache.fetch(n.fs.backend, entry)
+			if err != nil {
+				log.Printf("mount: fetching %v failed - %v", n.path, err)
+				return nil, errIO
+			} else if err = copyFile(cached, work); err != nil {
+				return nil, err
+			}
+		} else if err := os.WriteFile(work, nil, 0644); err != nil {
+			return nil, err
+		}
+		n.fs.setEntry(pending, true)
+	} else if truncate {
+		if err := os.Truncate(work, 0); err != nil {
+			return nil, err
+		}
+		n.dirty = true
+	}
+	file, err := os.OpenFile(work, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	n.writers++
+	return &writeHandle{readHandle: readHandle{file: file}, node: n}, nil
+}
+
+// Setattr only supports changing the size. The other attributes come from the
+// remote.
+func (n *fileNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		if n.fs.readOnly {
+			return errReadOnly
+		}
+		h, err := n.openWrite(false)
+		if err != nil {
+			return err
+		}
+		err = h.file.Truncate(int64(req.Size))
+		n.mu.Lock()
+		n.dirty = true
+		n.mu.Unlock()
+		if releaseErr := h.release(); err == nil {
+			err = releaseErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return n.Attr(ctx, &resp.Attr)
+}
+
+func (n *fileNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.writeBack()
+}
+
+// writeBack uploads the work copy if it has changes. Must be called with n.mu held.
+// It does not take the lease of the remote: the blob is looked at right before
+// the upload, and one that changed is kept as a conflict copy.
+func (n *fileNode) writeBack() error {
+	if !n.dirty {
+		return nil
+	}
+	err := syncer.WriteBack(n.fs.backend, n.fs.cache.workDir, n.path, n.baseMd5)
+	if err != nil {
+		log.Printf("mount: uploading %v failed - %v", n.path, err)
+		return errIO
+	}
+	n.dirty = false
+	meta, err := n.fs.backend.GetMeta(n.path)
+	if err != nil {
+		n.fs.invalidate()
+		return nil
+	}
+	local, err := util.GetLocalFileMeta(n.fs.cache.workDir, n.path.String(), util.SymlinkFollow)
+	if err != nil || local.Md5sum != meta.Md5 {
+		// The written version was kept as a conflict copy, which shows up with the
+		// next listing.
+		n.fs.invalidate()
+	}
+	n.baseMd5 = meta.Md5
+	n.fs.setEntry(meta, n.writers > 0)
+	return nil
+}
+
+// release is called when a writable handle is closed. The last one uploads the
+// changes and moves the work copy into the cache.
+func (n *fileNode) release() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.writers--
+	if n.writers > 0 {
+		return nil
+	}
+	err := n.writeBack()
+	n.fs.mu.Lock()
+	delete(n.fs.writing, n.path)
+	n.fs.mu.Unlock()
+	if err != nil {
+		if kept, keepErr := n.fs.cache.keepFailed(n.path); keepErr == nil {
+			log.Printf("mount: the version of %v that could not be uploaded is in %v", n.path, kept)
+		}
+		n.fs.invalidate()
+		return err
+	}
+	if local, metaErr := util.GetLocalFileMeta(n.fs.cache.workDir, n.path.String(), util.SymlinkFollow); metaErr == nil {
+		n.fs.cache.keep(n.fs.cache.workPath(n.path), local.Md5sum)
+	}
+	return nil
+}
+
+func (n *fileNode) Forget() {
+	n.fs.forget(n.path.String(), n)
+}
+
+type readHandle struct {
+	file *os.File
+}
+
+var (
+	_ fs.HandleReader   = (*readHandle)(nil)
+	_ fs.HandleReleaser = (*readHandle)(nil)
+)
+
+func (h *readHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := h.file.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *readHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.file.Close()
+}
+
+type writeHandle struct {
+	readHandle
+	node *fileNode
+}
+
+var (
+	_ fs.HandleWriter  = (*writeHandle)(nil)
+	_ fs.HandleFlusher = (*writeHandle)(nil)
+)
+
+func (h *writeHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	n, err := h.file.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	h.node.mu.Lock()
+	h.node.dirty = true
+	h.node.mu.Unlock()
+	return err
+}
+
+// Flush is called on every close(2), so that errors of the upload are returned
+// to the writer.
+func (h *writeHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.node.mu.Lock()
+	defer h.node.mu.Unlock()
+	return h.node.writeBack()
+}
+
+func (h *writeHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.release()
+}
+
+func (h *writeHandle) release() error {
+	closeErr := h.file.Close()
+	if err := h.node.release(); err != nil {
+		return err
+	}
+	return closeErr
+}
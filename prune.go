@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/config"
+	"github.com/dotslash/cloudsync/retention"
+	"github.com/dotslash/cloudsync/syncer"
+	"os"
+	"path"
+	"time"
+)
+
+// pruneTarget is what the retention of a pair applies to: the versions and the
+// journal of its remote and its trashes.
+func pruneTarget(backend blob.Backend, remoteTrash bool, localPath, localTrash string) retention.Target {
+	var target retention.Target
+	if versions, ok := backend.(blob.Versioner); ok {
+		target.Versions = versions
+	}
+	if trash, ok := backend.(blob.Trash); ok && remoteTrash {
+		target.RemoteTrash = trash
+	}
+	if journal, ok := backend.(blob.Journaler); ok {
+		target.Journal = journal
+	}
+	if localTrash != "" {
+		trash, err := syncer.NewLocalTrash(localPath, localTrash)
+		if err != nil {
+			fail("%v", err)
+		}
+		target.LocalTrash = trash
+	}
+	return target
+}
+
+func pairPruneTarget(pair *config.PairConfig, backend blob.Backend) retention.Target {
+	return pruneTarget(backend, pair.RemoteTrashPrefix != "", pair.Local, pair.LocalTrash)
+}
+
+// pruneCommand removes the old versions and trash entries that the retention of
+// the pairs (or the one given by flags) does not keep.
+func pruneCommand(args []string) {
+	flags := newFlagSet("prune")
+	rf := addRemoteFlags(flags).withLease(flags)
+	localPath := flags.String("local", "", "Local path, without -config (to prune the local trash)")
+	localTrash := flags.String("local_trash", "", "Local trash, without -config. Defaults to <local>/.trash")
+	keepVersions := flags.Int("keep_versions", 0, "Keep this many noncurrent versions of each blob")
+	keepDaily := flags.Int("keep_daily", 0, "Keep the last version of each day of this many last days")
+	keepWeekly := flags.Int("keep_weekly", 0, "Keep the last version of each week of this many last weeks")
+	trashDays := flags.Int("trash_days", 0, "Purge the trash entries removed more than this many days ago")
+	journalDays := flags.Int("journal_days", 0, "Remove the journal objects whose entries are all older than this many days")
+	dryRun := flags.Bool("dry_run", false, "Only print what would be removed")
+	asJson := flags.Bool("json", false, "Print the items as json, one per line")
+	_ = flags.Parse(args)
+	if flags.NArg() > 1 {
+		usageError(flags, "Unexpected arguments %v", flags.Args()[1:])
+	}
+	// The rules given by flags override the ones of the config.
+	override := func(policy *retention.Policy) {
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "keep_versions":
+				policy.KeepVersions = *keepVersions
+			case "keep_daily":
+				policy.KeepDaily = *keepDaily
+			case "keep_weekly":
+				policy.KeepWeekly = *keepWeekly
+			case "trash_days":
+				policy.TrashDays = *trashDays
+			case "journal_days":
+				policy.JournalDays = *journalDays
+			}
+		})
+	}
+
+	prefix := remotePrefix(flags, flags.Arg(0))
+
+	type prunedPair struct {
+		name   string
+		target retention.Target
+		policy retention.Policy
+		// To hold the lease of, nil if it is not used.
+		backend  blob.Backend
+		leaseTTL time.Duration
+	}
+	var pairs []prunedPair
+	if *rf.configPath != "" {
+		cfg, err := config.Load(*rf.configPath)
+		if err != nil {
+			usageError(flags, "Could not load %v: %v", *rf.configPath, err)
+		}
+		for i := range cfg.Pairs {
+			pair := &cfg.Pairs[i]
+			if *rf.pairName != "" && pair.Name != *rf.pairName {
+				continue
+			}
+			var policy retention.Policy
+			if pair.Retention != nil {
+				policy = *pair.Retention
+			} else if *rf.pairName == "" {
+				// Only the pairs with a retention, unless picked by -pair.
+				continue
+			}
+			override(&policy)
+			if err = policy.Validate(); err != nil {
+				usageError(flags, "Pair %v: %v", pair.Name, err)
+			}
+			backend := blob.NewBackendWithOptions(pair.RemoteURL, pair.BackendOptions())
+			pruned := prunedPair{name: pair.Name, target: pairPruneTarget(pair, backend), policy: policy}
+			if pair.Lease || *rf.lease {
+				pruned.backend, pruned.leaseTTL = backend, pair.LeaseTTL
+			}
+			pairs = append(pairs, pruned)
+		}
+		if len(pairs) == 0 && *rf.pairName != "" {
+			usageError(flags, "No pair named %q in %v", *rf.pairName, *rf.configPath)
+		} else if len(pairs) == 0 {
+			usageError(flags, "No pair of %v has a retention", *rf.configPath)
+		}
+	} else {
+		var policy retention.Policy
+		override(&policy)
+		if err := policy.Validate(); err != nil {
+			usageError(flags, "%v", err)
+		}
+		var backend blob.Backend
+		if rf.hasRemote() {
+			backend = rf.backend(flags)
+		} else if *localPath == "" {
+			usageError(flags, "Either -config, -remote or -local is needed")
+		}
+		if *localPath != "" && *localTrash == "" {
+			*localTrash = path.Join(*localPath, ".trash")
+		}
+		name := *rf.remote
+		if name == "" {
+			name = *localPath
+		}
+		target := pruneTarget(backend, *rf.remoteTrash != "", *localPath, *localTrash)
+		pruned := prunedPair{name: name, target: target, policy: policy}
+		if backend != nil && *rf.lease {
+			pruned.backend = backend
+		}
+		pairs = append(pairs, pruned)
+	}
+
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	failed := false
+	for _, pair := range pairs {
+		release := holdLease(pair.backend, pair.backend != nil && !*dryRun, pair.leaseTTL)
+		report, err := retention.Prune(pair.target, pair.policy, prefix, *dryRun)
+		release()
+		for _, item := range report.Items {
+			if *asJson {
+				_ = encoder.Encode(struct {
+					Pair string `json:"pair"`
+					retention.Item
+				}{pair.name, item})
+				continue
+			}
+			what := fmt.Sprintf("%v %v", item.Kind, item.TrashPath)
+			if item.Kind == retention.KindVersion || item.Kind == retention.KindInternal {
+				what = fmt.Sprintf("%v %v of %v", item.Kind, item.Generation, item.Path)
+			} else if item.Kind == retention.KindJournal {
+				what = fmt.Sprintf("%v %v", item.Kind, item.Path)
+			}
+			if item.Error != "" {
+				fmt.Fprintf(os.Stderr, "%v: %v\n", what, item.Error)
+			} else {
+				fmt.Printf("%v %v (%v, %v)\n", verb, what, item.Time.Local().Format("2006-01-02 15:04:05"),
+					formatBytes(item.Size))
+			}
+		}
+		if !*asJson {
+			versions, versionBytes := report.Totals(retention.KindVersion)
+			remote, remoteBytes := report.Totals(retention.KindRemoteTrash)
+			local, localBytes := report.Totals(retention.KindLocalTrash)
+			journal, journalBytes := report.Totals(retention.KindJournal)
+			internal, internalBytes := report.Totals(retention.KindInternal)
+			fmt.Printf("%v: %v %v version(s) (%v), %v remote trash entries (%v), %v local trash entries (%v), "+
+				"%v journal objects (%v) and %v internal versions (%v)\n", pair.name, verb, versions,
+				formatBytes(versionBytes), remote, formatBytes(remoteBytes), local, formatBytes(localBytes), journal,
+				formatBytes(journalBytes), internal, formatBytes(internalBytes))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", pair.name, err)
+			failed = true
+		} else if report.Failed() != 0 {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,289 @@
+// Package retention decides which old versions of the blobs, trash entries and
+// journal appends of a pair are not worth keeping anymore, and removes them. See Policy
+// for the rules.
+package retention
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	"log"
+	"strings"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// Kinds of Item.
+const (
+	KindVersion     = "version"
+	KindRemoteTrash = "remote-trash"
+	KindLocalTrash  = "local-trash"
+	KindJournal     = "journal"
+	// A noncurrent generation of an internal object, which nothing reads.
+	KindInternal = "internal-version"
+)
+
+// Policy is the retention of a pair in the config file.
+//
+//	retention:
+//	  keep_versions: 5
+//	  keep_daily: 30
+//	  keep_weekly: 52
+//	  trash_days: 30
+//	  journal_days: 365
+//	  prune_interval: 24h
+//
+// The current version of a blob is always kept. A noncurrent one (see
+// blob.Versioner) is kept if it is one of the keep_versions newest ones, or the
+// last one written on a day of the last keep_daily days, or in a week of the last
+// keep_weekly weeks. The current version counts as the last one of its day and
+// week. The others are removed, unless none of the three is set.
+type Policy struct {
+	KeepVersions int `yaml:"keep_versions"`
+	KeepDaily    int `yaml:"keep_daily"`
+	KeepWeekly   int `yaml:"keep_weekly"`
+	// Trash entries removed more than this many days ago are purged. 0 keeps them.
+	TrashDays int `yaml:"trash_days"`
+	// The journal appends (see blob.Journaler) whose entries are all older than
+	// this many days are removed. 0 keeps them.
+	JournalDays int `yaml:"journal_days"`
+	// How often the daemon prunes. 0 leaves it to `cloudsync prune`.
+	PruneInterval time.Duration `yaml:"prune_interval"`
+}
+
+func (p *Policy) Validate() error {
+	if p.KeepVersions < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 || p.TrashDays < 0 || p.JournalDays < 0 {
+		return fmt.Errorf("negative retention")
+	} else if p.PruneInterval < 0 {
+		return fmt.Errorf("negative prune_interval %v", p.PruneInterval)
+	} else if !p.PrunesVersions() && p.TrashDays == 0 && p.JournalDays == 0 {
+		return fmt.Errorf("retention needs keep_versions, keep_daily, keep_weekly, trash_days or journal_days")
+	}
+	return nil
+}
+
+// PrunesVersions is false when the policy keeps all the versions.
+func (p *Policy) PrunesVersions() bool {
+	return p.KeepVersions > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0
+}
+
+// Prunable returns the versions of a blob (oldest first, as blob.Versioner
+// returns them) that the policy does not keep, oldest first.
+func (p *Policy) Prunable(versions []blob.Version, now time.Time) []blob.Version {
+	if !p.PrunesVersions() {
+		return nil
+	}
+	days, weeks := make(map[string]bool), make(map[string]bool)
+	var ret []blob.Version
+	noncurrent := 0
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		keep := v.Current()
+		if !keep {
+			noncurrent++
+			keep = noncurrent <= p.KeepVersions
+		}
+		// Going from the newest, the first version of a day (or week) is its last.
+		// The current version takes the bucket of its day and week like the others.
+		created, age := v.Created.Local(), now.Sub(v.Created)
+		if dayKey := created.Format("2006-01-02"); age < time.Duration(p.KeepDaily)*day && !days[dayKey] {
+			days[dayKey], keep = true, true
+		}
+		year, week := created.ISOWeek()
+		if weekKey := fmt.Sprintf("%v-%v", year, week); age < time.Duration(p.KeepWeekly)*7*day && !weeks[weekKey] {
+			weeks[weekKey], keep = true, true
+		}
+		if !keep {
+			ret = append(ret, v)
+		}
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret
+}
+
+// Item is a version, a trash entry or a journal append that was (or would be)
+// removed.
+type Item struct {
+	Kind string `json:"kind"`
+	// Of the blob, or the name of the journal object.
+	Path util.RelPathType `json:"path"`
+	// Of a version.
+	Generation int64 `json:"generation,omitempty"`
+	// Of a trash entry.
+	TrashPath util.RelPathType `json:"trash_path,omitempty"`
+	// When the version was written, the entry removed or the last journal entry
+	// written.
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+	// Why removing it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Report is what Prune removed, or with a dry run would remove.
+type Report struct {
+	Items []Item
+}
+
+func (r *Report) add(item Item, err error) {
+	if err != nil {
+		item.Error = err.Error()
+	}
+	r.Items = append(r.Items, item)
+}
+
+// Totals returns the number and size of the items of kind that were removed
+// (or would be).
+func (r *Report) Totals(kind string) (count int, bytes int64) {
+	for _, item := range r.Items {
+		if item.Kind == kind && item.Error == "" {
+			count++
+			bytes += item.Size
+		}
+	}
+	return count, bytes
+}
+
+// Failed is the number of items that could not be removed.
+func (r *Report) Failed() int {
+	failed := 0
+	for _, item := range r.Items {
+		if item.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Target is what a pair keeps: the versions of its remote, its trashes and the
+// journal of its remote. Any of them can be nil.
+type Target struct {
+	Versions    blob.Versioner
+	RemoteTrash blob.Trash
+	LocalTrash  blob.Trash
+	Journal     blob.Journaler
+}
+
+// underPrefix is true if p is prefix, or under it by whole path components.
+func underPrefix(p util.RelPathType, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || p.String() == prefix || strings.HasPrefix(p.String(), prefix+"/")
+}
+
+// Prune removes the versions and trash entries under prefix, and without a
+// prefix the journal appends, that policy does not keep. A prune without a prefix
+// also removes the noncurrent generations of the internal objects. With dryRun it only reports them. Removing an item can fail without
+// stopping the others, listing fails the whole prune.
+func Prune(target Target, policy Policy, prefix string, dryRun bool) (*Report, error) {
+	now := time.Now()
+	report := &Report{}
+	if target.Versions != nil && policy.PrunesVersions() {
+		err := target.Versions.WalkVersions(prefix, func(name util.RelPathType, versions []blob.Version) error {
+			if !underPrefix(name, prefix) {
+				return nil
+			}
+			for _, v := range policy.Prunable(versions, now) {
+				var err error
+				if !dryRun {
+					err = target.Versions.DeleteVersion(name, v.Generation)
+				}
+				report.add(Item{Kind: KindVersion, Path: name, Generation: v.Generation, Time: v.Created, Size: v.Size}, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("listing the versions failed - %v", err)
+		}
+	}
+	// The journal is not by path, only a full prune covers it.
+	if target.Journal != nil && policy.JournalDays > 0 && prefix == "" {
+		objects, err := target.Journal.JournalObjects(now.Add(-time.Duration(policy.JournalDays) * day))
+		if err != nil {
+			return report, fmt.Errorf("listing the journal failed - %v", err)
+		}
+		for _, o := range objects {
+			if !dryRun {
+				err = target.Journal.RemoveJournalObject(o.Name)
+			}
+			report.add(Item{Kind: KindJournal, Path: util.RelPathType(o.Name), Time: o.Last, Size: o.Size}, err)
+		}
+	}
+	// Like the journal, and after it for the generations its removals left.
+	if target.Versions != nil && prefix == "" {
+		err := target.Versions.WalkInternalVersions(func(name util.RelPathType, versions []blob.Version) error {
+			for _, v := range versions {
+				if v.Current() {
+					continue
+				}
+				var err error
+				if !dryRun {
+					err = target.Versions.DeleteVersion(name, v.Generation)
+				}
+				report.add(Item{Kind: KindInternal, Path: name, Generation: v.Generation, Time: v.Replaced, Size: v.Size}, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("listing the internal versions failed - %v", err)
+		}
+	}
+	if policy.TrashDays == 0 {
+		return report, nil
+	}
+	for _, t := range []struct {
+		kind  string
+		trash blob.Trash
+	}{{KindRemoteTrash, target.RemoteTrash}, {KindLocalTrash, target.LocalTrash}} {
+		if t.trash == nil {
+			continue
+		}
+		entries, err := t.trash.ListTrash(prefix)
+		if err != nil {
+			return report, fmt.Errorf("listing the %v failed - %v", t.kind, err)
+		}
+		for _, e := range entries {
+			if now.Sub(e.DeletedAt) < time.Duration(policy.TrashDays)*day {
+				// Oldest first.
+				break
+			} else if !underPrefix(e.OriginalPath, prefix) {
+				continue
+			}
+			if !dryRun {
+				err = t.trash.Purge(e.TrashPath)
+			}
+			report.add(Item{Kind: t.kind, Path: e.OriginalPath, TrashPath: e.TrashPath, Time: e.DeletedAt, Size: e.Size}, err)
+		}
+	}
+	return report, nil
+}
+
+// Pruner prunes a pair for the daemon (see syncer.Pruner).
+type Pruner struct {
+	name   string
+	target Target
+	policy Policy
+}
+
+func NewPruner(name string, target Target, policy Policy) *Pruner {
+	return &Pruner{name: name, target: target, policy: policy}
+}
+
+func (p *Pruner) Prune() error {
+	report, err := Prune(p.target, p.policy, "", false)
+	if report != nil {
+		versions, versionBytes := report.Totals(KindVersion)
+		remote, remoteBytes := report.Totals(KindRemoteTrash)
+		local, localBytes := report.Totals(KindLocalTrash)
+		journal, journalBytes := report.Totals(KindJournal)
+		internal, internalBytes := report.Totals(KindInternal)
+		log.Printf("[%v] pruned %v version(s) (%v bytes), %v remote trash entries (%v bytes), %v local trash "+
+			"entries (%v bytes), %v journal objects (%v bytes) and %v internal versions (%v bytes)", p.name,
+			versions, versionBytes, remote, remoteBytes, local, localBytes, journal, journalBytes, internal, internalBytes)
+		if failed := report.Failed(); failed != 0 && err == nil {
+			err = fmt.Errorf("removing %v version(s), trash entries or journal objects failed", failed)
+		}
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dotslash/cloudsync/config"
+	"github.com/dotslash/cloudsync/index"
+	"github.com/dotslash/cloudsync/syncer"
+	"github.com/dotslash/cloudsync/util"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// selectTarget is the pair whose selection is changed.
+type selectTarget struct {
+	name     string
+	stateDir string
+	local    string
+	symlinks util.SymlinkPolicy
+	// From the config, used until a selection is saved in the state dir.
+	selected []string
+}
+
+func findSelectTarget(configPath, stateDir, localPath, pairName string) (*selectTarget, error) {
+	if configPath == "" {
+		if stateDir == "" || localPath == "" {
+			return nil, fmt.Errorf("either -config or -state_dir and -local are needed")
+		}
+		local, err := filepath.Abs(localPath)
+		if err != nil {
+			return nil, err
+		}
+		return &selectTarget{name: "default", stateDir: stateDir, local: local, symlinks: util.SymlinkFollow}, nil
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var found *config.PairConfig
+	for i := range cfg.Pairs {
+		if cfg.Pairs[i].Name == pairName || (pairName == "" && len(cfg.Pairs) == 1) {
+			found = &cfg.Pairs[i]
+		}
+	}
+	if found == nil && pairName == "" {
+		return nil, fmt.Errorf("%v has more than one pair, pick one with -pair", configPath)
+	} else if found == nil {
+		return nil, fmt.Errorf("no pair named %q in %v", pairName, configPath)
+	}
+	return &selectTarget{
+		name:     found.Name,
+		stateDir: cfg.PairStateDir(found),
+		local:    found.Local,
+		symlinks: util.SymlinkPolicy(found.Symlinks),
+		selected: found.Selected,
+	}, nil
+}
+
+// open opens the index for writing, so that the syncer does not start a round
+// while the selection changes, and returns the current selection (nil if
+// everything is selected).
+func (t *selectTarget) open() (*index.Index, *syncer.Selection, error) {
+	if err := os.MkdirAll(t.stateDir, 0755); err != nil {
+		return nil, nil, err
+	}
+	ix, err := index.Open(path.Join(t.stateDir, index.FileName), indexWaitTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	sel, err := syncer.LoadSelection(t.stateDir)
+	if err != nil {
+		ix.Close()
+		return nil, nil, err
+	} else if sel == nil && t.selected != nil {
+		sel = syncer.NewSelection(t.selected)
+	}
+	return ix, sel, nil
+}
+
+func printSelection(t *selectTarget, sel *syncer.Selection) {
+	if sel == nil {
+		fmt.Printf("%v: everything is selected\n", t.name)
+		return
+	}
+	fmt.Printf("%v: %v path(s) selected\n", t.name, len(sel.Paths()))
+	for _, p := range sel.Paths() {
+		fmt.Printf("  /%v\n", p)
+	}
+}
+
+func selectFlags(name string) (*flag.FlagSet, *string, *string, *string, *string) {
+	flags := newFlagSet(name)
+	configPath := flags.String("config", "", "Config file with the pairs")
+	pairName := flags.String("pair", "", "The pair (needed if the config has more than one)")
+	stateDir := flags.String("state_dir", "", "State dir of the pair (without -config)")
+	localPath := flags.String("local", "", "Local path of the pair (without -config)")
+	return flags, configPath, pairName, stateDir, localPath
+}
+
+// selectCommand adds remote subtrees to the selection of a pair. They are
+// downloaded by the next round. Without paths it prints the selection.
+func selectCommand(args []string) {
+	flags, configPath, pairName, stateDir, localPath := selectFlags("select")
+	replace := flags.Bool("replace", false,
+		"Needed when everything is selected: from then on only the given paths are synced")
+	_ = flags.Parse(args)
+
+	target, err := findSelectTarget(*configPath, *stateDir, *localPath, *pairName)
+	if err != nil {
+		usageError(flags, "%v", err)
+	}
+	ix, sel, err := target.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", target.name, err)
+		os.Exit(exitFailure)
+	}
+	defer ix.Close()
+	if flags.NArg() == 0 {
+		printSelection(target, sel)
+		return
+	}
+	if sel == nil && !*replace {
+		ix.Close()
+		fmt.Fprintf(os.Stderr, "%v: everything is selected, selecting paths would stop syncing all the others. "+
+			"Add -replace to do that\n", target.name)
+		os.Exit(exitUsage)
+	} else if sel == nil {
+		sel = syncer.NewSelection(nil)
+		fmt.Printf("%v: only the given paths are synced from now on, the other local files are left as they are\n", target.name)
+	}
+	for _, p := range flags.Args() {
+		if !sel.Add(p) {
+			fmt.Printf("%v: %v is already selected\n", target.name, p)
+		}
+	}
+	if err = syncer.SaveSelection(target.stateDir, sel); err != nil {
+		ix.Close()
+		fmt.Fprintf(os.Stderr, "%v: %v\n", target.name, err)
+		os.Exit(exitFailure)
+	}
+	printSelection(target, sel)
+	fmt.Println("The new paths are downloaded by the next sync round.")
+}
+
+// unselectCommand removes remote subtrees from the selection of a pair and
+// evicts their local copies. The blobs are not touched. Local files with changes
+// that are not uploaded yet are kept (and no longer synced).
+func unselectCommand(args []string) {
+	flags, configPath, pairName, stateDir, localPath := selectFlags("unselect")
+	dryRun := flags.Bool("dry_run", false, "Only print what would be evicted")
+	_ = flags.Parse(args)
+
+	target, err := findSelectTarget(*configPath, *stateDir, *localPath, *pairName)
+	if err != nil {
+		usageError(flags, "%v", err)
+	} else if flags.NArg() == 0 {
+		usageError(flags, "unselect needs the path(s) to remove from the selection")
+	}
+	ix, sel, err := target.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", target.name, err)
+		os.Exit(exitFailure)
+	}
+	defer ix.Close()
+	if sel == nil {
+		ix.Close()
+		fmt.Fprintf(os.Stderr, "%v: everything is selected, select the paths to keep with `cloudsync select` first\n", target.name)
+		os.Exit(exitUsage)
+	}
+	var removed []string
+	for _, p := range flags.Args() {
+		if sel.Remove(p) {
+			removed = append(removed, p)
+		} else {
+			fmt.Printf("%v: %v is not selected (only the selected paths themselves can be removed)\n", target.name, p)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	if !*dryRun {
+		// Saved first, so that an interrupted eviction is not undone by the next round.
+		if err = syncer.SaveSelection(target.stateDir, sel); err != nil {
+			ix.Close()
+			fmt.Fprintf(os.Stderr, "%v: %v\n", target.name, err)
+			os.Exit(exitFailure)
+		}
+	}
+	failed := false
+	for _, p := range removed {
+		res, err := syncer.EvictLocal(ix, target.local, p, target.symlinks, *dryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: evicting %v failed: %v\n", target.name, p, err)
+			failed = true
+			continue
+		}
+		verb := "evicted"
+		if *dryRun {
+			verb = "would evict"
+		}
+		fmt.Printf("%v: %v %v path(s) under %v\n", target.name, verb, len(res.Evicted), p)
+		for _, k := range res.Kept {
+			fmt.Printf("  kept %v, it has changes that are not uploaded\n", k)
+		}
+	}
+	if failed {
+		ix.Close()
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client talks to a running Server.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+}
+
+func NewClient(addr string) *Client {
+	transport := &http.Transport{}
+	baseURL := "http://" + addr
+	if strings.HasPrefix(addr, unixPrefix) {
+		socketPath := strings.TrimPrefix(addr, unixPrefix)
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		}
+		baseURL = "http://cloudsync"
+	}
+	return &Client{
+		httpClient: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		baseURL:    baseURL,
+	}
+}
+
+func (c *Client) getJson(path string, v interface{}) error {
+	resp, err := c.httpClient.Get(c.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("GET %v failed - %v %v", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) Status() (*StatusResponse, error) {
+	var ret StatusResponse
+	if err := c.getJson("/status", &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
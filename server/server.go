@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotslash/cloudsync/syncer"
+	"github.com/dotslash/cloudsync/util"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultAddr is where the daemon listens and where the status command looks by default.
+const DefaultAddr = "127.0.0.1:7321"
+
+const unixPrefix = "unix:"
+
+// The POSTs need this header. A web page can not set it on a cross origin request
+// without a CORS preflight, which the server does not answer, so it can not change
+// the limits of a daemon on the same machine.
+const mutationHeader = "X-Cloudsync"
+
+type StatusSource interface {
+	Status() syncer.Status
+}
+
+type Limits struct {
+	// Rates in effect right now. 0 means unlimited.
+	UploadBytesPerSec   int64 `json:"upload_bytes_per_sec"`
+	DownloadBytesPerSec int64 `json:"download_bytes_per_sec"`
+}
+
+type StatusResponse struct {
+	Time   time.Time       `json:"time"`
+	Pairs  []syncer.Status `json:"pairs"`
+	Limits Limits          `json:"limits"`
+}
+
+// Server exposes the status of the syncers (and lets the rate limits be changed)
+// over http. It listens on a tcp address or on a unix socket ("unix:/path/to/sock").
+//
+//	GET  /status                       status of all the pairs as json
+//	GET  /limits                       current rate limits
+//	POST /limits?upload=1M&download=0  override the rate limits (and their schedules)
+//	POST /limits?upload=default        go back to the configured limits
+//
+// The POSTs need an "X-Cloudsync: 1" header.
+type Server struct {
+	mux      *http.ServeMux
+	sources  []StatusSource
+	upload   *util.RateLimiter
+	download *util.RateLimiter
+}
+
+func New(sources []StatusSource, upload, download *util.RateLimiter) *Server {
+	s := &Server{mux: http.NewServeMux(), sources: sources, upload: upload, download: download}
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("/limits", s.handleLimits)
+	return s
+}
+
+// Handle registers an extra handler on the server. Eg: /metrics
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		socketPath := strings.TrimPrefix(addr, unixPrefix)
+		// Remove the socket left behind by an earlier run.
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", socketPath)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// ListenAndServe blocks until the server fails.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("status server listening on %v", addr)
+	return http.Serve(listener, s.mux)
+}
+
+func rateOf(l *util.RateLimiter) int64 {
+	if l == nil {
+		return 0
+	}
+	return l.Rate()
+}
+
+func (s *Server) limits() Limits {
+	return Limits{UploadBytesPerSec: rateOf(s.upload), DownloadBytesPerSec: rateOf(s.download)}
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writeJson failed. err=%v", err)
+	}
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	resp := StatusResponse{Time: time.Now(), Limits: s.limits()}
+	for _, source := range s.sources {
+		resp.Pairs = append(resp.Pairs, source.Status())
+	}
+	writeJson(w, resp)
+}
+
+func (s *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if r.Header.Get(mutationHeader) == "" {
+			http.Error(w, fmt.Sprintf("POST needs the %v header", mutationHeader), http.StatusForbidden)
+			return
+		}
+		// Both values are checked before any is applied.
+		var changes []func()
+		for _, l := range []struct {
+			key     string
+			limiter *util.RateLimiter
+		}{{"upload", s.upload}, {"download", s.download}} {
+			key, limiter := l.key, l.limiter
+			value := r.URL.Query().Get(key)
+			if value == "" {
+				continue
+			} else if limiter == nil {
+				http.Error(w, fmt.Sprintf("%v: no limiter configured", key), http.StatusBadRequest)
+				return
+			} else if value == "default" {
+				changes = append(changes, func() {
+					log.Printf("Clearing the %v rate limit override", key)
+					limiter.ClearOverride()
+				})
+				continue
+			}
+			rate, err := util.ParseByteRate(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%v: %v", key, err), http.StatusBadRequest)
+				return
+			}
+			changes = append(changes, func() {
+				log.Printf("Overriding the %v rate limit with %v bytes/sec", key, rate)
+				limiter.SetOverride(rate)
+			})
+		}
+		for _, change := range changes {
+			change()
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, s.limits())
+}
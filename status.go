@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotslash/cloudsync/index"
+	"github.com/dotslash/cloudsync/server"
+	"os"
+	"time"
+)
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatAgo(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%v (%v ago)", t.Format(time.RFC3339), time.Since(t).Round(time.Second))
+}
+
+func printStatus(resp *server.StatusResponse) {
+	fmt.Printf("limits: upload=%v/s download=%v/s (0 is unlimited)\n",
+		formatBytes(resp.Limits.UploadBytesPerSec), formatBytes(resp.Limits.DownloadBytesPerSec))
+	for _, pair := range resp.Pairs {
+		fmt.Printf("\n%v (%v, %v)\n", pair.Name, pair.LocalPath, pair.Mode)
+		fmt.Printf("  phase:        %v since %v\n", pair.Phase, formatAgo(pair.PhaseSince))
+		fmt.Printf("  last run:     %v\n", formatAgo(pair.LastRunStart))
+		fmt.Printf("  last success: %v\n", formatAgo(pair.LastSuccess))
+		if !pair.NextRound.IsZero() {
+			fmt.Printf("  next round:   %v (in %v)\n", pair.NextRound.Format(time.RFC3339),
+				time.Until(pair.NextRound).Round(time.Second))
+		}
+		if pair.Index != nil {
+			fmt.Printf("  index:        %v paths (%v synced, %v pending, %v failed)\n", pair.Index.Entries,
+				pair.Index.States[index.StateSynced], pair.Index.States[index.StatePending], pair.Index.States[index.StateFailed])
+		}
+		if lease := pair.Lease; lease != nil {
+			switch {
+			case lease.Held:
+				fmt.Printf("  lease:        held until %v\n", lease.Info.Expires.Local().Format(time.RFC3339))
+			case lease.Info != nil:
+				fmt.Printf("  lease:        waiting, held by %v until %v\n", lease.Info.Holder,
+					lease.Info.Expires.Local().Format(time.RFC3339))
+			default:
+				fmt.Printf("  lease:        not held\n")
+			}
+			if lease.Error != "" {
+				fmt.Printf("                %v\n", lease.Error)
+			}
+		}
+		fmt.Printf("  pending:      %v actions\n", len(pair.PendingActions))
+		for _, a := range pair.PendingActions {
+			fmt.Printf("    %v\n", a)
+		}
+		for _, t := range pair.Transfers {
+			total := "?"
+			if t.TotalBytes >= 0 {
+				total = formatBytes(t.TotalBytes)
+			}
+			fmt.Printf("  %v %v: %v/%v\n", t.Direction, t.Path, formatBytes(t.Bytes), total)
+		}
+		if len(pair.Errors) != 0 {
+			fmt.Printf("  errors:\n")
+		}
+		for _, e := range pair.Errors {
+			fmt.Printf("    %v %v\n", e.Time.Format(time.RFC3339), e.Message)
+		}
+	}
+}
+
+// statusCommand queries a running daemon.
+func statusCommand(args []string) {
+	flags := newFlagSet("status")
+	addr := flags.String("addr", server.DefaultAddr, "Address of the daemon. Eg: 127.0.0.1:7321, unix:/tmp/cloudsync.sock")
+	asJson := flags.Bool("json", false, "Print the raw json")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		usageError(flags, "Unexpected arguments %v", flags.Args())
+	}
+	resp, err := server.NewClient(*addr).Status()
+	if err != nil {
+		fail("Could not get the status from %v: %v", *addr, err)
+	}
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(resp)
+		return
+	}
+	printStatus(resp)
+}
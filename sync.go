@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotslash/cloudsync/syncer"
+	"os"
+)
+
+// syncCommand runs one round of each pair and exits, with exitFailure if any
+// round failed.
+func syncCommand(args []string) {
+	flags := newFlagSet("sync")
+	sf := addSyncFlags(flags, true)
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		usageError(flags, "Unexpected arguments %v", flags.Args())
+	}
+	syncers, _, _ := sf.syncers(flags)
+	failed := false
+	for _, s := range syncers {
+		if err := s.SyncOnce(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", s.Status().Name, err)
+			failed = true
+		}
+		s.WaitHooks()
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// planCommand prints the actions a round of each pair would apply.
+func planCommand(args []string) {
+	flags := newFlagSet("plan")
+	sf := addSyncFlags(flags, true)
+	asJson := flags.Bool("json", false, "Print the actions as json, one per line")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		usageError(flags, "Unexpected arguments %v", flags.Args())
+	}
+	syncers, _, _ := sf.syncers(flags)
+	encoder := json.NewEncoder(os.Stdout)
+	failed := false
+	for _, s := range syncers {
+		name := s.Status().Name
+		changes, err := s.Plan()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", name, err)
+			failed = true
+			continue
+		}
+		if !*asJson {
+			fmt.Printf("%v: %v action(s)\n", name, len(changes))
+		}
+		for _, c := range changes {
+			if *asJson {
+				_ = encoder.Encode(struct {
+					Pair string `json:"pair"`
+					syncer.PlannedChange
+				}{name, c})
+			} else {
+				fmt.Printf("  %-6v %v\n", c.Side, c.Action)
+			}
+		}
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
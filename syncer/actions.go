@@ -1,28 +1,138 @@
 package syncer
 
 import (
-	"cloud.google.com/go/storage"
 	"fmt"
 	"github.com/dotslash/cloudsync/blob"
 	"github.com/dotslash/cloudsync/util"
+	"io"
 	"log"
 	"os"
 	"path"
+	"strings"
+	"time"
+)
+
+// actionSide is the side of the sync that an action modifies.
+type actionSide string
+
+const (
+	sideLocal  actionSide = "local"
+	sideRemote actionSide = "remote"
 )
 
 type action interface {
+	fmt.Stringer
 	do() error
+	side() actionSide
+	// Name of the action type. Used in metrics.
+	kind() string
+}
+
+// skippedError is returned by the actions that found the file changed since the
+// scan and did nothing. It is not a failure, but the path is not in sync either.
+type skippedError struct {
+	reason string
+}
+
+func (e *skippedError) Error() string {
+	return "skipped: " + e.reason
+}
+
+func isSkipped(err error) bool {
+	_, ok := err.(*skippedError)
+	return ok
 }
 
 type localRemove struct {
 	basePath         string
 	relativeFilePath util.RelPathType
+	// If not empty, the file is moved to <trashPath>/<time of removal>/ instead of being removed.
+	trashPath string
+	// Directories that have a marker on the remote. They are not pruned even if
+	// they become empty.
+	keepDirs map[util.RelPathType]bool
+}
+
+// checkParentInside makes sure that the directory fullPath is in resolves (through
+// all the symlinks on the way, Eg: a synced link d -> /etc for d/x) to inside
+// basePath, so that creating, writing, moving or removing fullPath stays there.
+func checkParentInside(basePath, fullPath string) error {
+	parent := path.Dir(strings.TrimSuffix(fullPath, "/"))
+	if !util.ResolvesInside(basePath, parent) {
+		return fmt.Errorf("%v resolves to outside %v", parent, basePath)
+	}
+	return nil
 }
 
 func (lr *localRemove) do() error {
 	fullPath := path.Join(lr.basePath, lr.relativeFilePath.String())
-	log.Printf("localRemove(%v): full path:%v", lr.relativeFilePath, fullPath)
-	return os.Remove(fullPath)
+	if err := checkParentInside(lr.basePath, fullPath); err != nil {
+		return fmt.Errorf("localRemove(%v): %v", lr.relativeFilePath, err)
+	}
+	if lr.relativeFilePath.IsDir() {
+		return lr.removeDir(fullPath)
+	}
+	if lr.trashPath != "" {
+		trashFullPath := path.Join(lr.trashPath, time.Now().UTC().Format(util.TrashTimeFormat), lr.relativeFilePath.String())
+		log.Printf("localRemove(%v): moving %v to trash %v", lr.relativeFilePath, fullPath, trashFullPath)
+		if err := util.MoveFile(fullPath, trashFullPath); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("localRemove(%v): full path:%v", lr.relativeFilePath, fullPath)
+		if err := os.Remove(fullPath); err != nil {
+			return err
+		}
+	}
+	pruneEmptyParents(lr.basePath, path.Dir(lr.relativeFilePath.String()), lr.keepDirs)
+	return nil
+}
+
+// removeDir removes an empty directory (there is nothing worth keeping in the
+// trash). If files showed up in it since the scan, it is left alone.
+func (lr *localRemove) removeDir(fullPath string) error {
+	entries, err := os.ReadDir(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if len(entries) != 0 {
+		log.Printf("localRemove(%v): %v is not empty anymore. Not removing it", lr.relativeFilePath, fullPath)
+		return &skippedError{reason: fullPath + " is not empty anymore"}
+	}
+	log.Printf("localRemove(%v): removing directory %v", lr.relativeFilePath, fullPath)
+	if err = os.Remove(fullPath); err != nil {
+		return err
+	}
+	pruneEmptyParents(lr.basePath, path.Dir(strings.TrimSuffix(lr.relativeFilePath.String(), "/")), lr.keepDirs)
+	return nil
+}
+
+// pruneEmptyParents removes relDir and its parents as long as they are empty, so
+// that removing the last file of a directory removes the directory too.
+// Directories in keepDirs are left alone.
+func pruneEmptyParents(basePath string, relDir string, keepDirs map[util.RelPathType]bool) {
+	for ; relDir != "." && relDir != "/" && relDir != ""; relDir = path.Dir(relDir) {
+		if keepDirs[util.RelPathType(relDir+"/")] {
+			return
+		}
+		fullPath := path.Join(basePath, relDir)
+		if entries, err := os.ReadDir(fullPath); err != nil || len(entries) != 0 {
+			return
+		} else if err = os.Remove(fullPath); err != nil {
+			log.Printf("pruneEmptyParents: could not prune %v - %v", fullPath, err)
+			return
+		}
+		log.Printf("pruneEmptyParents: pruned empty directory %v", fullPath)
+	}
+}
+
+func (lr *localRemove) kind() string {
+	return "localRemove"
+}
+
+func (lr *localRemove) side() actionSide {
+	return sideLocal
 }
 
 func (lr *localRemove) String() string {
@@ -31,7 +141,9 @@ func (lr *localRemove) String() string {
 
 type blobRemove struct {
 	relativeFilePath util.RelPathType
-	backend          blob.Backend
+	// Of the blob being removed, for the journal.
+	md5     string
+	backend blob.Backend
 }
 
 func (s *blobRemove) do() error {
@@ -39,6 +151,14 @@ func (s *blobRemove) do() error {
 	return s.backend.Delete(s.relativeFilePath)
 }
 
+func (br *blobRemove) kind() string {
+	return "blobRemove"
+}
+
+func (br *blobRemove) side() actionSide {
+	return sideRemote
+}
+
 func (br *blobRemove) String() string {
 	return fmt.Sprintf("blobRemove(%v)", br.relativeFilePath)
 }
@@ -49,6 +169,7 @@ type blobWrite struct {
 	backend       blob.Backend
 	localMeta     *util.LocalFileMeta
 	remoteMeta    *blob.MetaEntry
+	symlinks      util.SymlinkPolicy
 }
 
 func (bw *blobWrite) do() error {
@@ -59,20 +180,45 @@ func (bw *blobWrite) do() error {
 	}
 	localFullPath := path.Join(bw.localBasePath, bw.relativePath.String())
 	log.Printf("[%v] Writing from %v to remote:%v", ctxString, localFullPath, bw.relativePath)
-	file, err := os.Open(localFullPath)
-	if err != nil {
-		return fmt.Errorf("[%v] remoteToWrite: Open(%v %v) failed - %e", ctxString, localFullPath, bw.relativePath, err)
-	}
 	// If the blob already exists, preserve existing acls
-	var acls []storage.ACLRule
+	var opts blob.PutOptions
 	if bw.remoteMeta != nil {
-		acls = bw.remoteMeta.ACLs
+		opts.ACLs = bw.remoteMeta.ACLs
+	}
+	var content io.ReadCloser
+	if bw.relativePath.IsDir() {
+		content = io.NopCloser(strings.NewReader(""))
+	} else if info, err := os.Lstat(localFullPath); err == nil && info.Mode()&os.ModeSymlink != 0 && bw.symlinks == util.SymlinkLink {
+		target, err := os.Readlink(localFullPath)
+		if err != nil {
+			return fmt.Errorf("[%v] remoteToWrite: Readlink(%v) failed - %e", ctxString, localFullPath, err)
+		}
+		opts.SymlinkTarget = target
+		content = io.NopCloser(strings.NewReader(target))
+	} else if file, err := os.Open(localFullPath); err != nil {
+		return fmt.Errorf("[%v] remoteToWrite: Open(%v %v) failed - %e", ctxString, localFullPath, bw.relativePath, err)
+	} else {
+		content = file
+		// The md5 of the scan still holds if the file was not touched since.
+		if info, err := file.Stat(); err == nil && bw.localMeta != nil && info.Size() == bw.localMeta.Size &&
+			info.ModTime().Equal(bw.localMeta.ModTime) {
+			opts.Md5 = bw.localMeta.Md5sum
+		}
 	}
-	if err = bw.backend.Put(bw.relativePath, file, acls); err != nil {
+	if err := bw.backend.Put(bw.relativePath, content, opts); err != nil {
 		return fmt.Errorf("[%v] remoteToWrite: Put(%v) failed - %e", ctxString, bw.relativePath, err)
 	}
 	return nil
 }
+
+func (bw *blobWrite) kind() string {
+	return "blobWrite"
+}
+
+func (bw *blobWrite) side() actionSide {
+	return sideRemote
+}
+
 func (bw *blobWrite) String() string {
 	return fmt.Sprintf("blobWrite(%v)", bw.relativePath)
 }
@@ -82,34 +228,85 @@ type localWrite struct {
 	relativePath  util.RelPathType
 	backend       blob.Backend
 	blobInfo      *blob.MetaEntry
+	symlinks      util.SymlinkPolicy
+	// md5 of the local file when the write was planned. Empty if there was none.
+	// If the file changed since, it is not overwritten.
+	expectedLocalMd5 string
+}
+
+// checkNotThroughSymlink makes sure that writing to localFullPath does not write
+// to the target of a symlink the walker did not sync.
+func (lw *localWrite) checkNotThroughSymlink(localFullPath string) error {
+	info, err := os.Lstat(localFullPath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	} else if lw.symlinks != util.SymlinkFollow {
+		return fmt.Errorf("%v is a symlink, not writing through it with symlinks=%v", localFullPath, lw.symlinks)
+	} else if !util.ResolvesInside(lw.localBasePath, localFullPath) {
+		return fmt.Errorf("%v is a symlink to outside %v", localFullPath, lw.localBasePath)
+	}
+	return nil
+}
+
+func (lw *localWrite) writeSymlink(localFullPath string) error {
+	if info, err := os.Lstat(localFullPath); err == nil && !info.IsDir() {
+		if err = os.Remove(localFullPath); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(lw.blobInfo.SymlinkTarget, localFullPath)
 }
 
-// TODO: Dont do the write if the target file exists already and has a higher timestamp
 func (lw *localWrite) do() error {
 	localFullPath := path.Join(lw.localBasePath, lw.relativePath.String())
 	ctxString := fmt.Sprintf("localWrite(%v)", lw.relativePath)
 	log.Printf("[%v] Starting remote:%v to %v", ctxString, lw.relativePath, localFullPath)
+	if err := checkParentInside(lw.localBasePath, localFullPath); err != nil {
+		return fmt.Errorf("[%v] %v", ctxString, err)
+	}
+	if lw.relativePath.IsDir() {
+		if err := os.MkdirAll(localFullPath, 0755); err != nil {
+			return fmt.Errorf("[%v] MkdirAll(%v) failed - %e", ctxString, localFullPath, err)
+		}
+		return nil
+	}
 	// TODO: maybe handle error. Here i only care about the case where info is ready
-	info, err := util.GetLocalFileMeta(lw.localBasePath, lw.relativePath.String())
+	info, err := util.GetLocalFileMeta(lw.localBasePath, lw.relativePath.String(), lw.symlinks)
 	if err == nil && info.Md5sum == lw.blobInfo.Md5 {
 		// test
 		log.Printf("[%v] Local file's md5 sum is same. Skipping the localWrite", ctxString)
 		return nil
-	} else if err == nil && info.ModTime.After(lw.blobInfo.ModTime) {
-		log.Printf("[%v] Local file is modified after remote. Skipping the localWrite", ctxString)
-		return nil
+	} else if err == nil && info.Md5sum != lw.expectedLocalMd5 {
+		log.Printf("[%v] Local file changed since the scan. Skipping the localWrite", ctxString)
+		return &skippedError{reason: "the local file changed since the scan"}
 	} else if err := os.MkdirAll(path.Dir(localFullPath), 0755); err != nil {
 		return fmt.Errorf("[%v] MkdirAll(%v) failed - %e", ctxString, path.Dir(localFullPath), err)
-	} else if file, err := os.OpenFile(localFullPath, os.O_CREATE|os.O_RDWR, 0755); err != nil {
-		return fmt.Errorf("[%v] OpenFile(%v) failed - %e", ctxString, localFullPath, err)
+	} else if lw.blobInfo.SymlinkTarget != "" {
+		if err = lw.writeSymlink(localFullPath); err != nil {
+			return fmt.Errorf("[%v] writeSymlink(%v) failed - %e", ctxString, localFullPath, err)
+		}
+		return nil
+	} else if err = lw.checkNotThroughSymlink(localFullPath); err != nil {
+		return fmt.Errorf("[%v] %v", ctxString, err)
 	} else if blobEntry, err := lw.backend.Get(lw.relativePath); err != nil {
 		return fmt.Errorf("[%v] backend.Get(%v) failed - %e", ctxString, lw.relativePath, err)
+	} else if file, err := os.OpenFile(localFullPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0755); err != nil {
+		blobEntry.Content.Close()
+		return fmt.Errorf("[%v] OpenFile(%v) failed - %e", ctxString, localFullPath, err)
 	} else if err = util.CopyAndClose(file, blobEntry.Content); err != nil {
 		return fmt.Errorf("[%v] CopyAndClose(%v) failed - %e", ctxString, lw.relativePath, err)
 	}
 	return nil
 }
 
+func (lw *localWrite) kind() string {
+	return "localWrite"
+}
+
+func (lw *localWrite) side() actionSide {
+	return sideLocal
+}
+
 func (lw *localWrite) String() string {
 	return fmt.Sprintf("localWrite(%v)", lw.relativePath)
 }
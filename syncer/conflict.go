@@ -0,0 +1,82 @@
+package syncer
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/util"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// conflictPath is where the losing version of p is kept: "dir/name.conflict-<time>.ext".
+func conflictPath(p util.RelPathType, now time.Time) util.RelPathType {
+	dir, name := path.Split(p.String())
+	ext := path.Ext(name)
+	if ext == name {
+		// Dot files like ".bashrc" have no extension.
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	return util.RelPathType(dir + stem + ".conflict-" + now.UTC().Format("20060102T150405") + ext)
+}
+
+// conflictWrite keeps the losing version of a conflicting file aside (as a new
+// path that gets synced like any other file) before overwriting it with the
+// winning version.
+type conflictWrite struct {
+	path  util.RelPathType
+	aside action
+	write action
+}
+
+func (cw *conflictWrite) do() error {
+	log.Printf("%v: keeping the losing version aside", cw)
+	if err := cw.aside.do(); err != nil {
+		return fmt.Errorf("[%v] %v failed, not overwriting - %v", cw, cw.aside, err)
+	}
+	return cw.write.do()
+}
+
+func (cw *conflictWrite) kind() string {
+	return "conflictWrite"
+}
+
+func (cw *conflictWrite) side() actionSide {
+	return cw.write.side()
+}
+
+func (cw *conflictWrite) String() string {
+	return fmt.Sprintf("conflictWrite(%v: %v then %v)", cw.path, cw.aside, cw.write)
+}
+
+// resolveConflict is called when both sides modified the file differently. The
+// newer version wins.
+func (s *syncer) resolveConflict(de *diffFileEntry) action {
+	asidePath := conflictPath(de.fileName, time.Now())
+	if de.local.ModTime.After(de.remote.ModTime) {
+		log.Printf("[%v] conflict on %v: the local version is newer, keeping the remote one as %v",
+			s.name, de.fileName, asidePath)
+		return &conflictWrite{
+			path:  de.fileName,
+			aside: &blobCopy{from: de.fileName, to: asidePath, md5: de.remote.Md5, backend: s.backend},
+			write: de.blobWrite(s),
+		}
+	}
+	log.Printf("[%v] conflict on %v: the remote version is newer, keeping the local one as %v",
+		s.name, de.fileName, asidePath)
+	write := de.localWrite(s)
+	// The local file is moved aside before the write.
+	write.expectedLocalMd5 = ""
+	return &conflictWrite{
+		path: de.fileName,
+		aside: &localMove{
+			basePath: s.localBasePath,
+			from:     de.fileName,
+			to:       asidePath,
+			md5:      de.local.Md5sum,
+			keepDirs: s.remoteDirMarkers,
+		},
+		write: write,
+	}
+}
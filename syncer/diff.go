@@ -0,0 +1,281 @@
+package syncer
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/index"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"log"
+	"time"
+)
+
+// The diff is a merge join of three streams sorted by path: the local walk, the
+// remote listing and the last scan (from the index). Only the actions (and the
+// directory markers) are kept in memory, so the memory used does not grow with
+// the number of files.
+
+// plannedAction is an action with the diff entry it was planned from.
+type plannedAction struct {
+	action action
+	entry  *diffFileEntry
+}
+
+// remoteCursor is the current entry of the remote listing.
+type remoteCursor struct {
+	it   blob.MetaIterator
+	keep func(entry *blob.MetaEntry) bool
+	cur  *blob.MetaEntry
+	// Spent waiting for the listing.
+	elapsed time.Duration
+}
+
+func (c *remoteCursor) advance() error {
+	prev := c.cur
+	for {
+		start := time.Now()
+		next, err := c.it.Next()
+		c.elapsed += time.Since(start)
+		if err == blob.Done {
+			c.cur = nil
+			return nil
+		} else if err != nil {
+			return err
+		} else if prev != nil && next.RelPath <= prev.RelPath {
+			return fmt.Errorf("remote listing is not sorted: %v after %v", next.RelPath, prev.RelPath)
+		} else if c.keep(next) {
+			c.cur = next
+			return nil
+		}
+		prev = next
+	}
+}
+
+// recordCursor is the current entry of the last scan.
+type recordCursor struct {
+	it  *index.Iterator
+	cur *index.Entry
+}
+
+func (c *recordCursor) advance() error {
+	next, err := c.it.Next()
+	if err == io.EOF {
+		c.cur = nil
+		return nil
+	} else if err != nil {
+		return err
+	} else if c.cur != nil && next.Path <= c.cur.Path {
+		return fmt.Errorf("last scan is not sorted: %v after %v", next.Path, c.cur.Path)
+	}
+	c.cur = next
+	return nil
+}
+
+type merger struct {
+	s         *syncer
+	remote    *remoteCursor
+	last      *recordCursor
+	newScan   *index.ScanWriter
+	scanTime  time.Time
+	lastLocal util.RelPathType
+	planned   []plannedAction
+}
+
+// changeOf tells how a side changed from base (nil if there is none) to new (nil
+// if it is gone).
+func changeOf(base, new *string) changeType {
+	if base == nil && new == nil {
+		return changeTypeNone
+	} else if new == nil {
+		return changeTypeRem
+	} else if base == nil || *base != *new {
+		return changeTypeUpdated
+	}
+	return changeTypeNone
+}
+
+// emitUpTo diffs all the paths before local (all the remaining ones if local is
+// nil) and then local.
+func (m *merger) emitUpTo(local *util.LocalFileMeta) error {
+	if local != nil {
+		if m.lastLocal != "" && local.RelPath <= m.lastLocal {
+			return fmt.Errorf("local walk is not sorted: %v after %v", local.RelPath, m.lastLocal)
+		}
+		m.lastLocal = local.RelPath
+	}
+	for {
+		var next util.RelPathType
+		done := true
+		if m.remote.cur != nil {
+			next, done = m.remote.cur.RelPath, false
+		}
+		if m.last.cur != nil && (done || m.last.cur.Path < next) {
+			next, done = m.last.cur.Path, false
+		}
+		if done || (local != nil && next >= local.RelPath) {
+			break
+		}
+		if err := m.emit(next, nil); err != nil {
+			return err
+		}
+	}
+	if local == nil {
+		return nil
+	}
+	return m.emit(local.RelPath, local)
+}
+
+func (m *merger) emit(p util.RelPathType, local *util.LocalFileMeta) error {
+	var remote *blob.MetaEntry
+	var last index.Entry
+	if m.remote.cur != nil && m.remote.cur.RelPath == p {
+		remote = m.remote.cur
+		if err := m.remote.advance(); err != nil {
+			return err
+		}
+	}
+	if m.last.cur != nil && m.last.cur.Path == p {
+		last = *m.last.cur
+		if err := m.last.advance(); err != nil {
+			return err
+		}
+	}
+	if local != nil || remote != nil {
+		if err := m.newScan.Add(m.newEntry(p, local, remote, &last)); err != nil {
+			return err
+		}
+	}
+	if remote != nil && p.IsDir() {
+		m.s.remoteDirMarkers[p] = true
+	}
+
+	entry := &diffFileEntry{fileName: p, local: local, remote: remote, baseMd5: last.SyncedLocalMd5}
+	var base, localMd5, remoteMd5 *string
+	if last.SyncedLocalMd5 != "" {
+		base = &last.SyncedLocalMd5
+	}
+	if local != nil {
+		localMd5 = &local.Md5sum
+	}
+	entry.localChange = changeOf(base, localMd5)
+	base = nil
+	if last.SyncedRemoteMd5 != "" {
+		base = &last.SyncedRemoteMd5
+	}
+	if remote != nil {
+		remoteMd5 = &remote.Md5
+	}
+	entry.remoteChange = changeOf(base, remoteMd5)
+
+	if a := entry.getAction(m.s); a == nil {
+		return nil
+	} else if !m.s.mode.allows(a) {
+		log.Printf("[%v] Skipping %v in %v mode", m.s.name, a, m.s.mode)
+	} else {
+		m.planned = append(m.planned, plannedAction{action: a, entry: entry})
+	}
+	return nil
+}
+
+// newEntry is the index entry of a path in the new scan. The sync state is
+// carried over from the last scan.
+func (m *merger) newEntry(p util.RelPathType, local *util.LocalFileMeta, remote *blob.MetaEntry, last *index.Entry) index.Entry {
+	e := index.Entry{
+		Path:            p,
+		Local:           local,
+		Remote:          remote,
+		State:           index.StatePending,
+		SyncedLocalMd5:  last.SyncedLocalMd5,
+		SyncedRemoteMd5: last.SyncedRemoteMd5,
+		SyncedAt:        last.SyncedAt,
+		ScannedAt:       m.scanTime,
+	}
+	if local != nil && remote != nil && local.Md5sum == remote.Md5 {
+		e.State = index.StateSynced
+		if e.SyncedLocalMd5 != local.Md5sum || e.SyncedRemoteMd5 != remote.Md5 {
+			e.SyncedLocalMd5, e.SyncedRemoteMd5, e.SyncedAt = local.Md5sum, remote.Md5, m.scanTime
+		}
+	}
+	return e
+}
+
+// keepRemote filters the remote entries the syncer does not sync.
+func (s *syncer) keepRemote(entry *blob.MetaEntry) bool {
+	if entry.RelPath == "" {
+		// The base path itself, Eg: a folder placeholder made in the console.
+		return false
+	}
+	if s.excludes.Excluded(entry.RelPath, entry.RelPath.IsDir()) || !s.selection.Selected(entry.RelPath) {
+		return false
+	}
+	// Links can only be materialized with SymlinkLink.
+	return entry.SymlinkTarget == "" || s.symlinks == util.SymlinkLink
+}
+
+// skipLocal skips the local paths outside the selection, and the directories
+// without selected paths in them.
+func (s *syncer) skipLocal(relPath util.RelPathType, isDir bool) bool {
+	if isDir {
+		return !s.selection.relevantDir(relPath.String())
+	}
+	return !s.selection.Selected(relPath)
+}
+
+// scanAndDiff lists the local and remote files, diffs them against the last scan
+// in ix and writes the new scan to newScan. Paths outside the selection are
+// neither listed nor diffed, so the entries of the last scan for them are
+// dropped without any action.
+func (s *syncer) scanAndDiff(ix *index.Index, newScan *index.ScanWriter, remote blob.MetaIterator) ([]plannedAction, error) {
+	selection, err := s.currentSelection()
+	if err != nil {
+		return nil, err
+	}
+	s.selection = selection
+	m := &merger{
+		s:        s,
+		remote:   &remoteCursor{it: remote, keep: s.keepRemote},
+		last:     &recordCursor{it: ix.Entries("")},
+		newScan:  newScan,
+		scanTime: time.Now(),
+	}
+	s.remoteDirMarkers = make(map[util.RelPathType]bool)
+	if err := m.remote.advance(); err != nil {
+		return nil, err
+	} else if err = m.last.advance(); err != nil {
+		return nil, err
+	}
+	// The walk and the listing are interleaved. The time of the walk is what is
+	// not spent in its callback, which merges and waits for the listing.
+	walkStart, inCallback := time.Now(), time.Duration(0)
+	err = util.WalkFilesRec(s.localBasePath, util.WalkOptions{
+		Excludes: s.excludes,
+		Symlinks: s.symlinks,
+		Skip:     s.skipLocal,
+	}, func(meta util.LocalFileMeta) error {
+		if !s.selection.Selected(meta.RelPath) {
+			// The marker of an empty parent of a selected path.
+			return nil
+		}
+		start := time.Now()
+		defer func() { inCallback += time.Since(start) }()
+		return m.emitUpTo(&meta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	walked := time.Since(walkStart) - inCallback
+	if err = m.emitUpTo(nil); err != nil {
+		return nil, err
+	}
+	scanSeconds.Observe(walked.Seconds(), s.name, "local")
+	scanSeconds.Observe(m.remote.elapsed.Seconds(), s.name, "remote")
+	return m.planned, newScan.Flush()
+}
+
+func (s *syncer) getActions(ix *index.Index, newScan *index.ScanWriter, remote blob.MetaIterator) ([]action, error) {
+	planned, err := s.scanAndDiff(ix, newScan, remote)
+	if err != nil {
+		return nil, err
+	}
+	return s.detectMoves(planned, newScan), nil
+}
@@ -0,0 +1,194 @@
+package syncer
+
+import (
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/index"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteFeed tells which remote paths changed, so that a round only has to get
+// their metadata instead of listing the whole remote. See the feed package.
+type RemoteFeed interface {
+	// Changes returns the paths (sorted, without duplicates) that changed since
+	// the last call.
+	Changes() ([]util.RelPathType, error)
+}
+
+const defaultReconcileInterval = time.Hour
+
+// touchRecorder remembers the blobs the syncer wrote, so that the next round
+// does not depend on the notifications of its own changes arriving in time.
+type touchRecorder struct {
+	blob.Backend
+	mu      sync.Mutex
+	touched map[util.RelPathType]bool
+}
+
+func (t *touchRecorder) touch(names ...util.RelPathType) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, name := range names {
+		t.touched[name] = true
+	}
+}
+
+// drain returns the blobs written since the last call.
+func (t *touchRecorder) drain() map[util.RelPathType]bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := t.touched
+	t.touched = make(map[util.RelPathType]bool)
+	return ret
+}
+
+func (t *touchRecorder) Put(name util.RelPathType, reader io.ReadCloser, opts blob.PutOptions) error {
+	t.touch(name)
+	return t.Backend.Put(name, reader, opts)
+}
+
+func (t *touchRecorder) Delete(name util.RelPathType) error {
+	t.touch(name)
+	return t.Backend.Delete(name)
+}
+
+func (t *touchRecorder) Copy(from, to util.RelPathType) error {
+	t.touch(to)
+	return t.Backend.Copy(from, to)
+}
+
+func (t *touchRecorder) Move(from, to util.RelPathType) error {
+	t.touch(from, to)
+	return t.Backend.Move(from, to)
+}
+
+// patchedListing is the remote listing of the last scan with the metadata of the
+// changed paths swapped in. Like a listing, it is sorted by path.
+type patchedListing struct {
+	last    *index.Iterator
+	lastCur *index.Entry
+	changed []util.RelPathType
+	// nil for the changed paths that have no blob anymore.
+	metas map[util.RelPathType]*blob.MetaEntry
+}
+
+func (pl *patchedListing) Next() (*blob.MetaEntry, error) {
+	for {
+		if pl.lastCur == nil && pl.last != nil {
+			next, err := pl.last.Next()
+			if err == io.EOF {
+				pl.last = nil
+			} else if err != nil {
+				return nil, err
+			}
+			pl.lastCur = next
+		}
+		if len(pl.changed) != 0 && (pl.lastCur == nil || pl.changed[0] <= pl.lastCur.Path) {
+			p := pl.changed[0]
+			pl.changed = pl.changed[1:]
+			if pl.lastCur != nil && pl.lastCur.Path == p {
+				pl.lastCur = nil
+			}
+			if meta := pl.metas[p]; meta != nil {
+				return meta, nil
+			}
+			continue
+		}
+		if pl.lastCur == nil {
+			return nil, blob.Done
+		}
+		cur := pl.lastCur
+		pl.lastCur = nil
+		if cur.Remote != nil {
+			return cur.Remote, nil
+		}
+	}
+}
+
+// selectionKey identifies a selection, to notice when it changed.
+func selectionKey(sel *Selection) string {
+	if sel == nil {
+		return "*"
+	}
+	return strings.Join(sel.Paths(), "\n")
+}
+
+// remoteListing returns the remote entries of a round. Without a feed it is the
+// full listing. With one, only the paths changed since the last round are looked
+// at, except for the first round, after a failed round, when the selection
+// changed or when the last full listing is older than the reconcile interval.
+func (s *syncer) remoteListing(ix *index.Index) (blob.MetaIterator, error) {
+	if s.feed == nil {
+		return s.backend.List(""), nil
+	}
+	changes, err := s.feed.Changes()
+	touched := s.touched.drain()
+	selection, selErr := s.currentSelection()
+	if selErr != nil {
+		return nil, selErr
+	}
+	full := ""
+	if err != nil {
+		full = "the feed failed: " + err.Error()
+	} else if s.lastFullListing.IsZero() {
+		full = "first round"
+	} else if s.needFullListing {
+		full = "the last round failed"
+	} else if selectionKey(selection) != s.listedSelection {
+		full = "the selection changed"
+	} else if time.Since(s.lastFullListing) >= s.reconcileInterval {
+		full = "reconciling"
+	}
+	if full != "" {
+		log.Printf("[%v] listing the whole remote: %v", s.name, full)
+		s.fullListing = true
+		return s.backend.List(""), nil
+	}
+	for p := range touched {
+		changes = append(changes, p)
+	}
+	changes = sortedUnique(changes)
+	metas := make(map[util.RelPathType]*blob.MetaEntry, len(changes))
+	for _, p := range changes {
+		meta, err := s.backend.GetMeta(p)
+		if err == blob.ErrNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		metas[p] = meta
+	}
+	log.Printf("[%v] %v remote change(s) from the feed", s.name, len(changes))
+	s.fullListing = false
+	return &patchedListing{last: ix.Entries(""), changed: changes, metas: metas}, nil
+}
+
+func sortedUnique(paths []util.RelPathType) []util.RelPathType {
+	seen := make(map[util.RelPathType]bool, len(paths))
+	ret := make([]util.RelPathType, 0, len(paths))
+	for _, p := range paths {
+		if !seen[p] {
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// listingDone records the outcome of a round for remoteListing.
+func (s *syncer) listingDone(err error) {
+	if s.feed == nil {
+		return
+	}
+	s.needFullListing = err != nil
+	if err == nil && s.fullListing {
+		s.lastFullListing = time.Now()
+		s.listedSelection = selectionKey(s.selection)
+	}
+}
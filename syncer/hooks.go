@@ -0,0 +1,99 @@
+package syncer
+
+import (
+	"github.com/dotslash/cloudsync/util"
+	"time"
+)
+
+// Kinds of HookEvent.
+const (
+	HookPreSync  = "pre-sync"
+	HookPostSync = "post-sync"
+	HookAction   = "action"
+)
+
+// HookEvent is what a Hook is told about, as json.
+type HookEvent struct {
+	Event string    `json:"event"`
+	Pair  string    `json:"pair"`
+	Time  time.Time `json:"time"`
+	// Of HookAction. For moves and copies, Path is the destination. For conflict
+	// writes, Aside is where the losing version was kept.
+	Path      util.RelPathType `json:"path,omitempty"`
+	From      util.RelPathType `json:"from,omitempty"`
+	Aside     util.RelPathType `json:"aside,omitempty"`
+	Action    string           `json:"action,omitempty"`
+	Direction string           `json:"direction,omitempty"` // upload, download or delete
+	// Of HookPostSync.
+	Actions  int    `json:"actions,omitempty"`
+	Failures int    `json:"failures,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Hook runs the commands or webhooks configured for the events of a syncer. See
+// the hooks package. Its failures are its own: they never fail a round.
+type Hook interface {
+	// Fire blocks for HookPreSync, so that the hook can prepare the files before
+	// the scan. The other events are handed off.
+	Fire(event HookEvent)
+	// Wait blocks until the events handed off are done.
+	Wait()
+}
+
+// actionPaths returns the path an action writes or removes, and the path it
+// moved or copied from.
+func actionPaths(a action) (p, from util.RelPathType) {
+	switch a := a.(type) {
+	case *blobWrite:
+		return a.relativePath, ""
+	case *localWrite:
+		return a.relativePath, ""
+	case *blobRemove:
+		return a.relativeFilePath, ""
+	case *localRemove:
+		return a.relativeFilePath, ""
+	case *blobMove:
+		return a.to, a.from
+	case *localMove:
+		return a.to, a.from
+	case *blobCopy:
+		return a.to, a.from
+	case *conflictWrite:
+		return a.path, ""
+	}
+	return "", ""
+}
+
+func (s *syncer) fireHook(event HookEvent) {
+	if s.hook == nil {
+		return
+	}
+	event.Pair, event.Time = s.name, time.Now()
+	s.hook.Fire(event)
+}
+
+func (s *syncer) fireActionHook(a action) {
+	if s.hook == nil {
+		return
+	}
+	event := HookEvent{Event: HookAction, Action: a.kind(), Direction: "upload"}
+	event.Path, event.From = actionPaths(a)
+	if a.side() == sideLocal {
+		event.Direction = "download"
+	}
+	switch a := a.(type) {
+	case *blobRemove, *localRemove:
+		event.Direction = "delete"
+	case *conflictWrite:
+		event.Aside, _ = actionPaths(a.aside)
+	}
+	s.fireHook(event)
+}
+
+// WaitHooks blocks until the hook is done with the events of the rounds so far,
+// for when the process is about to exit.
+func (s *syncer) WaitHooks() {
+	if s.hook != nil {
+		s.hook.Wait()
+	}
+}
@@ -0,0 +1,70 @@
+package syncer
+
+import (
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	"log"
+	"time"
+)
+
+// Past this many queued entries (when appending keeps failing), the oldest ones
+// are dropped.
+const maxJournalQueue = 10000
+
+// journalEntries returns what an action that was done changed on the remote.
+// Directory markers are left out.
+func journalEntries(a action, now time.Time) []blob.JournalEntry {
+	var ret []blob.JournalEntry
+	add := func(op string, p, from util.RelPathType, md5 string, size int64) {
+		if !p.IsDir() {
+			ret = append(ret, blob.JournalEntry{Time: now, Op: op, Path: p, From: from, Md5: md5, Size: size})
+		}
+	}
+	switch a := a.(type) {
+	case *blobWrite:
+		if a.localMeta != nil {
+			add(blob.JournalUpload, a.relativePath, "", a.localMeta.Md5sum, a.localMeta.Size)
+		} else {
+			add(blob.JournalUpload, a.relativePath, "", "", 0)
+		}
+	case *blobRemove:
+		add(blob.JournalDelete, a.relativeFilePath, "", a.md5, 0)
+	case *blobMove:
+		add(blob.JournalMove, a.to, a.from, a.md5, 0)
+	case *blobCopy:
+		add(blob.JournalCopy, a.to, a.from, a.md5, 0)
+	case *conflictWrite:
+		ret = append(journalEntries(a.aside, now), journalEntries(a.write, now)...)
+	}
+	return ret
+}
+
+// journalAction queues the remote operations of an action that was just done
+// for flushJournal.
+func (s *syncer) journalAction(a action) {
+	if s.journal == nil {
+		return
+	}
+	for _, e := range journalEntries(a, time.Now()) {
+		e.Machine, e.Pair = util.UniqueMachineId, s.name
+		s.journalQueue = append(s.journalQueue, e)
+	}
+	if dropped := len(s.journalQueue) - maxJournalQueue; dropped > 0 {
+		log.Printf("[%v] the journal is not being written, dropping its %v oldest entries", s.name, dropped)
+		s.journalQueue = append(s.journalQueue[:0], s.journalQueue[dropped:]...)
+	}
+}
+
+// flushJournal appends the queued entries to the journal of this machine.
+// Failing to do so does not fail the round, the entries are kept for the next one.
+func (s *syncer) flushJournal() {
+	if s.journal == nil || len(s.journalQueue) == 0 {
+		return
+	}
+	if err := s.journal.AppendJournal(s.journalQueue); err != nil {
+		log.Printf("[%v] appending %v entries to the journal failed. err=%v", s.name, len(s.journalQueue), err)
+		s.status.recordError(err)
+		return
+	}
+	s.journalQueue = nil
+}
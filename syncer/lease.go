@@ -0,0 +1,140 @@
+package syncer
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultLeaseTTL = 2 * time.Minute
+
+// LeaseStatus is the lease of the remote as a syncer last saw it.
+type LeaseStatus struct {
+	// Whether this syncer holds it right now.
+	Held bool `json:"held"`
+	// The last known holder. Nil if there was no lease.
+	Info  *blob.LeaseInfo `json:"info,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// leaseKeeper holds the lease of the remote for a round: it is acquired before
+// the scan, renewed while the actions are applied and released at the end, so
+// that no other machine decides on a view this round is changing.
+type leaseKeeper struct {
+	leaser blob.Leaser
+	ttl    time.Duration
+	status *statusTracker
+
+	mu sync.Mutex
+	// Of the last successful acquire or renew. Nil when not held.
+	info *blob.LeaseInfo
+	// When it expires by the clock of this machine: ttl after the last successful
+	// acquire or renew was sent, which is before the server wrote it.
+	expires time.Time
+	// Of the last renew.
+	err  error
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (k *leaseKeeper) setStatus(held bool, info *blob.LeaseInfo, err error) {
+	ls := &LeaseStatus{Held: held, Info: info}
+	if err != nil {
+		ls.Error = err.Error()
+	}
+	k.status.setLease(ls)
+}
+
+// acquire takes the lease and keeps renewing it until release.
+func (k *leaseKeeper) acquire() error {
+	sent := time.Now()
+	info, err := k.leaser.AcquireLease(k.ttl)
+	if err != nil {
+		if held, ok := err.(*blob.LeaseHeldError); ok {
+			k.setStatus(false, &held.Info, nil)
+		} else {
+			k.setStatus(false, nil, err)
+		}
+		return err
+	}
+	k.mu.Lock()
+	k.info, k.expires, k.err = info, sent.Add(k.ttl), nil
+	k.stop, k.done = make(chan struct{}), make(chan struct{})
+	k.mu.Unlock()
+	k.setStatus(true, info, nil)
+	go k.renew(k.stop, k.done)
+	return nil
+}
+
+func (k *leaseKeeper) renew(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(k.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		sent := time.Now()
+		info, err := k.leaser.AcquireLease(k.ttl)
+		k.mu.Lock()
+		if err == nil {
+			k.info, k.expires = info, sent.Add(k.ttl)
+		} else {
+			log.Printf("renewing the lease failed. err=%v", err)
+			k.err = err
+		}
+		info = k.info
+		k.mu.Unlock()
+		k.setStatus(err == nil, info, err)
+	}
+}
+
+// check returns an error unless the lease is held and did not expire.
+func (k *leaseKeeper) check() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.info == nil {
+		return fmt.Errorf("the lease is not held")
+	} else if !time.Now().Before(k.expires) {
+		if k.err != nil {
+			return fmt.Errorf("the lease expired at %v, renewing it failed - %v",
+				k.expires.Format(time.RFC3339), k.err)
+		}
+		return fmt.Errorf("the lease expired at %v", k.expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (k *leaseKeeper) release() {
+	k.mu.Lock()
+	stop, done := k.stop, k.done
+	k.info, k.stop, k.done = nil, nil, nil
+	k.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+	err := k.leaser.ReleaseLease()
+	if err != nil {
+		log.Printf("releasing the lease failed. err=%v", err)
+	}
+	k.setStatus(false, nil, err)
+}
+
+// HoldLease acquires the lease for a command that changes the remote outside of
+// a round and keeps renewing it until release is called.
+func HoldLease(leaser blob.Leaser, ttl time.Duration) (release func(), err error) {
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	k := &leaseKeeper{leaser: leaser, ttl: ttl, status: newStatusTracker("", "", "")}
+	if err = k.acquire(); err != nil {
+		return nil, err
+	}
+	return k.release, nil
+}
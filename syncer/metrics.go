@@ -0,0 +1,21 @@
+package syncer
+
+import (
+	"github.com/dotslash/cloudsync/metrics"
+)
+
+var (
+	scanSeconds = metrics.Default.NewHistogramVec("cloudsync_scan_duration_seconds",
+		"Time spent walking the local files (scan=local) and listing the remote (scan=remote) in a scan.",
+		nil, "pair", "scan")
+	actionsTotal = metrics.Default.NewCounterVec("cloudsync_actions_total",
+		"Actions applied, by type.", "pair", "action")
+	actionFailuresTotal = metrics.Default.NewCounterVec("cloudsync_action_failures_total",
+		"Actions that failed, by type.", "pair", "action")
+	syncRoundsTotal = metrics.Default.NewCounterVec("cloudsync_sync_rounds_total",
+		"Completed syncCore rounds.", "pair", "result")
+	lastSuccessTimestamp = metrics.Default.NewGaugeVec("cloudsync_last_success_timestamp_seconds",
+		"Unix time of the last successful syncCore round.", "pair")
+	secondsSinceLastSuccess = metrics.Default.NewGaugeVec("cloudsync_seconds_since_last_success",
+		"Seconds since the last successful syncCore round (or since start if there was none).", "pair")
+)
@@ -0,0 +1,245 @@
+package syncer
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/index"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"log"
+	"os"
+	"path"
+)
+
+// blobMove renames a blob on the remote (without downloading it) because the
+// file got renamed locally.
+type blobMove struct {
+	from    util.RelPathType
+	to      util.RelPathType
+	md5     string
+	backend blob.Backend
+}
+
+func (bm *blobMove) do() error {
+	log.Printf("%v: Moving remote:%v to remote:%v", bm, bm.from, bm.to)
+	return bm.backend.Move(bm.from, bm.to)
+}
+
+func (bm *blobMove) kind() string {
+	return "blobMove"
+}
+
+func (bm *blobMove) side() actionSide {
+	return sideRemote
+}
+
+func (bm *blobMove) String() string {
+	return fmt.Sprintf("blobMove(%v -> %v)", bm.from, bm.to)
+}
+
+// blobCopy writes a blob by copying another blob with the same content on the
+// remote, because the file got copied locally.
+type blobCopy struct {
+	from    util.RelPathType
+	to      util.RelPathType
+	md5     string
+	backend blob.Backend
+}
+
+func (bc *blobCopy) do() error {
+	// The source could have changed since the scan. Then it is not worth copying.
+	if meta, err := bc.backend.GetMeta(bc.from); err != nil {
+		return fmt.Errorf("[%v] GetMeta(%v) failed - %v", bc, bc.from, err)
+	} else if meta.Md5 != bc.md5 {
+		return fmt.Errorf("[%v] remote:%v changed since the scan", bc, bc.from)
+	}
+	log.Printf("%v: Copying remote:%v to remote:%v", bc, bc.from, bc.to)
+	return bc.backend.Copy(bc.from, bc.to)
+}
+
+func (bc *blobCopy) kind() string {
+	return "blobCopy"
+}
+
+func (bc *blobCopy) side() actionSide {
+	return sideRemote
+}
+
+func (bc *blobCopy) String() string {
+	return fmt.Sprintf("blobCopy(%v -> %v)", bc.from, bc.to)
+}
+
+// localMove renames a local file because the blob got renamed on the remote.
+type localMove struct {
+	basePath string
+	from     util.RelPathType
+	to       util.RelPathType
+	md5      string
+	keepDirs map[util.RelPathType]bool
+}
+
+func (lm *localMove) do() error {
+	fromFullPath := path.Join(lm.basePath, lm.from.String())
+	toFullPath := path.Join(lm.basePath, lm.to.String())
+	log.Printf("%v: Moving %v to %v", lm, fromFullPath, toFullPath)
+	if err := checkParentInside(lm.basePath, fromFullPath); err != nil {
+		return fmt.Errorf("[%v] %v", lm, err)
+	} else if err = checkParentInside(lm.basePath, toFullPath); err != nil {
+		return fmt.Errorf("[%v] %v", lm, err)
+	}
+	if _, err := os.Lstat(toFullPath); err == nil {
+		return fmt.Errorf("[%v] %v already exists", lm, toFullPath)
+	} else if err = os.MkdirAll(path.Dir(toFullPath), 0755); err != nil {
+		return fmt.Errorf("[%v] MkdirAll(%v) failed - %v", lm, path.Dir(toFullPath), err)
+	} else if err = os.Rename(fromFullPath, toFullPath); err != nil {
+		return fmt.Errorf("[%v] Rename failed - %v", lm, err)
+	}
+	pruneEmptyParents(lm.basePath, path.Dir(lm.from.String()), lm.keepDirs)
+	return nil
+}
+
+func (lm *localMove) kind() string {
+	return "localMove"
+}
+
+func (lm *localMove) side() actionSide {
+	return sideLocal
+}
+
+func (lm *localMove) String() string {
+	return fmt.Sprintf("localMove(%v -> %v)", lm.from, lm.to)
+}
+
+func contentKey(md5 string, size int64) string {
+	return fmt.Sprintf("%v:%v", md5, size)
+}
+
+// detectMoves replaces a remove of one path and a write of another path with the
+// same content (same md5 and size) by a move. So a rename on one side costs no
+// bandwidth on the other side. Uploads of content that is already on the remote
+// (in a blob no action touches) become server side copies.
+func (s *syncer) detectMoves(planned []plannedAction, newScan *index.ScanWriter) []action {
+	// content key => indices of the remove actions with that content
+	blobRemoves := make(map[string][]int)
+	localRemoves := make(map[string][]int)
+	touched := make(map[util.RelPathType]bool)
+	for i, p := range planned {
+		switch a := p.action.(type) {
+		case *blobRemove:
+			touched[a.relativeFilePath] = true
+			if meta := p.entry.remote; meta != nil && !a.relativeFilePath.IsDir() {
+				key := contentKey(meta.Md5, meta.Size)
+				blobRemoves[key] = append(blobRemoves[key], i)
+			}
+		case *localRemove:
+			if meta := p.entry.local; meta != nil && !a.relativeFilePath.IsDir() {
+				key := contentKey(meta.Md5sum, meta.Size)
+				localRemoves[key] = append(localRemoves[key], i)
+			}
+		case *blobWrite:
+			touched[a.relativePath] = true
+		case *conflictWrite:
+			touched[a.path] = true
+		}
+	}
+
+	// popRemove returns the index of a remove action with the given content or -1.
+	popRemove := func(removes map[string][]int, key string) int {
+		indices := removes[key]
+		if len(indices) == 0 {
+			return -1
+		}
+		removes[key] = indices[1:]
+		return indices[0]
+	}
+	replaced := make(map[int]bool)
+	var moves []action
+	// content key => indices of the uploads that could be copies
+	uploads := make(map[string][]int)
+	for i, p := range planned {
+		switch a := p.action.(type) {
+		case *blobWrite:
+			localMeta := p.entry.local
+			if localMeta == nil || p.entry.remote != nil || a.relativePath.IsDir() {
+				continue
+			}
+			key := contentKey(localMeta.Md5sum, localMeta.Size)
+			if j := popRemove(blobRemoves, key); j >= 0 {
+				from := planned[j].action.(*blobRemove).relativeFilePath
+				replaced[i], replaced[j] = true, true
+				moves = append(moves, &blobMove{from: from, to: a.relativePath, md5: localMeta.Md5sum, backend: s.backend})
+			} else if localMeta.SymlinkTarget == "" && localMeta.Size != 0 {
+				uploads[key] = append(uploads[key], i)
+			}
+		case *localWrite:
+			if p.entry.local != nil || a.relativePath.IsDir() {
+				continue
+			}
+			if j := popRemove(localRemoves, contentKey(a.blobInfo.Md5, a.blobInfo.Size)); j >= 0 {
+				from := planned[j].action.(*localRemove).relativeFilePath
+				replaced[i], replaced[j] = true, true
+				moves = append(moves, &localMove{
+					basePath: s.localBasePath,
+					from:     from,
+					to:       a.relativePath,
+					md5:      a.blobInfo.Md5,
+					keepDirs: s.remoteDirMarkers,
+				})
+			}
+		}
+	}
+	if len(uploads) != 0 {
+		sources, err := findCopySources(newScan, uploads, touched)
+		if err != nil {
+			log.Printf("[%v] looking for copy sources failed, uploading instead. err=%v", s.name, err)
+		}
+		for key, indices := range uploads {
+			from, ok := sources[key]
+			for _, i := range indices {
+				if !ok {
+					break
+				}
+				to := planned[i].action.(*blobWrite).relativePath
+				replaced[i] = true
+				moves = append(moves, &blobCopy{from: from, to: to, md5: planned[i].entry.local.Md5sum, backend: s.backend})
+			}
+		}
+	}
+
+	ret := make([]action, 0, len(planned)-len(replaced)+len(moves))
+	for i, p := range planned {
+		if !replaced[i] {
+			ret = append(ret, p.action)
+		}
+	}
+	for _, m := range moves {
+		log.Printf("[%v] detected a rename or copy: %v", s.name, m)
+	}
+	return append(ret, moves...)
+}
+
+// findCopySources goes over the new scan and returns, for the content keys in
+// wanted, the first remote blob with that content that no action touches.
+func findCopySources(newScan *index.ScanWriter, wanted map[string][]int, touched map[util.RelPathType]bool) (map[string]util.RelPathType, error) {
+	it := newScan.Entries()
+	ret := make(map[string]util.RelPathType)
+	for len(ret) < len(wanted) {
+		rec, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ret, err
+		}
+		meta := rec.Remote
+		if meta == nil || touched[rec.Path] || rec.Path.IsDir() || meta.SymlinkTarget != "" {
+			continue
+		}
+		key := contentKey(meta.Md5, meta.Size)
+		if _, ok := wanted[key]; ok {
+			if _, found := ret[key]; !found {
+				ret[key] = rec.Path
+			}
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,27 @@
+package syncer
+
+import (
+	"log"
+	"time"
+)
+
+// Pruner removes the old versions and trash entries of a pair that its retention
+// rules do not keep. See the retention package.
+type Pruner interface {
+	Prune() error
+}
+
+// maybePrune runs the pruner if the last prune was at least pruneInterval ago.
+// The daemon calls it between rounds, outside of the quiet hours.
+func (s *syncer) maybePrune() {
+	if s.pruner == nil || s.pruneInterval <= 0 || time.Since(s.lastPrune) < s.pruneInterval {
+		return
+	}
+	s.status.setPhase(PhasePruning)
+	if err := s.pruner.Prune(); err != nil {
+		log.Printf("[%v] pruning failed. err=%v", s.name, err)
+		s.status.recordError(err)
+	}
+	// A failed prune is retried after the interval too, it is not urgent.
+	s.lastPrune = time.Now()
+}
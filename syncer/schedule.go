@@ -0,0 +1,163 @@
+package syncer
+
+import (
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/index"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"log"
+	"time"
+)
+
+const defaultMaxSyncInterval = 10 * time.Minute
+
+// schedule decides how long Start waits between rounds. A round with actions
+// brings the interval down to min. Idle and failed rounds double it, rate limits
+// quadruple it, up to max.
+type schedule struct {
+	min        time.Duration
+	max        time.Duration
+	quietHours []util.TimeWindow
+	current    time.Duration
+}
+
+func newSchedule(min, max time.Duration, quietHours []util.TimeWindow) *schedule {
+	if min <= 0 {
+		min = defaultSyncInterval
+	}
+	if max <= 0 {
+		max = defaultMaxSyncInterval
+	}
+	if max < min {
+		max = min
+	}
+	return &schedule{min: min, max: max, quietHours: quietHours, current: min}
+}
+
+func (sc *schedule) grow(factor time.Duration) {
+	sc.current *= factor
+	if sc.current > sc.max {
+		sc.current = sc.max
+	}
+}
+
+// roundDone adjusts the interval to the outcome of a round and returns it.
+func (sc *schedule) roundDone(actions int, err error, rateLimited bool) time.Duration {
+	switch {
+	case rateLimited:
+		sc.grow(4)
+	case err != nil:
+		sc.grow(2)
+	case actions > 0:
+		sc.current = sc.min
+	default:
+		sc.grow(2)
+	}
+	return sc.current
+}
+
+// quietUntil returns when the quiet hours that t is in end, and false if t is
+// not in quiet hours. Adjacent or overlapping windows count as one.
+func (sc *schedule) quietUntil(t time.Time) (time.Time, bool) {
+	quiet := false
+	// Each window can extend the end at most once.
+	for range sc.quietHours {
+		extended := false
+		for _, w := range sc.quietHours {
+			if w.Contains(t) {
+				t = w.EndAfter(t)
+				quiet, extended = true, true
+			}
+		}
+		if !extended {
+			break
+		}
+	}
+	return t, quiet
+}
+
+// anyRateLimited tells whether an action of a round failed because of rate
+// limits.
+func anyRateLimited(errs map[action]error) bool {
+	for _, err := range errs {
+		if blob.IsRateLimited(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledRound runs the round Start is due for and returns how long to wait
+// for the next one. During quiet hours the remote is left alone: the local files
+// are only scanned, and what a round would do about them is shown as pending.
+func (s *syncer) scheduledRound() time.Duration {
+	now := time.Now()
+	if quietEnd, quiet := s.schedule.quietUntil(now); quiet {
+		s.status.setPhase(PhaseQuiet)
+		actions, err := s.localScan()
+		if err != nil {
+			log.Printf("[%v] local scan failed. err=%v", s.name, err)
+			s.status.recordError(err)
+		} else {
+			log.Printf("[%v] quiet hours until %v, %v action(s) waiting", s.name, quietEnd.Format("15:04"), len(actions))
+		}
+		s.status.setPending(actions)
+		wait := s.schedule.roundDone(len(actions), err, false)
+		if untilEnd := quietEnd.Sub(now); untilEnd < wait {
+			wait = untilEnd
+		}
+		return wait
+	}
+	err := s.SyncOnce()
+	wait := s.schedule.roundDone(s.roundActions, err, s.rateLimited)
+	if s.rateLimited {
+		log.Printf("[%v] rate limited, waiting %v", s.name, wait)
+	} else {
+		s.maybePrune()
+	}
+	s.status.setPhase(PhaseSleeping)
+	return wait
+}
+
+// syncedListing is the remote as the index knows it: the listing of the last
+// scan, with what the last round wrote to the synced paths. Like a listing, it is
+// sorted by path.
+type syncedListing struct {
+	it *index.Iterator
+}
+
+func (l *syncedListing) Next() (*blob.MetaEntry, error) {
+	for {
+		e, err := l.it.Next()
+		if err == io.EOF {
+			return nil, blob.Done
+		} else if err != nil {
+			return nil, err
+		}
+		if e.State != index.StateSynced || e.SyncedRemoteMd5 == "" ||
+			(e.Remote != nil && e.Remote.Md5 == e.SyncedRemoteMd5) {
+			if e.Remote != nil {
+				return e.Remote, nil
+			}
+			continue
+		}
+		// Written by the last round.
+		meta := &blob.MetaEntry{RelPath: e.Path}
+		if e.Remote != nil {
+			*meta = *e.Remote
+		} else if e.Local != nil {
+			meta.Size, meta.ModTime, meta.SymlinkTarget = e.Local.Size, e.Local.ModTime, e.Local.SymlinkTarget
+		}
+		meta.Md5 = e.SyncedRemoteMd5
+		return meta, nil
+	}
+}
+
+// localScan diffs the local files against the last scan as if the remote did not
+// change, without talking to the backend, and returns the actions a round would
+// start with. The index is left as it is.
+func (s *syncer) localScan() ([]action, error) {
+	return s.plannedActions(func(ix *index.Index) blob.MetaIterator {
+		return &syncedListing{it: ix.Entries("")}
+	})
+}
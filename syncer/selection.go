@@ -0,0 +1,231 @@
+package syncer
+
+import (
+	"bufio"
+	"github.com/dotslash/cloudsync/index"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// selectionFile in the state dir has the remote subtrees (one per line) that are
+// synced to this machine. Without it, Options.Selected is used.
+const selectionFile = "selection"
+
+// Selection is the set of remote subtrees (or single files) synced to this
+// machine. Everything else is left alone on both sides. A nil Selection selects
+// everything.
+type Selection struct {
+	paths []string
+}
+
+func normalizeSelected(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+func NewSelection(paths []string) *Selection {
+	sel := &Selection{}
+	for _, p := range paths {
+		sel.Add(p)
+	}
+	return sel
+}
+
+// Paths returns the selected paths, sorted.
+func (sel *Selection) Paths() []string {
+	return append([]string(nil), sel.paths...)
+}
+
+// Add returns false if p was already selected.
+func (sel *Selection) Add(p string) bool {
+	p = normalizeSelected(p)
+	for _, existing := range sel.paths {
+		if existing == p {
+			return false
+		}
+	}
+	sel.paths = append(sel.paths, p)
+	sort.Strings(sel.paths)
+	return true
+}
+
+// Remove returns false if p was not selected.
+func (sel *Selection) Remove(p string) bool {
+	p = normalizeSelected(p)
+	for i, existing := range sel.paths {
+		if existing == p {
+			sel.paths = append(sel.paths[:i], sel.paths[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func under(relPath, selected string) bool {
+	return selected == "" || relPath == selected || strings.HasPrefix(relPath, selected+"/")
+}
+
+// Selected is true if relPath is one of the selected paths or is under one.
+func (sel *Selection) Selected(relPath util.RelPathType) bool {
+	if sel == nil {
+		return true
+	}
+	for _, p := range sel.paths {
+		if under(relPath.String(), p) {
+			return true
+		}
+	}
+	return false
+}
+
+// relevantDir is true if the directory relDir (without a trailing "/") has
+// selected paths in it.
+func (sel *Selection) relevantDir(relDir string) bool {
+	if sel == nil {
+		return true
+	}
+	for _, p := range sel.paths {
+		if under(relDir, p) || strings.HasPrefix(p, relDir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadSelection returns the selection saved in stateDir, or nil if there is none.
+func LoadSelection(stateDir string) (*Selection, error) {
+	file, err := os.Open(path.Join(stateDir, selectionFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	sel := &Selection{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			sel.Add(line)
+		}
+	}
+	return sel, scanner.Err()
+}
+
+// SaveSelection stores sel in stateDir. It is used by the syncer from its next round.
+func SaveSelection(stateDir string, sel *Selection) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	data := strings.Join(sel.paths, "\n") + "\n"
+	tmpPath := path.Join(stateDir, selectionFile+".tmp")
+	if err := os.WriteFile(tmpPath, []byte(data), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path.Join(stateDir, selectionFile))
+}
+
+// currentSelection is the saved selection, or the one from the options.
+func (s *syncer) currentSelection() (*Selection, error) {
+	if sel, err := LoadSelection(s.stateDir); err != nil || sel != nil {
+		return sel, err
+	}
+	if s.selected == nil {
+		return nil, nil
+	}
+	return NewSelection(s.selected), nil
+}
+
+// EvictResult is what EvictLocal removed, and what it kept because it has local
+// changes that are not uploaded.
+type EvictResult struct {
+	Evicted []util.RelPathType
+	Kept    []util.RelPathType
+}
+
+// EvictLocal removes the local copies of the files under selected (a path given
+// to Selection.Remove), which must no longer be selected, and their index
+// entries. Only files whose content is the one last synced are removed, the
+// blobs are left as they are. The caller must have ix open for writing so that
+// no round runs meanwhile.
+func EvictLocal(ix *index.Index, localPath, selected string, symlinks util.SymlinkPolicy, dryRun bool) (*EvictResult, error) {
+	selected = normalizeSelected(selected)
+	var entries []*index.Entry
+	if selected != "" {
+		// A selected file.
+		e, err := ix.Get(util.RelPathType(selected))
+		if err != nil {
+			return nil, err
+		} else if e != nil {
+			entries = append(entries, e)
+		}
+	}
+	prefix := selected
+	if prefix != "" {
+		// "dir" is also the prefix of "dir2/file".
+		prefix += "/"
+	}
+	it := ix.Entries(prefix)
+	for {
+		e, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	ret := &EvictResult{}
+	for _, e := range entries {
+		if e.Local == nil || e.Path.IsDir() {
+			// Empty directories are removed at the end.
+			ret.Evicted = append(ret.Evicted, e.Path)
+			continue
+		}
+		meta, err := util.GetLocalFileMeta(localPath, e.Path.String(), symlinks)
+		if os.IsNotExist(err) {
+			ret.Evicted = append(ret.Evicted, e.Path)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if e.SyncedRemoteMd5 == "" || meta.Md5sum != e.SyncedLocalMd5 {
+			ret.Kept = append(ret.Kept, e.Path)
+			continue
+		}
+		if !dryRun {
+			if err = os.Remove(path.Join(localPath, e.Path.String())); err != nil {
+				return nil, err
+			}
+		}
+		ret.Evicted = append(ret.Evicted, e.Path)
+	}
+	if dryRun {
+		return ret, nil
+	}
+	if err := ix.Modify(ret.Evicted, func(p util.RelPathType, e *index.Entry) *index.Entry { return nil }); err != nil {
+		return nil, err
+	}
+	removeEmptyDirs(path.Join(localPath, selected), selected == "")
+	return ret, nil
+}
+
+// removeEmptyDirs removes the directories under dir that are (or become) empty,
+// and dir itself unless keep is set.
+func removeEmptyDirs(dir string, keep bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			removeEmptyDirs(path.Join(dir, e.Name()), false)
+		}
+	}
+	if !keep {
+		// Fails if the directory is not empty.
+		_ = os.Remove(dir)
+	}
+}
@@ -0,0 +1,215 @@
+package syncer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/index"
+	"github.com/dotslash/cloudsync/util"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// The state of a pair is the index (see the index package) in its state dir.
+// Earlier versions kept the last scan in these files. They are imported into the
+// index on the first round and removed.
+const (
+	// A json object with all the local and remote metadata.
+	legacyLastScanFile = "last_scan.json"
+	// A json index.Entry (with only Path, Local and Remote) per line, sorted by path.
+	legacyLastScanLinesFile = "last_scan.jsonl"
+)
+
+// How long a round waits for a command that has the index open.
+const indexOpenTimeout = 30 * time.Second
+
+func (s *syncer) openIndex() (*index.Index, error) {
+	if err := os.MkdirAll(s.stateDir, 0755); err != nil {
+		return nil, err
+	}
+	ix, err := index.Open(path.Join(s.stateDir, index.FileName), indexOpenTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.importLegacyScan(ix); err != nil {
+		log.Printf("[%v] importing the last scan failed, starting from an empty state. err=%v", s.name, err)
+	}
+	return ix, nil
+}
+
+// legacyScan is the format of last_scan.json.
+type legacyScan struct {
+	ScanTime time.Time
+	Local    []util.LocalFileMeta
+	Remote   []blob.MetaEntry
+}
+
+func readLegacyScan(filePath string) ([]index.Entry, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var legacy legacyScan
+	if err = json.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	byPath := make(map[util.RelPathType]*index.Entry)
+	entry := func(p util.RelPathType) *index.Entry {
+		if byPath[p] == nil {
+			byPath[p] = &index.Entry{Path: p, ScannedAt: legacy.ScanTime}
+		}
+		return byPath[p]
+	}
+	for i := range legacy.Local {
+		entry(legacy.Local[i].RelPath).Local = &legacy.Local[i]
+	}
+	for i := range legacy.Remote {
+		entry(legacy.Remote[i].RelPath).Remote = &legacy.Remote[i]
+	}
+	ret := make([]index.Entry, 0, len(byPath))
+	for _, e := range byPath {
+		ret = append(ret, *e)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return ret, nil
+}
+
+func readLegacyScanLines(filePath string) ([]index.Entry, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var ret []index.Entry
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var e index.Entry
+		if err = decoder.Decode(&e); err != nil {
+			return nil, err
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// importLegacyScan fills an empty index with the last scan saved by an earlier
+// version.
+func (s *syncer) importLegacyScan(ix *index.Index) error {
+	linesPath := path.Join(s.stateDir, legacyLastScanLinesFile)
+	jsonPath := path.Join(s.stateDir, legacyLastScanFile)
+	empty, err := ix.Empty()
+	if err != nil || !empty {
+		return err
+	}
+	// The legacy files are removed once imported, a scan that can not be read is
+	// left there rather than imported partially.
+	var entries []index.Entry
+	var from string
+	if _, statErr := os.Stat(linesPath); statErr == nil {
+		from = linesPath
+		if entries, err = readLegacyScanLines(linesPath); err != nil {
+			return fmt.Errorf("reading %v failed - %v", linesPath, err)
+		}
+	} else if _, statErr = os.Stat(jsonPath); statErr == nil {
+		from = jsonPath
+		if entries, err = readLegacyScan(jsonPath); err != nil {
+			return fmt.Errorf("reading %v failed - %v", jsonPath, err)
+		}
+	} else {
+		return nil
+	}
+	w, err := ix.NewScan()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Local != nil && e.Remote != nil && e.Local.Md5sum == e.Remote.Md5 {
+			// The best guess of a base there is.
+			e.State = index.StateSynced
+			e.SyncedLocalMd5, e.SyncedRemoteMd5, e.SyncedAt = e.Local.Md5sum, e.Remote.Md5, e.ScannedAt
+		} else if e.State == "" {
+			e.State = index.StatePending
+		}
+		if err = w.Add(e); err != nil {
+			_ = w.Abort()
+			return err
+		}
+	}
+	if err = w.Commit(); err != nil {
+		return err
+	}
+	log.Printf("[%v] imported %v entries from %v", s.name, len(entries), from)
+	_ = os.Remove(linesPath)
+	_ = os.Remove(jsonPath)
+	return nil
+}
+
+// recordOutcome updates the index after the actions were applied. A successful
+// action leaves its path(s) in sync (or gone), a failed one marks them failed.
+// Skipped actions leave the index as it is.
+func (s *syncer) recordOutcome(ix *index.Index, actions []action, errs map[action]error, skipped map[action]bool) error {
+	type outcome struct {
+		md5     string // md5 both sides have now. Empty if not known.
+		removed bool
+		err     error
+	}
+	outcomes := make(map[util.RelPathType]outcome)
+	for _, a := range actions {
+		err := errs[a]
+		if skipped[a] {
+			continue
+		}
+		if cw, ok := a.(*conflictWrite); ok {
+			// The version kept aside is picked up by the next scan.
+			a = cw.write
+		}
+		switch a := a.(type) {
+		case *blobWrite:
+			md5 := ""
+			if a.localMeta != nil {
+				md5 = a.localMeta.Md5sum
+			}
+			outcomes[a.relativePath] = outcome{md5: md5, err: err}
+		case *localWrite:
+			outcomes[a.relativePath] = outcome{md5: a.blobInfo.Md5, err: err}
+		case *blobRemove:
+			outcomes[a.relativeFilePath] = outcome{removed: true, err: err}
+		case *localRemove:
+			outcomes[a.relativeFilePath] = outcome{removed: true, err: err}
+		case *blobMove:
+			outcomes[a.from] = outcome{removed: true, err: err}
+			outcomes[a.to] = outcome{md5: a.md5, err: err}
+		case *localMove:
+			outcomes[a.from] = outcome{removed: true, err: err}
+			outcomes[a.to] = outcome{md5: a.md5, err: err}
+		case *blobCopy:
+			outcomes[a.to] = outcome{md5: a.md5, err: err}
+		}
+	}
+	paths := make([]util.RelPathType, 0, len(outcomes))
+	for p := range outcomes {
+		paths = append(paths, p)
+	}
+	now := time.Now()
+	return ix.Modify(paths, func(p util.RelPathType, e *index.Entry) *index.Entry {
+		o := outcomes[p]
+		if e == nil {
+			e = &index.Entry{Path: p, ScannedAt: now}
+		}
+		if o.err != nil {
+			e.State = index.StateFailed
+			e.Error = o.err.Error()
+		} else if o.removed {
+			return nil
+		} else if o.md5 != "" {
+			e.State = index.StateSynced
+			e.Error = ""
+			e.SyncedLocalMd5, e.SyncedRemoteMd5, e.SyncedAt = o.md5, o.md5, now
+		}
+		return e
+	})
+}
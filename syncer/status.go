@@ -0,0 +1,247 @@
+package syncer
+
+import (
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/index"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Phase is what the syncer is doing right now.
+type Phase string
+
+const (
+	PhaseIdle Phase = "idle"
+	// Listing the local and remote files and diffing them (all at once).
+	PhaseScanning Phase = "scanning"
+	PhaseApplying Phase = "applying"
+	PhaseSleeping Phase = "sleeping"
+	// In quiet hours, when only the local files are scanned. See scheduledRound.
+	PhaseQuiet Phase = "quiet"
+	// Removing what the retention rules do not keep. See maybePrune.
+	PhasePruning Phase = "pruning"
+)
+
+// Only the last few errors are kept around.
+const maxStatusErrors = 20
+
+type TransferProgress struct {
+	Path      util.RelPathType `json:"path"`
+	Direction string           `json:"direction"` // upload or download
+	Bytes     int64            `json:"bytes"`
+	// -1 if not known
+	TotalBytes int64     `json:"total_bytes"`
+	Started    time.Time `json:"started"`
+}
+
+type StatusError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Status is a snapshot of what a syncer is doing.
+type Status struct {
+	Name       string    `json:"name"`
+	LocalPath  string    `json:"local_path"`
+	Mode       SyncMode  `json:"mode"`
+	Phase      Phase     `json:"phase"`
+	PhaseSince time.Time `json:"phase_since"`
+	// Actions of the current round that are not done yet.
+	PendingActions []string           `json:"pending_actions"`
+	Transfers      []TransferProgress `json:"transfers"`
+	LastRunStart   time.Time          `json:"last_run_start"`
+	LastSuccess    time.Time          `json:"last_success"`
+	// When the daemon runs the next round. Zero while a round runs.
+	NextRound time.Time     `json:"next_round"`
+	Errors    []StatusError `json:"errors"`
+	// Counts of the index after the last round. Nil before the first round.
+	Index *index.Summary `json:"index,omitempty"`
+	// Nil without a lease, or before the first round.
+	Lease *LeaseStatus `json:"lease,omitempty"`
+}
+
+type statusTracker struct {
+	mu        sync.Mutex
+	status    Status
+	pending   []action
+	transfers map[*TransferProgress]bool
+}
+
+func newStatusTracker(name, localPath string, mode SyncMode) *statusTracker {
+	return &statusTracker{
+		status: Status{
+			Name:       name,
+			LocalPath:  localPath,
+			Mode:       mode,
+			Phase:      PhaseIdle,
+			PhaseSince: time.Now(),
+		},
+		transfers: make(map[*TransferProgress]bool),
+	}
+}
+
+func (t *statusTracker) setPhase(phase Phase) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Phase = phase
+	t.status.PhaseSince = time.Now()
+	if phase == PhaseScanning {
+		t.status.LastRunStart = t.status.PhaseSince
+		t.status.NextRound = time.Time{}
+	}
+}
+
+func (t *statusTracker) setNextRound(next time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.NextRound = next
+}
+
+func (t *statusTracker) setPending(actions []action) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append([]action(nil), actions...)
+}
+
+func (t *statusTracker) actionDone(a action) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, p := range t.pending {
+		if p == a {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *statusTracker) recordError(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Errors = append(t.status.Errors, StatusError{Time: time.Now(), Message: err.Error()})
+	if len(t.status.Errors) > maxStatusErrors {
+		t.status.Errors = t.status.Errors[len(t.status.Errors)-maxStatusErrors:]
+	}
+}
+
+func (t *statusTracker) syncDone(err error) {
+	if err != nil {
+		t.recordError(err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		t.status.LastSuccess = time.Now()
+	}
+	t.pending = nil
+}
+
+func (t *statusTracker) setIndexSummary(summary *index.Summary) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Index = summary
+}
+
+func (t *statusTracker) setLease(lease *LeaseStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Lease = lease
+}
+
+func (t *statusTracker) startTransfer(name util.RelPathType, direction string, total int64) *TransferProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := &TransferProgress{Path: name, Direction: direction, TotalBytes: total, Started: time.Now()}
+	t.transfers[p] = true
+	return p
+}
+
+func (t *statusTracker) addBytes(p *TransferProgress, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p.Bytes += int64(n)
+}
+
+func (t *statusTracker) endTransfer(p *TransferProgress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.transfers, p)
+}
+
+func (t *statusTracker) snapshot() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := t.status
+	ret.PendingActions = make([]string, 0, len(t.pending))
+	for _, a := range t.pending {
+		ret.PendingActions = append(ret.PendingActions, a.String())
+	}
+	ret.Transfers = make([]TransferProgress, 0, len(t.transfers))
+	for p := range t.transfers {
+		ret.Transfers = append(ret.Transfers, *p)
+	}
+	sort.Slice(ret.Transfers, func(i, j int) bool {
+		return ret.Transfers[i].Started.Before(ret.Transfers[j].Started)
+	})
+	ret.Errors = append([]StatusError(nil), t.status.Errors...)
+	return ret
+}
+
+type progressReader struct {
+	reader   io.ReadCloser
+	tracker  *statusTracker
+	progress *TransferProgress
+	once     sync.Once
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.tracker.addBytes(r.progress, n)
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	r.once.Do(func() { r.tracker.endTransfer(r.progress) })
+	return r.reader.Close()
+}
+
+// progressBackend reports the progress of the content flowing through Put and
+// Get to the status tracker.
+type progressBackend struct {
+	blob.Backend
+	tracker *statusTracker
+}
+
+func (b *progressBackend) Put(name util.RelPathType, reader io.ReadCloser, opts blob.PutOptions) error {
+	total := int64(-1)
+	if file, ok := reader.(*os.File); ok {
+		if info, err := file.Stat(); err == nil {
+			total = info.Size()
+		}
+	}
+	wrapped := &progressReader{reader: reader, tracker: b.tracker}
+	wrapped.progress = b.tracker.startTransfer(name, "upload", total)
+	defer wrapped.once.Do(func() { b.tracker.endTransfer(wrapped.progress) })
+	return b.Backend.Put(name, wrapped, opts)
+}
+
+func (b *progressBackend) Get(name util.RelPathType) (*blob.FullEntry, error) {
+	entry, err := b.Backend.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	entry.Content = &progressReader{
+		reader:   entry.Content,
+		tracker:  b.tracker,
+		progress: b.tracker.startTransfer(name, "download", entry.Size),
+	}
+	return entry, nil
+}
+
+// Status returns a snapshot of what the syncer is doing.
+func (s *syncer) Status() Status {
+	return s.status.snapshot()
+}
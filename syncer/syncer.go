@@ -3,23 +3,125 @@ package syncer
 import (
 	"fmt"
 	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/index"
 	"github.com/dotslash/cloudsync/util"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
-// ScanResult contains the information present on remote and local filesystem
-// about what files are present and their metadata.
-type ScanResult struct {
-	remote   map[util.RelPathType]blob.MetaEntry
-	local    map[util.RelPathType]util.LocalFileMeta
-	scanTime time.Time
+// SyncMode restricts the side(s) of the sync a syncer is allowed to modify.
+type SyncMode string
+
+const (
+	SyncModeTwoWay SyncMode = "two-way"
+	// Local is the source of truth. Remote changes are never written locally.
+	SyncModeUploadOnly SyncMode = "upload-only"
+	// Remote is the source of truth. Local changes are never uploaded.
+	SyncModeDownloadOnly SyncMode = "download-only"
+)
+
+func (m SyncMode) Valid() bool {
+	return m == SyncModeTwoWay || m == SyncModeUploadOnly || m == SyncModeDownloadOnly
+}
+
+func (m SyncMode) allows(a action) bool {
+	switch m {
+	case SyncModeUploadOnly:
+		return a.side() == sideRemote
+	case SyncModeDownloadOnly:
+		return a.side() == sideLocal
+	default:
+		return true
+	}
+}
+
+const defaultSyncInterval = 30 * time.Second
+
+// Options has the optional settings of a syncer. The zero value is a two way sync
+// without trash, excludes or persisted state that runs every 30 secs to 10 mins.
+type Options struct {
+	// Name is used in logs and as the name of the state directory of the syncer.
+	Name string
+	// Removed local files are moved here. Empty means no trash.
+	LocalTrash string
+	Excludes   []string
+	Mode       SyncMode
+	// The daemon waits this long after a round with actions. Defaults to 30 secs.
+	MinInterval time.Duration
+	// Idle rounds, failures and rate limits stretch the interval up to this.
+	// Defaults to 10 mins (or MinInterval if it is longer).
+	MaxInterval time.Duration
+	// During these the daemon only scans the local files. See scheduledRound.
+	QuietHours []util.TimeWindow
+	// The index (see the index package) is kept here, so that a restart can tell
+	// deletions from additions. If empty a temporary directory is used.
+	StateDir string
+	// Defaults to util.SymlinkFollow
+	Symlinks util.SymlinkPolicy
+	// Remote subtrees (or files) synced to this machine. nil means everything.
+	// A selection saved in StateDir (see SaveSelection) takes precedence.
+	Selected []string
+	// If set, rounds only look at the remote paths it reports (see remoteListing).
+	Feed RemoteFeed
+	// How often the whole remote is listed anyway with a Feed. Defaults to an hour.
+	ReconcileInterval time.Duration
+	// Told about every round and every action that is done. Can be nil.
+	Hook Hook
+	// If set, rounds hold the lease of the remote (see leaseKeeper), which expires
+	// LeaseTTL (2 mins by default) after it was last renewed.
+	Lease    blob.Leaser
+	LeaseTTL time.Duration
+	// If set, the operations of the rounds on the remote are appended to the
+	// journal of this machine.
+	Journal blob.Journaler
+	// If set, the daemon runs it every PruneInterval.
+	Pruner        Pruner
+	PruneInterval time.Duration
 }
 
 type syncer struct {
+	name          string
 	localBasePath string
+	localTrash    string
 	backend       blob.Backend
-	lastScan      ScanResult
+	excludes      *util.ExcludeMatcher
+	symlinks      util.SymlinkPolicy
+	mode          SyncMode
+	schedule      *schedule
+	// Has the index. See state.go
+	stateDir string
+	status   *statusTracker
+	// Directory markers in the remote scan being diffed.
+	remoteDirMarkers map[util.RelPathType]bool
+	// From Options. See currentSelection.
+	selected []string
+	// Of the current round.
+	selection *Selection
+	// See remoteListing. touched is nil without a feed.
+	feed              RemoteFeed
+	touched           *touchRecorder
+	reconcileInterval time.Duration
+	fullListing       bool
+	needFullListing   bool
+	lastFullListing   time.Time
+	listedSelection   string
+	// Outcome of the last round, for the schedule and the hook.
+	roundActions  int
+	roundFailures int
+	rateLimited   bool
+	hook          Hook
+	// nil without Options.Lease.
+	lease *leaseKeeper
+	// See flushJournal.
+	journal      blob.Journaler
+	journalQueue []blob.JournalEntry
+	// See maybePrune.
+	pruner        Pruner
+	pruneInterval time.Duration
+	lastPrune     time.Time
 }
 
 type changeType string
@@ -30,233 +132,184 @@ const (
 	changeTypeNone    changeType = "none"
 )
 
+// diffFileEntry is a path with its local and remote state and how each side
+// changed since the base: the content both sides last agreed on (see
+// index.Entry.SyncedLocalMd5). Without a base, whatever is present counts as
+// added.
 type diffFileEntry struct {
 	fileName util.RelPathType
-	// if localChanged is false, no change on local
-	// if localChanged is true, localDiff has this semantic
-	//   nil => no diff.
-	//   Otherwise, the file got changed/added
+	// nil if the file is not there locally.
 	local       *util.LocalFileMeta
 	localChange changeType
-	// if remoteChanged is false, no change on local
-	// if remoteChanged is true, remoteDiff has this semantic
-	//   nil => no diff.
-	//   Otherwise, the file got changed/added
+	// nil if there is no blob.
 	remote       *blob.MetaEntry
 	remoteChange changeType
+	// md5 of the base. Empty if there is none.
+	baseMd5 string
 }
 
 func (de diffFileEntry) String() string {
-	localMd5, remoteMd5 := "na", "na"
+	localMd5, remoteMd5, baseMd5 := "na", "na", "na"
 	if de.local != nil {
 		localMd5 = de.local.Md5sum
 	}
 	if de.remote != nil {
 		remoteMd5 = de.remote.Md5
 	}
-	return fmt.Sprintf("local:%v@%v remote:%v@%v", de.localChange, localMd5, de.remoteChange, remoteMd5)
+	if de.baseMd5 != "" {
+		baseMd5 = de.baseMd5
+	}
+	return fmt.Sprintf("base:%v local:%v@%v remote:%v@%v", baseMd5, de.localChange, localMd5, de.remoteChange, remoteMd5)
 }
 
+func (de *diffFileEntry) blobWrite(s *syncer) *blobWrite {
+	return &blobWrite{
+		localBasePath: s.localBasePath,
+		relativePath:  de.fileName,
+		backend:       s.backend,
+		symlinks:      s.symlinks,
+		localMeta:     de.local,
+		remoteMeta:    de.remote,
+	}
+}
+
+func (de *diffFileEntry) localWrite(s *syncer) *localWrite {
+	lw := &localWrite{
+		localBasePath: s.localBasePath,
+		relativePath:  de.fileName,
+		backend:       s.backend,
+		symlinks:      s.symlinks,
+		blobInfo:      de.remote,
+	}
+	if de.local != nil {
+		lw.expectedLocalMd5 = de.local.Md5sum
+	}
+	return lw
+}
+
+// getAction decides from the (base, local, remote) triple. A side that did not
+// change since the base takes the change of the other side. If both changed
+// differently, a modification wins over a removal, and when both modified the
+// newer one wins and the other one is kept as a conflict copy.
 func (de *diffFileEntry) getAction(s *syncer) action {
 	bothMetasPresent := de.local != nil && de.remote != nil
-	noOp := bothMetasPresent && de.local.Md5sum == de.remote.Md5
-	if !noOp {
-		log.Printf("diffEntry - %v %v", de.fileName, de.String())
-	}
-	if de.localChange == changeTypeRem && de.remoteChange == changeTypeRem {
+	if bothMetasPresent && de.local.Md5sum == de.remote.Md5 {
+		// Same content on both sides. The base is updated by the scan.
+		return nil
+	} else if de.local == nil && de.remote == nil {
 		// Removed from both remote and local.
 		return nil
-	} else if de.remoteChange == changeTypeRem { // removed from remote
-		if de.localChange == changeTypeUpdated {
-			// locally the file is updated or added. It is removed from remote.
-			// lets play safe and add it back to remote.
-			return &blobWrite{
-				localBasePath: s.localBasePath,
-				relativePath:  de.fileName,
-				backend:       s.backend,
-			}
-		} else if de.local != nil {
-			// no change on local => remove on local
-			return &localRemove{
-				basePath:         s.localBasePath,
-				relativeFilePath: de.fileName,
-			}
+	}
+	log.Printf("diffEntry - %v %v", de.fileName, de.String())
+	if de.localChange == changeTypeNone && de.remoteChange != changeTypeNone {
+		// Only the remote changed.
+		if de.remote != nil {
+			return de.localWrite(s)
 		}
-	} else if de.localChange == changeTypeRem { // removed from local
-		if de.remoteChange == changeTypeUpdated { // update on blobstore
-			blobWriterClientId := de.remote.BlobWriterClientId
-			if blobWriterClientId != nil && *blobWriterClientId == util.UniqueMachineId {
-				// 1. Source of the blob is the current machine
-				// 2. Blob is not on the machine
-				// => blob was removed from the machine after it was uploaded => So we need to remove the blob
-				return &blobRemove{
-					relativeFilePath: de.fileName,
-					backend:          s.backend,
-				}
-			} else {
-				// locally file is removed. But it updated on remote recently.
-				// lets play safe and add it back to local
-				return &localWrite{
-					localBasePath: s.localBasePath,
-					relativePath:  de.fileName,
-					backend:       s.backend,
-					blobInfo:      de.remote,
-				}
-			}
-		} else if de.remote != nil {
-			// no changes on remote => remove on remote
-			return &blobRemove{
-				relativeFilePath: de.fileName,
-				backend:          s.backend,
-			}
+		return &localRemove{
+			basePath:         s.localBasePath,
+			relativeFilePath: de.fileName,
+			trashPath:        s.localTrash,
+			keepDirs:         s.remoteDirMarkers,
 		}
-		return nil
-	} else if !bothMetasPresent {
-		// This will happen if the file is present only on one side => (typically file add)
+	} else if de.remoteChange == changeTypeNone && de.localChange != changeTypeNone {
+		// Only the local file changed.
 		if de.local != nil {
-			return &blobWrite{
-				localBasePath: s.localBasePath,
-				relativePath:  de.fileName,
-				backend:       s.backend,
-				localMeta:     de.local,
-				remoteMeta:    de.remote,
-			}
-		} else {
-			return &localWrite{
-				localBasePath: s.localBasePath,
-				relativePath:  de.fileName,
-				backend:       s.backend,
-				blobInfo:      de.remote,
-			}
+			return de.blobWrite(s)
 		}
-	} else {
-		// We have both the metadatas. Lets check which one is recent and write to the other.
-		if de.local.Md5sum == de.remote.Md5 {
-			// file changed. But same md5 in both places.
-			return nil
-		} else if de.local.ModTime.After(de.remote.ModTime) {
-			// local timestamp higher => write to remote
-			return &blobWrite{
-				localBasePath: s.localBasePath,
-				relativePath:  de.fileName,
-				backend:       s.backend,
-				localMeta:     de.local,
-				remoteMeta:    de.remote,
-			}
-		} else {
-			// remote timestamp higher => write to local
-			return &localWrite{
-				localBasePath: s.localBasePath,
-				relativePath:  de.fileName,
-				backend:       s.backend,
-				blobInfo:      de.remote,
-			}
+		br := &blobRemove{
+			relativeFilePath: de.fileName,
+			backend:          s.backend,
+		}
+		if de.remote != nil {
+			br.md5 = de.remote.Md5
 		}
+		return br
+	} else if de.local == nil {
+		// Removed locally, modified on the remote. Lets play safe and bring it back.
+		return de.localWrite(s)
+	} else if de.remote == nil {
+		// Removed from the remote, modified locally. Lets play safe and add it back.
+		return de.blobWrite(s)
 	}
-	return nil
+	// Both sides have different content and (at least) one of them does not match
+	// the base: a conflict.
+	return s.resolveConflict(de)
 }
 
-type diffFromLastRunState map[util.RelPathType]*diffFileEntry
-
-func (d *diffFromLastRunState) setLocalDiff(key util.RelPathType, local *util.LocalFileMeta, ct changeType) {
-	entry, ok := (*d)[key]
-	if ok {
-		entry.localChange = ct
-		entry.local = local
-	} else {
-		(*d)[key] = &diffFileEntry{
-			fileName:     key,
-			local:        local,
-			localChange:  ct,
-			remoteChange: changeTypeNone,
-		}
+func (s *syncer) Start() {
+	for {
+		wait := s.scheduledRound()
+		s.status.setNextRound(time.Now().Add(wait))
+		time.Sleep(wait)
 	}
 }
 
-func (d *diffFromLastRunState) setRemoteDiff(key util.RelPathType, remote *blob.MetaEntry, ct changeType) {
-	entry, ok := (*d)[key]
-	if ok {
-		entry.remote = remote
-		entry.remoteChange = ct
+// SyncOnce runs one round and records its outcome in the status and metrics.
+func (s *syncer) SyncOnce() error {
+	log.Printf("[%v] Starting syncCode", s.name)
+	s.fireHook(HookEvent{Event: HookPreSync})
+	err := s.syncCore()
+	s.listingDone(err)
+	post := HookEvent{Event: HookPostSync, Actions: s.roundActions, Failures: s.roundFailures}
+	if err != nil {
+		post.Error = err.Error()
+	}
+	s.fireHook(post)
+	if err != nil {
+		log.Printf("[%v] syncCore failed. err=%v", s.name, err)
+	}
+	s.status.syncDone(err)
+	if err != nil {
+		syncRoundsTotal.Inc(s.name, "error")
 	} else {
-		(*d)[key] = &diffFileEntry{
-			fileName:     key,
-			remote:       remote,
-			remoteChange: ct,
-			localChange:  changeTypeNone,
-		}
+		syncRoundsTotal.Inc(s.name, "ok")
+		lastSuccessTimestamp.Set(float64(time.Now().Unix()), s.name)
 	}
+	return err
 }
 
-func (s *syncer) Start() {
-	for {
-		log.Printf("Starting syncCode")
-		err := s.syncCore()
-		if err != nil {
-			log.Printf("syncCore failed. err=%v", err)
-		}
-		time.Sleep(30 * time.Second)
-	}
+// PlannedChange is an action a round would apply. See Plan.
+type PlannedChange struct {
+	Kind string `json:"kind"`
+	// "local" or "remote", the side the action modifies.
+	Side   string `json:"side"`
+	Action string `json:"action"`
 }
 
-func (s *syncer) getActions(newRun *ScanResult) []action {
-	state := make(diffFromLastRunState)
-	newLocalFiles := make(map[util.RelPathType]util.LocalFileMeta)
-	for _, _lm := range newRun.local {
-		localMeta := _lm
-		newLocalFiles[_lm.RelPath] = _lm
-		state.setLocalDiff(localMeta.RelPath, &localMeta, changeTypeNone)
-	}
-	for _, _oldFile := range s.lastScan.local {
-		newFile, ok := newLocalFiles[_oldFile.RelPath]
-		if !ok {
-			state.setLocalDiff(_oldFile.RelPath, nil, changeTypeRem)
-		} else {
-			if newFile.Md5sum != _oldFile.Md5sum {
-				state.setLocalDiff(newFile.RelPath, &newFile, changeTypeUpdated)
-			}
-			// Delete the file from newLocalFiles map. After this for loop
-			// the entries left in this map are newly added.
-			delete(newLocalFiles, newFile.RelPath)
-		}
+// Plan scans both sides and returns what a round would do, without doing it.
+// The index is left as it is.
+func (s *syncer) Plan() ([]PlannedChange, error) {
+	s.status.setPhase(PhaseScanning)
+	defer s.status.setPhase(PhaseIdle)
+	actions, err := s.plannedActions(func(*index.Index) blob.MetaIterator { return s.backend.List("") })
+	if err != nil {
+		return nil, err
 	}
-	for _, _newFile := range newLocalFiles {
-		// all these are newly added.
-		newFile := _newFile
-		state.setLocalDiff(_newFile.RelPath, &newFile, changeTypeUpdated)
+	ret := make([]PlannedChange, 0, len(actions))
+	for _, a := range actions {
+		ret = append(ret, PlannedChange{Kind: a.kind(), Side: string(a.side()), Action: a.String()})
 	}
+	return ret, nil
+}
 
-	newFilesRemote := make(map[util.RelPathType]blob.MetaEntry)
-	for _, _remoteFile := range newRun.remote {
-		remoteFile := _remoteFile
-		newFilesRemote[_remoteFile.RelPath] = _remoteFile
-		state.setRemoteDiff(_remoteFile.RelPath, &remoteFile, changeTypeNone)
-	}
-	for _, _oldRemoteFile := range s.lastScan.remote {
-		newRemoteFile, ok := newFilesRemote[_oldRemoteFile.RelPath]
-		if !ok {
-			state.setRemoteDiff(_oldRemoteFile.RelPath, nil, changeTypeRem)
-		} else {
-			if newRemoteFile.Md5 != _oldRemoteFile.Md5 {
-				state.setRemoteDiff(newRemoteFile.RelPath, &newRemoteFile, changeTypeUpdated)
-			}
-			delete(newFilesRemote, newRemoteFile.RelPath)
-		}
+// plannedActions scans and diffs like a round, with the remote listing returned
+// by listing, and drops the new scan.
+func (s *syncer) plannedActions(listing func(ix *index.Index) blob.MetaIterator) ([]action, error) {
+	ix, err := s.openIndex()
+	if err != nil {
+		return nil, err
 	}
-	for _, _newRemoteFile := range newFilesRemote {
-		newRemoteFile := _newRemoteFile
-		state.setRemoteDiff(_newRemoteFile.RelPath, &newRemoteFile, changeTypeUpdated)
+	defer ix.Close()
+	newScan, err := ix.NewScan()
+	if err != nil {
+		return nil, err
 	}
-
-	ret := make([]action, 0)
-	for _, entry := range state {
-		fileAction := entry.getAction(s)
-		if fileAction != nil {
-			ret = append(ret, fileAction)
-		}
+	actions, err := s.getActions(ix, newScan, listing(ix))
+	if abortErr := newScan.Abort(); abortErr != nil && err == nil {
+		err = abortErr
 	}
-
-	return ret
+	return actions, err
 }
 
 func (s *syncer) syncCore() error {
@@ -269,35 +322,163 @@ func (s *syncer) syncCore() error {
 			log.Printf("syncCore.done(ok)->==================================")
 		}
 	}()
-	remoteFiles, err := s.backend.ListDirRecursive("")
+	s.roundActions, s.roundFailures, s.rateLimited = 0, 0, false
+	s.status.setPhase(PhaseScanning)
+	ix, err := s.openIndex()
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+	if s.lease != nil {
+		if err = s.lease.acquire(); err != nil {
+			return err
+		}
+		defer s.lease.release()
+	}
+	newScan, err := ix.NewScan()
 	if err != nil {
 		return err
 	}
-	log.Printf("backend.ListDirRecursive done")
-	localFiles, err := util.ListFilesRec(s.localBasePath)
+	remote, err := s.remoteListing(ix)
 	if err != nil {
+		s.rateLimited = blob.IsRateLimited(err)
+		_ = newScan.Abort()
+		return err
+	}
+	actions, err := s.getActions(ix, newScan, remote)
+	if err != nil {
+		s.rateLimited = blob.IsRateLimited(err)
+		if abortErr := newScan.Abort(); abortErr != nil {
+			log.Printf("[%v] dropping the scan failed. err=%v", s.name, abortErr)
+		}
 		return err
 	}
-	log.Printf("util.ListFilesRec done")
-	scanRes := ScanResult{remote: remoteFiles, local: localFiles, scanTime: time.Now()}
-	actions := s.getActions(&scanRes)
 	log.Printf("s.getActions done. numActions %v", len(actions))
-	err = s.applyChanges(actions)
+	s.status.setPhase(PhaseApplying)
+	errs, skipped := s.applyChanges(actions)
+	s.flushJournal()
+	s.roundActions, s.roundFailures, s.rateLimited = len(actions), len(errs), anyRateLimited(errs)
 	log.Printf("s.applyChanges done. numActions %v", len(actions))
-	s.lastScan = scanRes
+	if commitErr := newScan.Commit(); commitErr != nil {
+		log.Printf("[%v] saving the scan failed. err=%v", s.name, commitErr)
+	} else if recordErr := s.recordOutcome(ix, actions, errs, skipped); recordErr != nil {
+		log.Printf("[%v] recording the outcome of the actions failed. err=%v", s.name, recordErr)
+	}
+	if summary, summaryErr := ix.Summary(); summaryErr == nil {
+		s.status.setIndexSummary(summary)
+	}
+	if len(errs) != 0 {
+		err = fmt.Errorf("%v of %v actions failed", len(errs), len(actions))
+	}
 	return err
 }
 
-func (s *syncer) applyChanges(actions []action) error {
+// applyChanges does all the actions even if some of them fail. The failures are
+// recorded in the status and returned with the actions that were skipped.
+func (s *syncer) applyChanges(actions []action) (errs map[action]error, skipped map[action]bool) {
+	s.status.setPending(actions)
+	errs = make(map[action]error)
+	skipped = make(map[action]bool)
 	for _, a := range actions {
-		if err := a.do(); err != nil {
-			// TODO: Dont fail the entire thing if one operation fails.
-			return fmt.Errorf("failure in %v", a)
+		actionsTotal.Inc(s.name, a.kind())
+		if err := s.doAction(a); isSkipped(err) {
+			skipped[a] = true
+		} else if err != nil {
+			actionFailuresTotal.Inc(s.name, a.kind())
+			errs[a] = err
+			s.status.recordError(fmt.Errorf("failure in %v - %v", a, err))
+			log.Printf("[%v] failure in %v - %v", s.name, a, err)
+		} else {
+			s.journalAction(a)
+			s.fireActionHook(a)
 		}
+		s.status.actionDone(a)
 	}
-	return nil
+	return errs, skipped
 }
 
-func NewSyncer(localPath string, _ string, backend blob.Backend) *syncer {
-	return &syncer{localBasePath: localPath, backend: backend}
+// doAction does the action if the syncer can: actions on the remote need the
+// lease, if there is one.
+func (s *syncer) doAction(a action) error {
+	if s.lease != nil && a.side() == sideRemote {
+		if err := s.lease.check(); err != nil {
+			return err
+		}
+	}
+	return a.do()
+}
+
+func NewSyncer(localPath string, localTrash string, backend blob.Backend) *syncer {
+	return NewSyncerWithOptions(localPath, backend, Options{LocalTrash: localTrash})
+}
+
+func NewSyncerWithOptions(localPath string, backend blob.Backend, opts Options) *syncer {
+	localPath, err := filepath.Abs(localPath)
+	util.PanicIfErr(err, "filepath.Abs failed")
+	localTrash := opts.LocalTrash
+	if localTrash != "" {
+		localTrash, err = filepath.Abs(localTrash)
+		util.PanicIfErr(err, "filepath.Abs failed")
+	}
+	s := &syncer{
+		name:              opts.Name,
+		localBasePath:     localPath,
+		localTrash:        localTrash,
+		mode:              opts.Mode,
+		schedule:          newSchedule(opts.MinInterval, opts.MaxInterval, opts.QuietHours),
+		stateDir:          opts.StateDir,
+		symlinks:          opts.Symlinks,
+		selected:          opts.Selected,
+		feed:              opts.Feed,
+		reconcileInterval: opts.ReconcileInterval,
+		hook:              opts.Hook,
+		journal:           opts.Journal,
+		pruner:            opts.Pruner,
+		pruneInterval:     opts.PruneInterval,
+	}
+	if s.symlinks == "" {
+		s.symlinks = util.SymlinkFollow
+	}
+	if s.mode == "" {
+		s.mode = SyncModeTwoWay
+	}
+	if s.name == "" {
+		s.name = "default"
+	}
+	s.status = newStatusTracker(s.name, s.localBasePath, s.mode)
+	s.backend = &progressBackend{Backend: blob.NewMeteredBackend(backend, s.name), tracker: s.status}
+	if s.feed != nil {
+		s.touched = &touchRecorder{Backend: s.backend, touched: make(map[util.RelPathType]bool)}
+		s.backend = s.touched
+	}
+	if s.reconcileInterval <= 0 {
+		s.reconcileInterval = defaultReconcileInterval
+	}
+	if opts.Lease != nil {
+		s.lease = &leaseKeeper{leaser: opts.Lease, ttl: opts.LeaseTTL, status: s.status}
+		if s.lease.ttl <= 0 {
+			s.lease.ttl = defaultLeaseTTL
+		}
+	}
+	started := time.Now()
+	secondsSinceLastSuccess.SetFunc(func() float64 {
+		lastSuccess := s.status.snapshot().LastSuccess
+		if lastSuccess.IsZero() {
+			lastSuccess = started
+		}
+		return time.Since(lastSuccess).Seconds()
+	}, s.name)
+	excludes := opts.Excludes
+	// Dont sync the trash if it lives inside the directory being synced.
+	if trashRel, err := filepath.Rel(s.localBasePath, s.localTrash); s.localTrash != "" && err == nil &&
+		trashRel != ".." && !strings.HasPrefix(trashRel, "../") {
+		excludes = append([]string{"/" + trashRel + "/"}, excludes...)
+	}
+	s.excludes = util.NewExcludeMatcher(excludes)
+	if s.stateDir == "" {
+		// The state is lost on restart, like it used to be without a state dir.
+		s.stateDir, err = os.MkdirTemp("", "cloudsync-"+s.name+"-")
+		util.PanicIfErr(err, "MkdirTemp failed")
+	}
+	return s
 }
@@ -0,0 +1,120 @@
+package syncer
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalTrash is the trash localRemove moves files to: <trash>/<time of
+// removal>/<path>. It implements blob.Trash, the paths are relative to the trash
+// directory.
+type LocalTrash struct {
+	localBasePath string
+	trashPath     string
+}
+
+func NewLocalTrash(localPath, trashPath string) (*LocalTrash, error) {
+	localPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if trashPath, err = filepath.Abs(trashPath); err != nil {
+		return nil, err
+	}
+	return &LocalTrash{localBasePath: localPath, trashPath: trashPath}, nil
+}
+
+// ListTrash returns the trashed files. They are all removed by this machine.
+func (t *LocalTrash) ListTrash(prefix string) ([]blob.TrashEntry, error) {
+	var ret []blob.TrashEntry
+	// WalkDir goes in lexical order, which is the order of the times.
+	err := filepath.WalkDir(t.trashPath, func(p string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && p == t.trashPath {
+			return filepath.SkipDir
+		} else if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(t.trashPath, p)
+		if err != nil {
+			return err
+		}
+		deletedAt, original, ok := util.ParseTrashPath(filepath.ToSlash(rel))
+		if !ok || !strings.HasPrefix(original.String(), prefix) {
+			return nil
+		}
+		// Links were trashed as they are.
+		meta, err := util.GetLocalFileMeta(t.trashPath, filepath.ToSlash(rel), util.SymlinkLink)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, blob.TrashEntry{
+			TrashPath:    util.RelPathType(filepath.ToSlash(rel)),
+			OriginalPath: original,
+			DeletedAt:    deletedAt,
+			DeletedBy:    util.UniqueMachineId,
+			Size:         meta.Size,
+			Md5:          meta.Md5sum,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// trashed returns the full path of a trashed file and its original path.
+func (t *LocalTrash) trashed(trashPath util.RelPathType) (string, util.RelPathType, error) {
+	_, original, ok := util.ParseTrashPath(trashPath.String())
+	if !ok || strings.Contains("/"+trashPath.String()+"/", "/../") {
+		return "", "", fmt.Errorf("%v is not in the trash", trashPath)
+	}
+	fullPath := path.Join(t.trashPath, trashPath.String())
+	if _, err := os.Lstat(fullPath); err != nil {
+		return "", "", err
+	}
+	return fullPath, original, nil
+}
+
+// Restore moves the file back. The next round uploads it like a new file.
+func (t *LocalTrash) Restore(trashPath, to util.RelPathType) error {
+	fullPath, original, err := t.trashed(trashPath)
+	if err != nil {
+		return err
+	}
+	if to == "" {
+		to = original
+	}
+	dst := path.Join(t.localBasePath, to.String())
+	if dst == path.Clean(t.localBasePath) || !util.ResolvesInside(t.localBasePath, dst) {
+		return fmt.Errorf("%v is not inside %v", to, t.localBasePath)
+	}
+	if _, err = os.Lstat(dst); err == nil {
+		return blob.ErrExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err = util.MoveFile(fullPath, dst); err != nil {
+		return err
+	}
+	pruneEmptyParents(t.trashPath, path.Dir(trashPath.String()), nil)
+	return nil
+}
+
+func (t *LocalTrash) Purge(trashPath util.RelPathType) error {
+	fullPath, _, err := t.trashed(trashPath)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(fullPath); err != nil {
+		return err
+	}
+	pruneEmptyParents(t.trashPath, path.Dir(trashPath.String()), nil)
+	return nil
+}
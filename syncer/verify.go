@@ -0,0 +1,236 @@
+package syncer
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	"io"
+	"log"
+	"math/rand"
+	"sort"
+)
+
+// Kinds of VerifyDiff.
+const (
+	// The blob has no local file.
+	VerifyMissingLocally = "missing-locally"
+	// The local file has no blob.
+	VerifyMissingRemotely = "missing-remotely"
+	// Both are there with different content.
+	VerifyMismatched = "mismatched"
+	// The content of the blob does not have the md5 it is listed with.
+	VerifyBadContent = "bad-content"
+	// The blob could not be downloaded to check its content. See VerifyDiff.Error.
+	VerifyUnreadable = "unreadable"
+)
+
+// VerifyOptions has the optional settings of Verify. The zero value only
+// compares the listings.
+type VerifyOptions struct {
+	// Fraction (0 to 1) of the blobs that are downloaded to check their content.
+	Sample float64
+	// Fix the differences with the actions a round would use. Nothing is removed:
+	// a missing side is written from the other one, mismatched files are resolved
+	// like a conflict (the older version is kept as a conflict copy) and blobs with
+	// bad content are uploaded again. The mode of the syncer is respected.
+	Repair bool
+}
+
+// VerifyDiff is a path that is not the same on both sides.
+type VerifyDiff struct {
+	Path util.RelPathType `json:"path"`
+	Kind string           `json:"kind"`
+	// Empty if the side does not have it.
+	LocalMd5  string `json:"local_md5,omitempty"`
+	RemoteMd5 string `json:"remote_md5,omitempty"`
+	// Why the content could not be checked, for VerifyUnreadable.
+	Error string `json:"error,omitempty"`
+	// With VerifyOptions.Repair, the action applied and its error. Empty if it
+	// could not be repaired.
+	Repair      string `json:"repair,omitempty"`
+	RepairError string `json:"repair_error,omitempty"`
+
+	entry *diffFileEntry
+}
+
+// VerifyReport is the outcome of Verify.
+type VerifyReport struct {
+	// Number of files compared (the union of both sides).
+	Files int `json:"files"`
+	// Number of blobs whose content was checked.
+	Downloaded int          `json:"downloaded"`
+	Diffs      []VerifyDiff `json:"diffs"`
+}
+
+// contentMd5 downloads a blob and returns the md5 of what it got.
+func contentMd5(backend blob.Backend, name util.RelPathType) (string, error) {
+	entry, err := backend.Get(name)
+	if err != nil {
+		return "", err
+	}
+	defer entry.Content.Close()
+	hash := md5.New()
+	if _, err = io.Copy(hash, entry.Content); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Verify lists both sides from scratch (without the index) and compares the files
+// the syncer syncs by md5. Directory markers are not compared.
+func (s *syncer) Verify(opts VerifyOptions) (*VerifyReport, error) {
+	selection, err := s.currentSelection()
+	if err != nil {
+		return nil, err
+	}
+	s.selection = selection
+	local, err := util.ListFilesRec(s.localBasePath, util.WalkOptions{
+		Excludes: s.excludes,
+		Symlinks: s.symlinks,
+		Skip:     s.skipLocal,
+	})
+	if err != nil {
+		return nil, err
+	}
+	remote, err := blob.ListDirRecursive(s.backend, "")
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{}
+	addDiff := func(p util.RelPathType, kind string, localMeta *util.LocalFileMeta, remoteMeta *blob.MetaEntry) *VerifyDiff {
+		d := VerifyDiff{Path: p, Kind: kind, entry: &diffFileEntry{fileName: p, local: localMeta, remote: remoteMeta}}
+		if localMeta != nil {
+			d.LocalMd5 = localMeta.Md5sum
+		}
+		if remoteMeta != nil {
+			d.RemoteMd5 = remoteMeta.Md5
+		}
+		report.Diffs = append(report.Diffs, d)
+		return &report.Diffs[len(report.Diffs)-1]
+	}
+	for p := range local {
+		meta := local[p]
+		if p.IsDir() || !s.selection.Selected(p) {
+			continue
+		}
+		report.Files++
+		entry, ok := remote[p]
+		if !ok || !s.keepRemote(&entry) {
+			addDiff(p, VerifyMissingRemotely, &meta, nil)
+		} else if entry.Md5 != meta.Md5sum {
+			addDiff(p, VerifyMismatched, &meta, &entry)
+		}
+	}
+	for p := range remote {
+		entry := remote[p]
+		if p.IsDir() || !s.keepRemote(&entry) {
+			continue
+		}
+		if _, ok := local[p]; !ok {
+			report.Files++
+			addDiff(p, VerifyMissingLocally, nil, &entry)
+		}
+		if entry.SymlinkTarget != "" || opts.Sample <= 0 || rand.Float64() >= opts.Sample {
+			continue
+		}
+		report.Downloaded++
+		var localMeta *util.LocalFileMeta
+		if meta, ok := local[p]; ok {
+			localMeta = &meta
+		}
+		if got, err := contentMd5(s.backend, p); err != nil {
+			log.Printf("[%v] verify: downloading %v failed - %v", s.name, p, err)
+			addDiff(p, VerifyUnreadable, localMeta, &entry).Error = err.Error()
+		} else if got != entry.Md5 {
+			log.Printf("[%v] verify: %v is listed with md5 %v, its content has %v", s.name, p, entry.Md5, got)
+			addDiff(p, VerifyBadContent, localMeta, &entry)
+		}
+	}
+	sort.Slice(report.Diffs, func(i, j int) bool {
+		if report.Diffs[i].Path != report.Diffs[j].Path {
+			return report.Diffs[i].Path < report.Diffs[j].Path
+		}
+		return report.Diffs[i].Kind < report.Diffs[j].Kind
+	})
+	if opts.Repair {
+		err = s.repair(report.Diffs)
+	}
+	return report, err
+}
+
+// repairAction is the action that fixes a difference, nil if there is none.
+// badContent has the paths whose blob can not be trusted, which are only
+// repaired by uploading a good local copy.
+func (s *syncer) repairAction(d *VerifyDiff, badContent map[util.RelPathType]bool) action {
+	de := d.entry
+	if badContent[d.Path] && d.Kind != VerifyBadContent {
+		return nil
+	}
+	switch d.Kind {
+	case VerifyMissingLocally:
+		return de.localWrite(s)
+	case VerifyMissingRemotely:
+		return de.blobWrite(s)
+	case VerifyMismatched:
+		return s.resolveConflict(de)
+	case VerifyBadContent:
+		if de.local == nil || de.local.Md5sum != de.remote.Md5 {
+			// There is no good copy to upload.
+			return nil
+		}
+		bw := de.blobWrite(s)
+		// The listed md5 matches the local file, which would skip the write.
+		remote := *de.remote
+		remote.Md5 = ""
+		bw.remoteMeta = &remote
+		return bw
+	}
+	return nil
+}
+
+// repair applies the repair actions with the index open, so that it does not run
+// at the same time as a round. The next round records the outcome.
+func (s *syncer) repair(diffs []VerifyDiff) error {
+	ix, err := s.openIndex()
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+	if s.lease != nil {
+		if err = s.lease.acquire(); err != nil {
+			return err
+		}
+		defer s.lease.release()
+	}
+	s.remoteDirMarkers = make(map[util.RelPathType]bool)
+	badContent := make(map[util.RelPathType]bool)
+	for _, d := range diffs {
+		if d.Kind == VerifyBadContent || d.Kind == VerifyUnreadable {
+			badContent[d.Path] = true
+		}
+	}
+	for i := range diffs {
+		d := &diffs[i]
+		a := s.repairAction(d, badContent)
+		if a == nil {
+			continue
+		} else if !s.mode.allows(a) {
+			log.Printf("[%v] verify: not repairing %v with %v in %v mode", s.name, d.Path, a, s.mode)
+			continue
+		}
+		d.Repair = a.String()
+		actionsTotal.Inc(s.name, a.kind())
+		if err := s.doAction(a); isSkipped(err) {
+			d.RepairError = err.Error()
+		} else if err != nil {
+			actionFailuresTotal.Inc(s.name, a.kind())
+			d.RepairError = err.Error()
+			log.Printf("[%v] verify: failure in %v - %v", s.name, a, err)
+		} else {
+			s.journalAction(a)
+		}
+	}
+	s.flushJournal()
+	return nil
+}
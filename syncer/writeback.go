@@ -0,0 +1,83 @@
+package syncer
+
+import (
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/util"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// WriteBack uploads the file relPath under localBasePath, which was changed from
+// the version with md5 baseMd5 (empty for a new file), deciding like a round
+// would. If the blob changed since the base too, the conflict is resolved as in
+// resolveConflict, except that a newer blob is never overwritten locally: the
+// written version is uploaded next to it as a conflict copy instead. It is used
+// by the mount, whose files are not part of a pair.
+func WriteBack(backend blob.Backend, localBasePath string, relPath util.RelPathType, baseMd5 string) error {
+	s := &syncer{
+		name:             "writeBack",
+		localBasePath:    localBasePath,
+		backend:          backend,
+		symlinks:         util.SymlinkFollow,
+		mode:             SyncModeUploadOnly,
+		remoteDirMarkers: make(map[util.RelPathType]bool),
+	}
+	local, err := util.GetLocalFileMeta(localBasePath, relPath.String(), s.symlinks)
+	if err != nil {
+		return err
+	}
+	remote, err := backend.GetMeta(relPath)
+	if err == blob.ErrNotExist {
+		remote = nil
+	} else if err != nil {
+		return err
+	}
+	de := &diffFileEntry{fileName: relPath, local: local, remote: remote, baseMd5: baseMd5}
+	var base *string
+	if baseMd5 != "" {
+		base = &baseMd5
+	}
+	de.localChange = changeOf(base, &local.Md5sum)
+	if remote != nil {
+		de.remoteChange = changeOf(base, &remote.Md5)
+	} else {
+		de.remoteChange = changeOf(base, nil)
+	}
+
+	a := de.getAction(s)
+	if cw, ok := a.(*conflictWrite); ok && cw.side() == sideLocal {
+		asidePath := conflictPath(relPath, time.Now())
+		log.Printf("[%v] conflict on %v: the remote version is newer, uploading the written one as %v",
+			s.name, relPath, asidePath)
+		written, asideFile := path.Join(localBasePath, relPath.String()), path.Join(localBasePath, asidePath.String())
+		if err = util.MoveFile(written, asideFile); err != nil {
+			return fmt.Errorf("moving %v aside failed - %v", relPath, err)
+		}
+		aside := *local
+		aside.RelPath = asidePath
+		write := &blobWrite{
+			localBasePath: localBasePath,
+			relativePath:  asidePath,
+			backend:       backend,
+			symlinks:      s.symlinks,
+			localMeta:     &aside,
+		}
+		// The aside copy only exists to be uploaded. If that fails, the written
+		// version is put back for the caller to keep.
+		if err = write.do(); err != nil {
+			if moveErr := util.MoveFile(asideFile, written); moveErr != nil {
+				log.Printf("[%v] moving %v back failed - %v", s.name, asidePath, moveErr)
+			}
+			return err
+		}
+		return os.Remove(asideFile)
+	}
+	if a == nil || !s.mode.allows(a) {
+		// Nothing was changed locally.
+		return nil
+	}
+	return a.do()
+}
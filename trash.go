@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dotslash/cloudsync/blob"
+	"github.com/dotslash/cloudsync/syncer"
+	"github.com/dotslash/cloudsync/util"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Sides of a pair with a trash.
+const (
+	sideLocal  = "local"
+	sideRemote = "remote"
+)
+
+// trashFlags pick the trashes of a command: the local and remote trash of a pair
+// of the config file, or the ones given by flags.
+type trashFlags struct {
+	*remoteFlags
+	side       *string
+	localPath  *string
+	localTrash *string
+}
+
+func addTrashFlags(flags *flag.FlagSet, defaultSide, sideUsage string) *trashFlags {
+	return &trashFlags{
+		remoteFlags: addRemoteFlags(flags).withLease(flags),
+		side:        flags.String("side", defaultSide, sideUsage),
+		localPath:   flags.String("local", "", "Local path, without -config (for the local trash)"),
+		localTrash:  flags.String("local_trash", "", "Local trash, without -config. Defaults to <local>/.trash"),
+	}
+}
+
+// trashes returns the trashes picked by the flags, by side. With an empty -side
+// it is the ones that are configured.
+func (tf *trashFlags) trashes(flags *flag.FlagSet) map[string]blob.Trash {
+	side := *tf.side
+	if side != "" && side != sideLocal && side != sideRemote {
+		usageError(flags, "Bad -side %q, expected %v or %v", side, sideLocal, sideRemote)
+	}
+	ret := make(map[string]blob.Trash)
+	if side == sideRemote || (side == "" && tf.hasRemote()) {
+		trash, ok := tf.backend(flags).(blob.Trash)
+		if !ok {
+			fail("The remote has no trash")
+		}
+		ret[sideRemote] = trash
+	}
+	if side == sideRemote {
+		return ret
+	}
+	localPath, localTrash := *tf.localPath, *tf.localTrash
+	if *tf.configPath != "" {
+		cfg, pair, err := tf.pair()
+		if err != nil {
+			usageError(flags, "%v", err)
+		}
+		initMachineId(cfg)
+		localPath, localTrash = pair.Local, pair.LocalTrash
+		if localTrash == "" && side == sideLocal {
+			fail("The pair %v has no local trash", pair.Name)
+		}
+	} else if localPath != "" {
+		initMachineId(nil)
+		if localTrash == "" {
+			localTrash = path.Join(localPath, ".trash")
+		}
+	} else if side == sideLocal {
+		usageError(flags, "Either -config or -local is needed for the local trash")
+	}
+	if localTrash != "" {
+		trash, err := syncer.NewLocalTrash(localPath, localTrash)
+		if err != nil {
+			fail("%v", err)
+		}
+		ret[sideLocal] = trash
+	}
+	if len(ret) == 0 {
+		usageError(flags, "Either -config, -remote or -local is needed")
+	}
+	return ret
+}
+
+// trashFilter picks the trash entries a command works on.
+type trashFilter struct {
+	olderThan time.Duration
+	match     *util.ExcludeMatcher
+}
+
+func (f *trashFilter) keep(e blob.TrashEntry, now time.Time) bool {
+	if f.olderThan > 0 && now.Sub(e.DeletedAt) < f.olderThan {
+		return false
+	}
+	return f.match == nil || f.match.Excluded(e.OriginalPath, false)
+}
+
+// trashCommand lists the blobs in the trashes, oldest first. With -empty they
+// are removed for good.
+func trashCommand(args []string) {
+	flags := newFlagSet("trash")
+	tf := addTrashFlags(flags, "", "Only this trash: local or remote. By default the ones that are configured")
+	olderThan := flags.Duration("older_than", 0, "Only the entries removed at least this long ago. Eg: 720h")
+	match := flags.String("match", "",
+		"Only the entries whose original path matches this pattern (like in excludes). Eg: *.log, /build/")
+	empty := flags.Bool("empty", false, "Remove the entries from the trash for good")
+	asJson := flags.Bool("json", false, "Print the entries as json, one per line")
+	_ = flags.Parse(args)
+	if flags.NArg() > 1 {
+		usageError(flags, "Unexpected arguments %v", flags.Args()[1:])
+	}
+	filter := &trashFilter{olderThan: *olderThan}
+	if *match != "" {
+		filter.match = util.NewExcludeMatcher([]string{*match})
+	}
+	prefix := remotePrefix(flags, flags.Arg(0))
+	trashes := tf.trashes(flags)
+	release := func() {}
+	if remote, ok := trashes[sideRemote]; ok && *empty {
+		release = tf.holdLease(flags, remote.(blob.Backend))
+	}
+
+	now := time.Now()
+	encoder := json.NewEncoder(os.Stdout)
+	failed := false
+	for _, side := range []string{sideLocal, sideRemote} {
+		trash, ok := trashes[side]
+		if !ok {
+			continue
+		}
+		entries, err := trash.ListTrash(prefix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v trash: %v\n", side, err)
+			failed = true
+			continue
+		}
+		for _, e := range entries {
+			if !filter.keep(e, now) {
+				continue
+			}
+			if *empty {
+				if err = trash.Purge(e.TrashPath); err != nil {
+					fmt.Fprintf(os.Stderr, "%v: %v\n", e.TrashPath, err)
+					failed = true
+				} else {
+					fmt.Printf("purged %v %v\n", side, e.TrashPath)
+				}
+			} else if *asJson {
+				_ = encoder.Encode(struct {
+					Side string `json:"side"`
+					blob.TrashEntry
+				}{side, e})
+			} else {
+				by := e.DeletedBy
+				if by == "" {
+					by = "-"
+				} else if util.IsOwnClientId(by) {
+					by += " (this machine)"
+				}
+				fmt.Printf("%-6v %v %8v %v  deleted by %v\n    %v\n", side,
+					e.DeletedAt.Local().Format("2006-01-02 15:04:05"), formatBytes(e.Size), e.OriginalPath, by, e.TrashPath)
+			}
+		}
+	}
+	release()
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// parseTrashed returns the time of removal and the original path of a trash
+// path, which can start with the trash prefix.
+func parseTrashed(trashPath util.RelPathType) (time.Time, util.RelPathType, bool) {
+	rel := trashPath.String()
+	for {
+		if deletedAt, original, ok := util.ParseTrashPath(rel); ok {
+			return deletedAt, original, true
+		}
+		slash := strings.Index(rel, "/")
+		if slash < 0 {
+			return time.Time{}, "", false
+		}
+		rel = rel[slash+1:]
+	}
+}
+
+// restoreCommand moves entries of a trash back to their original path (or to
+// -to). If the path is taken, the entry is left in the trash unless -rename is
+// given.
+func restoreCommand(args []string) {
+	flags := newFlagSet("restore")
+	tf := addTrashFlags(flags, sideRemote, "The trash the entries are in: local or remote")
+	toFlag := flags.String("to", "", "Restore the (single) entry here instead of its original path")
+	rename := flags.Bool("rename", false,
+		"If the path is taken, restore next to it as <name>.restored-<time of removal>.<ext>")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		usageError(flags, "restore needs the trash path(s) printed by `cloudsync trash`")
+	} else if *toFlag != "" && flags.NArg() != 1 {
+		usageError(flags, "-to needs a single trash path")
+	}
+	var trashPaths []util.RelPathType
+	for _, arg := range flags.Args() {
+		trashPaths = append(trashPaths, remotePath(flags, arg))
+	}
+	to := util.RelPathType(remotePrefix(flags, *toFlag))
+	trash := tf.trashes(flags)[*tf.side]
+	release := func() {}
+	if *tf.side == sideRemote {
+		release = tf.holdLease(flags, trash.(blob.Backend))
+	}
+	failed := false
+	for _, trashPath := range trashPaths {
+		dest := to
+		err := trash.Restore(trashPath, dest)
+		if err == blob.ErrExists && *rename {
+			deletedAt, original, ok := parseTrashed(trashPath)
+			if dest == "" && ok {
+				dest = original
+			}
+			if dest != "" {
+				dest = blob.RestoredPath(dest, deletedAt)
+				err = trash.Restore(trashPath, dest)
+			}
+		}
+		if err == blob.ErrExists {
+			fmt.Fprintf(os.Stderr, "%v: the path is taken, not overwriting it (see -rename and -to)\n", trashPath)
+			failed = true
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", trashPath, err)
+			failed = true
+		} else if dest != "" {
+			fmt.Printf("restored %v as %v\n", trashPath, dest)
+		} else {
+			fmt.Printf("restored %v\n", trashPath)
+		}
+	}
+	release()
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+	"path"
+	"strings"
+)
+
+type excludePattern struct {
+	pattern  string
+	anchored bool // pattern has a "/" in it => match against the path from the root
+	dirOnly  bool // pattern ends with "/" => only matches directories
+}
+
+// ExcludeMatcher decides which paths should be left out of the sync. The patterns
+// are a small subset of gitignore:
+//   - "*.tmp", ".git"  match a file or directory with that name at any depth
+//   - "build/"         matches only directories
+//   - "/out", "a/b/*"  are anchored to the root of the sync
+//
+// Anything inside an excluded directory is excluded too.
+type ExcludeMatcher struct {
+	patterns []excludePattern
+}
+
+func NewExcludeMatcher(patterns []string) *ExcludeMatcher {
+	ret := &ExcludeMatcher{}
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		entry := excludePattern{}
+		if strings.HasSuffix(p, "/") {
+			entry.dirOnly = true
+			p = strings.TrimSuffix(p, "/")
+		}
+		if strings.Contains(p, "/") {
+			entry.anchored = true
+			p = strings.TrimPrefix(p, "/")
+		}
+		entry.pattern = p
+		ret.patterns = append(ret.patterns, entry)
+	}
+	return ret
+}
+
+func (m *ExcludeMatcher) matches(relPath string, isDir bool) bool {
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		target := relPath
+		if !p.anchored {
+			target = path.Base(relPath)
+		}
+		if ok, _ := path.Match(p.pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Excluded returns true if relPath or any of its parent directories is excluded.
+// A nil matcher excludes nothing.
+func (m *ExcludeMatcher) Excluded(relPath RelPathType, isDir bool) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+	parts := strings.Split(strings.Trim(relPath.String(), "/"), "/")
+	for i := range parts {
+		partIsDir := isDir || i < len(parts)-1
+		if m.matches(strings.Join(parts[:i+1], "/"), partIsDir) {
+			return true
+		}
+	}
+	return false
+}
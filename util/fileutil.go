@@ -6,76 +6,333 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"time"
 )
 import "path/filepath"
 
+// SymlinkPolicy decides what the local walker does with symlinks.
+type SymlinkPolicy string
+
+const (
+	// Symlinks are ignored.
+	SymlinkSkip SymlinkPolicy = "skip"
+	// Symlinks are synced as the files/directories they point to. Links that
+	// point outside the sync root, dangling links and links that lead to a cycle
+	// are ignored.
+	SymlinkFollow SymlinkPolicy = "follow"
+	// Symlinks are synced as links. The remote blob holds the target and is
+	// recreated as a symlink by the other machines.
+	SymlinkLink SymlinkPolicy = "link"
+)
+
+func (p SymlinkPolicy) Valid() bool {
+	return p == SymlinkSkip || p == SymlinkFollow || p == SymlinkLink
+}
+
 type LocalFileMeta struct {
 	BaseDir string
 	RelPath RelPathType
 	ModTime time.Time
 	Md5sum  string // hex string of md5 hash
+	Size    int64
+	// Only set for symlinks with SymlinkLink. Md5sum is the md5 of the target.
+	SymlinkTarget string `json:",omitempty"`
 }
 
-func GetLocalFileMeta(basePath, relPath string) (*LocalFileMeta, error) {
+// WalkOptions control what WalkFilesRec returns.
+type WalkOptions struct {
+	// Can be nil
+	Excludes *ExcludeMatcher
+	// Defaults to SymlinkFollow
+	Symlinks SymlinkPolicy
+	// Can be nil. Paths (and directories) for which it returns true are skipped
+	// like excluded ones.
+	Skip func(relPath RelPathType, isDir bool) bool
+}
+
+func (o *WalkOptions) skipped(relPath RelPathType, isDir bool) bool {
+	return o.Excludes.Excluded(relPath, isDir) || (o.Skip != nil && o.Skip(relPath, isDir))
+}
+
+func GetLocalFileMeta(basePath, relPath string, symlinks SymlinkPolicy) (*LocalFileMeta, error) {
 	fullpath := path.Join(basePath, relPath)
-	if info, err := os.Stat(fullpath); err != nil {
+	info, err := os.Lstat(fullpath)
+	if err != nil {
 		return nil, err
-	} else {
-		return makeLocalFileMeta(basePath, fullpath, info)
 	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		switch symlinks {
+		case SymlinkLink:
+			return makeLinkMeta(basePath, RelPathType(relPath))
+		case SymlinkSkip:
+			return nil, fmt.Errorf("%v is a symlink", fullpath)
+		}
+		if info, err = os.Stat(fullpath); err != nil {
+			return nil, err
+		}
+	}
+	if info.IsDir() {
+		return &LocalFileMeta{
+			BaseDir: basePath,
+			RelPath: RelPathType(strings.TrimSuffix(relPath, "/") + "/"),
+			ModTime: info.ModTime(),
+			Md5sum:  EmptyMd5,
+		}, nil
+	}
+	return makeLocalFileMeta(basePath, RelPathType(relPath), info)
 }
 
-// TODO: this method takes basePath and fullPath. This is bazzare. Fix it.
-func makeLocalFileMeta(basePath, path string, info fs.FileInfo) (*LocalFileMeta, error) {
+func makeLocalFileMeta(basePath string, relPath RelPathType, info fs.FileInfo) (*LocalFileMeta, error) {
 	PanicIf(
 		strings.HasSuffix(basePath, "/"),
 		fmt.Sprintf("Base path should not end with /: %v", basePath),
 	)
 	PanicIfFalse(
-		strings.HasPrefix(path, "/"),
-		fmt.Sprintf("path should start with /: %v", path),
+		strings.HasPrefix(basePath, "/"),
+		fmt.Sprintf("Base path should start with /: %v", basePath),
 	)
 
 	hasher := md5.New()
-	if file, err := os.Open(path); err != nil {
+	file, err := os.Open(path.Join(basePath, relPath.String()))
+	if err != nil {
 		return nil, err
-	} else if _, err = io.Copy(hasher, file); err != nil {
+	}
+	defer file.Close()
+	if _, err = io.Copy(hasher, file); err != nil {
 		return nil, err
 	}
 	return &LocalFileMeta{
 		BaseDir: basePath,
-		RelPath: RelPathType(strings.TrimPrefix(path, basePath+"/")),
+		RelPath: relPath,
 		ModTime: info.ModTime(),
 		Md5sum:  hex.EncodeToString(hasher.Sum(nil)),
+		Size:    info.Size(),
 	}, nil
 }
 
-func ListFilesRec(basePath string) (ret map[RelPathType]LocalFileMeta, err error) {
+func makeLinkMeta(basePath string, relPath RelPathType) (*LocalFileMeta, error) {
+	fullPath := path.Join(basePath, relPath.String())
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	target, err := os.Readlink(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	hash := md5.Sum([]byte(target))
+	return &LocalFileMeta{
+		BaseDir:       basePath,
+		RelPath:       relPath,
+		ModTime:       info.ModTime(),
+		Md5sum:        hex.EncodeToString(hash[:]),
+		Size:          int64(len(target)),
+		SymlinkTarget: target,
+	}, nil
+}
+
+// isInside returns true if p is root or is under root. Both should be clean.
+func isInside(root, p string) bool {
+	return p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/")
+}
+
+// ResolvesInside returns true if fullPath (after resolving all the symlinks)
+// is inside basePath. Paths that dont exist yet are resolved as far as possible.
+func ResolvesInside(basePath, fullPath string) bool {
+	realBase, err := filepath.EvalSymlinks(basePath)
+	if err != nil {
+		return false
+	}
+	// Walk up till we find something that exists.
+	suffix := ""
+	for p := fullPath; ; p = path.Dir(p) {
+		if real, err := filepath.EvalSymlinks(p); err == nil {
+			return isInside(realBase, path.Join(real, suffix))
+		} else if p == "/" || p == "." {
+			return false
+		}
+		suffix = path.Join(path.Base(p), suffix)
+	}
+}
+
+type walker struct {
+	basePath string
+	realBase string
+	opts     WalkOptions
+	emit     func(meta LocalFileMeta) error
+	// Real paths of the directories being walked (the current dir and its
+	// parents). Following a link to one of these would never end.
+	ancestors map[string]bool
+}
+
+// walkEntry is a directory entry that passed the symlink policy and the excludes.
+type walkEntry struct {
+	path     string
+	rel      RelPathType
+	real     string
+	info     fs.FileInfo
+	linkMeta *LocalFileMeta // Only for SymlinkLink
+}
+
+// sortKey orders the entries the way their RelPaths (and the paths under them)
+// compare. A directory "a" sorts as "a/", so it comes after "a.txt".
+func (e *walkEntry) sortKey() string {
+	if e.linkMeta == nil && e.info.IsDir() {
+		return e.rel.String() + "/"
+	}
+	return e.rel.String()
+}
+
+// readDir returns the entries of dirPath that should be walked, sorted by sortKey.
+func (w *walker) readDir(dirPath, relDir, realDir string) ([]*walkEntry, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*walkEntry
+	for _, entry := range entries {
+		e := &walkEntry{
+			path: path.Join(dirPath, entry.Name()),
+			rel:  RelPathType(path.Join(relDir, entry.Name())),
+			real: path.Join(realDir, entry.Name()),
+		}
+		if entry.Type()&fs.ModeSymlink != 0 {
+			if w.opts.Symlinks == SymlinkSkip {
+				continue
+			} else if w.opts.Symlinks == SymlinkLink {
+				if w.opts.skipped(e.rel, false) {
+					continue
+				}
+				if e.linkMeta, err = makeLinkMeta(w.basePath, e.rel); err != nil {
+					return nil, err
+				}
+				ret = append(ret, e)
+				continue
+			}
+			// SymlinkFollow
+			if e.real, err = filepath.EvalSymlinks(e.path); err != nil {
+				log.Printf("ListFilesRec: skipping dangling symlink %v - %v", e.path, err)
+				continue
+			} else if !isInside(w.realBase, e.real) {
+				log.Printf("ListFilesRec: skipping symlink %v, it points outside %v", e.path, w.basePath)
+				continue
+			} else if e.info, err = os.Stat(e.path); err != nil {
+				return nil, err
+			} else if e.info.IsDir() && w.ancestors[e.real] {
+				log.Printf("ListFilesRec: skipping symlink %v, it leads to a cycle", e.path)
+				continue
+			}
+		} else if e.info, err = entry.Info(); err != nil {
+			return nil, err
+		}
+		if w.opts.skipped(e.rel, e.info.IsDir()) {
+			continue
+		} else if !e.info.IsDir() && !e.info.Mode().IsRegular() {
+			// sockets, pipes, devices etc.
+			continue
+		}
+		ret = append(ret, e)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].sortKey() < ret[j].sortKey() })
+	return ret, nil
+}
+
+// walkDir emits the files in dirPath (whose path relative to the base is relDir
+// and whose path after resolving links is realDir). It returns the number of
+// emitted entries. If nothing in the directory is synced, the directory itself
+// is emitted as "<relDir>/".
+func (w *walker) walkDir(dirPath, relDir, realDir string) (numEmitted int, err error) {
+	w.ancestors[realDir] = true
+	defer delete(w.ancestors, realDir)
+	entries, err := w.readDir(dirPath, relDir, realDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if e.linkMeta != nil {
+			err = w.emit(*e.linkMeta)
+		} else if e.info.IsDir() {
+			var n int
+			n, err = w.walkDir(e.path, e.rel.String(), e.real)
+			numEmitted += n
+			if err != nil {
+				return numEmitted, err
+			}
+			continue
+		} else if meta, metaErr := makeLocalFileMeta(w.basePath, e.rel, e.info); metaErr != nil {
+			err = metaErr
+		} else {
+			err = w.emit(*meta)
+		}
+		if err != nil {
+			return numEmitted, err
+		}
+		numEmitted++
+	}
+	if relDir != "" && numEmitted == 0 {
+		return 1, w.emitEmptyDir(dirPath, relDir)
+	}
+	return numEmitted, nil
+}
+
+func (w *walker) emitEmptyDir(dirPath, relDir string) error {
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		return err
+	}
+	relPath := RelPathType(relDir + "/")
+	return w.emit(LocalFileMeta{
+		BaseDir: w.basePath,
+		RelPath: relPath,
+		ModTime: info.ModTime(),
+		Md5sum:  EmptyMd5,
+	})
+}
+
+// WalkFilesRec calls fn with the metadata of all the files under basePath, in
+// the (byte) order of their RelPaths. Paths matched by opts.Excludes or opts.Skip
+// are skipped and symlinks are handled as per opts.Symlinks. Empty directories
+// are returned as "<dir>/" (see RelPathType.IsDir). The walk stops at the first
+// error from fn.
+func WalkFilesRec(basePath string, opts WalkOptions, fn func(meta LocalFileMeta) error) error {
 	PanicIfFalse(
 		strings.HasPrefix(basePath, "/") && !strings.HasSuffix(basePath, "/"),
 		fmt.Sprintf("Base path must begin with / and must not end with /: %v", basePath),
 	)
-	ret = make(map[RelPathType]LocalFileMeta)
-	err = filepath.WalkDir(basePath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if info, err := d.Info(); err != nil {
-			return err
-		} else if info.IsDir() {
-			return nil
-		} else if meta, err := makeLocalFileMeta(basePath, path, info); err != nil {
-			return err
-		} else {
-			ret[meta.RelPath] = *meta
-			return nil
-		}
+	if opts.Symlinks == "" {
+		opts.Symlinks = SymlinkFollow
+	}
+	realBase, err := filepath.EvalSymlinks(basePath)
+	if err != nil {
+		return err
+	}
+	w := &walker{
+		basePath:  basePath,
+		realBase:  realBase,
+		opts:      opts,
+		emit:      fn,
+		ancestors: make(map[string]bool),
+	}
+	_, err = w.walkDir(basePath, "", realBase)
+	return err
+}
+
+// ListFilesRec is WalkFilesRec collecting the files in a map.
+func ListFilesRec(basePath string, opts WalkOptions) (map[RelPathType]LocalFileMeta, error) {
+	ret := make(map[RelPathType]LocalFileMeta)
+	err := WalkFilesRec(basePath, opts, func(meta LocalFileMeta) error {
+		ret[meta.RelPath] = meta
+		return nil
 	})
-	return ret, err
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
 // created this so that we can use defer for the reader, writer in for loops
@@ -85,3 +342,27 @@ func CopyAndClose(to io.WriteCloser, from io.ReadCloser) error {
 	_, err := io.Copy(to, from)
 	return err
 }
+
+// MoveFile moves src to dst creating the parent directories of dst. Falls back to
+// copy + remove when a rename is not possible (Eg: dst is on another device).
+func MoveFile(src, dst string) error {
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	from, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	to, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		from.Close()
+		return err
+	}
+	if err := CopyAndClose(to, from); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
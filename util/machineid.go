@@ -0,0 +1,162 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	machineIdFile        = "machine_id"
+	legacyMachineIdsFile = "legacy_machine_ids"
+)
+
+// UniqueMachineId identifies this machine as the writer of blobs. It is set by
+// InitMachineId.
+var UniqueMachineId string
+
+// Ids this machine used before the id was stored on disk. Blobs written with
+// these ids are still treated as written by this machine.
+var legacyMachineIds []string
+
+// InitMachineId sets UniqueMachineId. The id is read from <stateDir>/machine_id,
+// a random one is generated and stored there on the first run. A non empty
+// override is used as is (and not stored).
+//
+// The ids in <stateDir>/legacy_machine_ids (one per line) are recognized as this
+// machine's too. The old mac address based id (see GetLegacyMachineId) is not
+// adopted on its own: clones of a vm or containers with the same mac share it and
+// would take each other's blobs for their own. To keep recognizing the blobs
+// uploaded by older versions, write it to that file (the first run logs it).
+func InitMachineId(stateDir string, override string) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	legacyIds, err := readLines(path.Join(stateDir, legacyMachineIdsFile))
+	if err != nil {
+		return err
+	}
+	idPath := path.Join(stateDir, machineIdFile)
+	ids, err := readLines(idPath)
+	if err != nil {
+		return err
+	}
+	id := ""
+	if len(ids) != 0 {
+		id = ids[0]
+	} else {
+		if id, err = newRandomId(); err != nil {
+			return err
+		}
+		if legacyId, err := GetLegacyMachineId(); err == nil && len(legacyIds) == 0 {
+			log.Printf("InitMachineId: the blobs written by older versions have the id %v. If no other machine "+
+				"had the same mac address, add it to %v to keep treating them as written by this machine",
+				legacyId, path.Join(stateDir, legacyMachineIdsFile))
+		}
+		if err = writeLines(idPath, []string{id}); err != nil {
+			return err
+		}
+		log.Printf("InitMachineId: generated a new machine id %v in %v", id, idPath)
+	}
+	if override = strings.TrimSpace(override); override != "" {
+		id = override
+	}
+	UniqueMachineId = id
+	legacyMachineIds = legacyIds
+	log.Printf("InitMachineId: %v (legacy ids: %v)", UniqueMachineId, legacyMachineIds)
+	return nil
+}
+
+// IsOwnClientId returns true if the blob writer id belongs to this machine.
+func IsOwnClientId(id string) bool {
+	if id == UniqueMachineId {
+		return true
+	}
+	for _, legacyId := range legacyMachineIds {
+		if id == legacyId {
+			return true
+		}
+	}
+	return false
+}
+
+// newRandomId returns a random (version 4) uuid.
+func newRandomId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// readLines returns the non empty lines of the file. A missing file has no lines.
+func readLines(filePath string) ([]string, error) {
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret, nil
+}
+
+func writeLines(filePath string, lines []string) error {
+	return os.WriteFile(filePath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// GetLegacyMachineId returns the id older versions used. It is derived from the
+// first mac address, so it changes with the network interfaces and is the same
+// for containers/vms with the same mac.
+//
+// NOTE: sha1.New().Sum(mac) appends the sha1 of nothing to the mac, it does not
+// hash the mac. Dont fix it, the point is to return what the older versions
+// wrote in the WriterClientId of the blobs.
+func GetLegacyMachineId() (string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	// Sort the interfaces.
+	sort.Slice(interfaces, func(i, j int) bool {
+		return interfaces[i].Name < interfaces[j].Name
+	})
+
+	macAddress := ""
+	for _, i := range interfaces {
+		if i.Name == "en0" { // In mac en0 is the wifi network interface.
+			macAddress = i.HardwareAddr.String()
+			break
+		}
+		// Make sure that the interface has a hardware address.
+		// Not clear to me if this is the "perfect" thing to do. But should be fine.
+		// NOTE: Maybe i should check if the interface is up or not. Did not do it because
+		// I want to make sure when this function is called twice, it will return the same
+		// address
+		if bytes.Compare(i.HardwareAddr, nil) != 0 {
+			// Don't use random as we have a real address
+			macAddress = i.HardwareAddr.String()
+			break
+		}
+	}
+	if macAddress == "" {
+		return "", errors.New("could not find mac address")
+	}
+	return base64.StdEncoding.EncodeToString(sha1.New().Sum([]byte(macAddress))), nil
+}
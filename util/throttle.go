@@ -0,0 +1,221 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest chunk a throttled reader hands out in one Read. Keeps the sleeps short
+// so that a rate change is picked up quickly.
+const throttleChunkSize = 32 * 1024
+
+// RateScheduleEntry overrides the base rate of a RateLimiter between Start and End
+// (both are offsets from local midnight). If End is before Start the window wraps
+// around midnight.
+type RateScheduleEntry struct {
+	Start       time.Duration
+	End         time.Duration
+	BytesPerSec int64
+}
+
+func (e RateScheduleEntry) contains(t time.Time) bool {
+	return TimeWindow{Start: e.Start, End: e.End}.Contains(t)
+}
+
+// RateLimiter is a token bucket shared by all the readers it throttles. A rate of
+// 0 means unlimited. The rate and the schedule can be changed at any time, readers
+// that are currently waiting pick up the new rate on their next chunk.
+type RateLimiter struct {
+	mu       sync.Mutex
+	rate     int64
+	schedule []RateScheduleEntry
+	// See SetOverride.
+	override    int64
+	hasOverride bool
+	tokens      float64
+	last        time.Time
+}
+
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{rate: bytesPerSec, last: time.Now()}
+}
+
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = bytesPerSec
+}
+
+// SetOverride makes the limiter use bytesPerSec, whatever the base rate and the
+// schedule say, until ClearOverride. It is for the changes made at runtime.
+func (l *RateLimiter) SetOverride(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.override, l.hasOverride = bytesPerSec, true
+}
+
+// ClearOverride goes back to the base rate and the schedule.
+func (l *RateLimiter) ClearOverride() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.override, l.hasOverride = 0, false
+}
+
+func (l *RateLimiter) SetSchedule(schedule []RateScheduleEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.schedule = schedule
+}
+
+// Rate returns the rate that is in effect right now (after applying the override
+// and the schedule).
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.currentRate(time.Now())
+}
+
+func (l *RateLimiter) currentRate(now time.Time) int64 {
+	if l.hasOverride {
+		return l.override
+	}
+	for _, e := range l.schedule {
+		if e.contains(now) {
+			return e.BytesPerSec
+		}
+	}
+	return l.rate
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller has to
+// wait before using them.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	rate := l.currentRate(now)
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		return 0
+	}
+	// Allow at most one second worth of burst.
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes are allowed to pass.
+func (l *RateLimiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+	if wait := l.reserve(n); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type throttledReader struct {
+	reader  io.ReadCloser
+	limiter *RateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		t.limiter.WaitN(n)
+	}
+	return n, err
+}
+
+func (t *throttledReader) Close() error {
+	return t.reader.Close()
+}
+
+// NewThrottledReader returns a reader that reads from reader no faster than the
+// limiter allows. A nil limiter returns reader as is.
+func NewThrottledReader(reader io.ReadCloser, limiter *RateLimiter) io.ReadCloser {
+	if limiter == nil {
+		return reader
+	}
+	return &throttledReader{reader: reader, limiter: limiter}
+}
+
+// ParseByteRate parses rates like "512K", "1.5M", "100" (bytes per sec).
+// The suffixes are powers of 1024. "0", "" and "unlimited" mean no limit.
+func ParseByteRate(s string) (int64, error) {
+	rate, err := ParseByteSize(strings.TrimSuffix(strings.TrimSpace(strings.ToUpper(s)), "/S"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate, nil
+}
+
+// ParseByteSize parses sizes like "512K", "1.5G", "100" (bytes). The suffixes
+// are powers of 1024. "0", "" and "unlimited" mean no limit.
+func ParseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	s = strings.TrimSuffix(s, "B")
+	if s == "" || s == "UNLIMITED" {
+		return 0, nil
+	}
+	multiplier := 1.0
+	switch s[len(s)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	// Past MaxInt64 the conversion is undefined, and a negative size would mean
+	// no limit.
+	if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) || value*multiplier >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * multiplier), nil
+}
+
+// ParseRateSchedule parses a comma separated list of "HH:MM-HH:MM=<rate>" entries.
+// Eg: "09:00-18:00=512K,18:00-23:00=2M". Earlier entries win if windows overlap.
+func ParseRateSchedule(s string) ([]RateScheduleEntry, error) {
+	var ret []RateScheduleEntry
+	if strings.TrimSpace(s) == "" {
+		return ret, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("schedule entry %q has no rate", part)
+		}
+		window, err := parseTimeWindow(part[:i])
+		if err != nil {
+			return nil, fmt.Errorf("schedule entry %q has an invalid window - %v", part, err)
+		}
+		rate, err := ParseByteRate(part[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, RateScheduleEntry{Start: window.Start, End: window.End, BytesPerSec: rate})
+	}
+	return ret, nil
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a daily window between Start and End (both are offsets from local
+// midnight). If End is before Start the window wraps around midnight.
+type TimeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+}
+
+func (w TimeWindow) Contains(t time.Time) bool {
+	offset := sinceMidnight(t)
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// EndAfter returns the first end of the window after t.
+func (w TimeWindow) EndAfter(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	end := midnight.Add(w.End)
+	if !end.After(t) {
+		end = midnight.AddDate(0, 0, 1).Add(w.End)
+	}
+	return end
+}
+
+func (w TimeWindow) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+	return format(w.Start) + "-" + format(w.End)
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseTimeWindow(s string) (TimeWindow, error) {
+	bounds := strings.Split(s, "-")
+	if len(bounds) != 2 {
+		return TimeWindow{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", s)
+	}
+	start, err := parseTimeOfDay(bounds[0])
+	if err != nil {
+		return TimeWindow{}, err
+	}
+	end, err := parseTimeOfDay(bounds[1])
+	if err != nil {
+		return TimeWindow{}, err
+	}
+	return TimeWindow{Start: start, End: end}, nil
+}
+
+// ParseTimeWindows parses a comma separated list of "HH:MM-HH:MM" windows.
+// Eg: "22:00-07:00,12:00-13:00".
+func ParseTimeWindows(s string) ([]TimeWindow, error) {
+	var ret []TimeWindow
+	if strings.TrimSpace(s) == "" {
+		return ret, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		window, err := parseTimeWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, window)
+	}
+	return ret, nil
+}
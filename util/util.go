@@ -1,24 +1,44 @@
 package util
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/base64"
-	"errors"
 	"fmt"
-	"log"
-	"net"
-	"sort"
+	"strings"
+	"time"
 )
 
 type RelPathType string
 
-var UniqueMachineId = getUniqueMachineIdOrDie()
+// TrashTimeFormat is the layout of the timestamp directory under which removed
+// files are kept in the local and the remote trash.
+const TrashTimeFormat = "20060102T150405.000000Z"
+
+// ParseTrashPath splits a path relative to a trash, "<time of removal>/<original
+// path>".
+func ParseTrashPath(rel string) (time.Time, RelPathType, bool) {
+	slash := strings.Index(rel, "/")
+	if slash < 0 {
+		return time.Time{}, "", false
+	}
+	removedAt, err := time.Parse(TrashTimeFormat, rel[:slash])
+	if err != nil || slash == len(rel)-1 {
+		return time.Time{}, "", false
+	}
+	return removedAt, RelPathType(rel[slash+1:]), true
+}
 
 func (p RelPathType) String() string {
 	return string(p)
 }
 
+// IsDir is true for the entries that stand for (empty) directories. Their path
+// ends with a "/", like the directory markers on GCS.
+func (p RelPathType) IsDir() bool {
+	return strings.HasSuffix(string(p), "/")
+}
+
+// EmptyMd5 is the md5 of no content. Directory entries have this md5.
+const EmptyMd5 = "d41d8cd98f00b204e9800998ecf8427e"
+
 func PanicIf(cond bool, msg string) {
 	if cond {
 		panic(msg)
@@ -36,48 +56,3 @@ func PanicIfErr(err error, msg string) {
 		panic(fmt.Sprintf("%v err=%v", msg, err))
 	}
 }
-
-func getUniqueMachineIdOrDie() string {
-	mid, err := GetUniqueMachineId()
-	if err != nil {
-		panic(fmt.Errorf("could not GetUniqueMachineId: %v", err))
-	} else {
-		log.Printf("getUniqueMachineIdOrDie: %v", mid)
-	}
-	return mid
-}
-
-func GetUniqueMachineId() (string, error) {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return "", err
-	}
-	// Sort the interfaces.
-	sort.Slice(interfaces, func(i, j int) bool {
-		return interfaces[i].Name < interfaces[j].Name
-	})
-
-	macAddress := ""
-	if err == nil {
-		for _, i := range interfaces {
-			if i.Name == "en0" { // In mac en0 is the wifi network interface.
-				macAddress = i.HardwareAddr.String()
-				break
-			}
-			// Make sure that the interface has a hardware address.
-			// Not clear to me if this is the "perfect" thing to do. But should be fine.
-			// NOTE: Maybe i should check if the interface is up or not. Did not do it because
-			// I want to make sure when this function is called twice, it will return the same
-			// address
-			if bytes.Compare(i.HardwareAddr, nil) != 0 {
-				// Don't use random as we have a real address
-				macAddress = i.HardwareAddr.String()
-				break
-			}
-		}
-	}
-	if macAddress == "" {
-		return "", errors.New("could not find mac address")
-	}
-	return base64.StdEncoding.EncodeToString(sha1.New().Sum([]byte(macAddress))), nil
-}
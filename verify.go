@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotslash/cloudsync/syncer"
+	"os"
+)
+
+// verifyCommand compares the local files of each pair with its blobs. It exits
+// with exitDifferences if they are not the same (and were not all repaired).
+func verifyCommand(args []string) {
+	flags := newFlagSet("verify")
+	sf := addSyncFlags(flags, true)
+	sample := flags.Float64("sample", 0,
+		"Fraction of the blobs to download to check that their content has the md5 they are listed with. 1 checks all")
+	repair := flags.Bool("repair", false,
+		"Fix the differences like a round would, without removing anything: a missing side is written from the other "+
+			"one and the older of two different versions is kept as a conflict copy")
+	asJson := flags.Bool("json", false, "Print the differences as json, one per line")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		usageError(flags, "Unexpected arguments %v", flags.Args())
+	} else if *sample < 0 || *sample > 1 {
+		usageError(flags, "-sample should be between 0 and 1, got %v", *sample)
+	}
+	syncers, _, _ := sf.syncers(flags)
+	encoder := json.NewEncoder(os.Stdout)
+	failed, differ := false, false
+	for _, s := range syncers {
+		name := s.Status().Name
+		report, err := s.Verify(syncer.VerifyOptions{Sample: *sample, Repair: *repair})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", name, err)
+			failed = true
+			continue
+		}
+		if !*asJson {
+			fmt.Printf("%v: %v file(s), %v downloaded, %v difference(s)\n",
+				name, report.Files, report.Downloaded, len(report.Diffs))
+		}
+		for _, d := range report.Diffs {
+			differ = differ || d.Repair == "" || d.RepairError != ""
+			if *asJson {
+				_ = encoder.Encode(struct {
+					Pair string `json:"pair"`
+					syncer.VerifyDiff
+				}{name, d})
+				continue
+			}
+			fmt.Printf("  %-16v %v\n", d.Kind, d.Path)
+			if d.Error != "" {
+				fmt.Printf("    %v\n", d.Error)
+			}
+			if d.RepairError != "" {
+				fmt.Printf("    %v failed: %v\n", d.Repair, d.RepairError)
+			} else if d.Repair != "" {
+				fmt.Printf("    repaired: %v\n", d.Repair)
+			} else if *repair {
+				fmt.Println("    not repaired")
+			}
+		}
+	}
+	if failed {
+		os.Exit(exitFailure)
+	} else if differ {
+		os.Exit(exitDifferences)
+	}
+}